@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"ngit-relay/shared"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/nbd-wtf/go-nostr/nip34"
+	"go.uber.org/zap"
+)
+
+// owner-signed NIP-51 set listing repositories to archive using `a` tags (repository
+// coordinates) and `p` tags (every repository announced by the pubkey)
+const (
+	KindArchiveList       = 30003
+	ArchiveListIdentifier = "ngit-relay-archive"
+)
+
+// Archive mirrors repositories, that don't list this instance, into a read-only namespace
+// within git_data_path. Entries come from the NGIT_ARCHIVE_FILE config file and the owner's
+// archive list event.
+type Archive struct {
+	relay         *khatru.Relay
+	git_data_path string
+	file          string
+	ownerPubkey   string
+	management    *RelayManagement
+	lookupRelays  []string
+	pool          *nostr.SimplePool
+	logger        *zap.Logger
+
+	mu      sync.RWMutex
+	entries []RepoPointer
+	// coordinates of archived repositories and their maintainers, resolved during Refresh
+	coordinates map[string]bool
+
+	refreshing sync.Mutex
+}
+
+func NewArchive(relay *khatru.Relay, config Config, ownerPubkey string, management *RelayManagement) *Archive {
+	return &Archive{
+		relay:         relay,
+		git_data_path: config.GitDataPath + "/" + shared.ArchiveDirName,
+		file:          config.ArchiveFile,
+		ownerPubkey:   ownerPubkey,
+		management:    management,
+		lookupRelays:  config.ArchiveLookupRelays,
+		pool:          nostr.NewSimplePool(context.Background(), nostr.WithPenaltyBox()),
+		logger:        shared.L().With(zap.String("type", "Archive")),
+		coordinates:   make(map[string]bool),
+	}
+}
+
+// Start refreshes the archive every interval
+func (a *Archive) Start(interval time.Duration) {
+	go func() {
+		// wait for the relay to start listening
+		time.Sleep(20 * time.Second)
+		for {
+			if err := a.Refresh(context.Background()); err != nil {
+				a.logger.Warn("archive refresh incomplete", zap.Error(err))
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// GitDataPath returns the directory holding archived repositories
+func (a *Archive) GitDataPath() string {
+	return a.git_data_path
+}
+
+// Includes reports whether the repository announced by pubkey with identifier is archived
+func (a *Archive) Includes(pubkey string, identifier string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.coordinates[shared.RepoCoordinate(pubkey, identifier)] {
+		return true
+	}
+	for _, entry := range a.entries {
+		if entry.PubKey == pubkey && (entry.Identifier == "" || entry.Identifier == identifier) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsArchiveListEvent reports whether event is the owner's archive list
+func (a *Archive) IsArchiveListEvent(event *nostr.Event) bool {
+	return event.Kind == KindArchiveList && event.PubKey == a.ownerPubkey && event.Tags.GetD() == ArchiveListIdentifier
+}
+
+// Refresh reloads the archive entries, imports their announcement and state events and
+// provisions and syncs each archived repository. It returns the errors provisioning
+// repositories; syncs of archived repositories are expected to fail at times so aren't errors.
+func (a *Archive) Refresh(ctx context.Context) error {
+	a.refreshing.Lock()
+	defer a.refreshing.Unlock()
+
+	entries := a.loadEntries(ctx)
+	a.mu.Lock()
+	a.entries = entries
+	a.mu.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+	a.logger.Debug("refreshing archive", zap.Int("entries", len(entries)))
+
+	coordinates := make(map[string]bool)
+	var errs []error
+	for _, entry := range entries {
+		for _, ann := range a.fetchAnnouncements(ctx, entry) {
+			repo := nip34.ParseRepository(ann)
+			coordinates[shared.RepoCoordinate(ann.PubKey, repo.ID)] = true
+			for _, maintainer := range repo.Maintainers {
+				coordinates[shared.RepoCoordinate(maintainer, repo.ID)] = true
+			}
+			a.mu.Lock()
+			for c := range coordinates {
+				a.coordinates[c] = true
+			}
+			a.mu.Unlock()
+
+			if err := a.archiveRepo(ctx, ann, entry.Relays); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	// forget coordinates that are no longer archived
+	a.mu.Lock()
+	a.coordinates = coordinates
+	a.mu.Unlock()
+	return errors.Join(errs...)
+}
+
+// archiveRepo imports the announcement and state events of the repository and its
+// maintainers, provisions the archived repository if needed and syncs it
+func (a *Archive) archiveRepo(ctx context.Context, ann nostr.Event, hintRelays []string) error {
+	repo := nip34.ParseRepository(ann)
+	logger := a.logger.With(zap.String("pubkey", ann.PubKey), zap.String("identifier", repo.ID))
+
+	if !shared.IsValidIdentifier(repo.ID) {
+		logger.Debug("not archiving repository with invalid identifier")
+		return nil
+	}
+	if blocked, reason := a.management.IsRepoBlocked(ann.PubKey, repo.ID); blocked {
+		logger.Debug("not archiving blocked repository", zap.String("reason", reason))
+		return nil
+	}
+
+	relays := a.relaysFor(hintRelays, repo.Relays)
+	authors := append([]string{ann.PubKey}, repo.Maintainers...)
+	fetchCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	events := []nostr.Event{ann}
+	for ev := range a.pool.FetchMany(fetchCtx, relays, nostr.Filter{
+		Kinds:   []int{nostr.KindRepositoryAnnouncement, nostr.KindRepositoryState},
+		Authors: authors,
+		Tags:    nostr.TagMap{"d": []string{repo.ID}},
+	}) {
+		events = append(events, *ev.Event)
+	}
+	cancel()
+
+	for i := range events {
+		ev := events[i]
+		if ok, _ := ev.CheckSignature(); !ok {
+			continue
+		}
+		if skipBroadcast, err := a.relay.AddEvent(ctx, &ev); err != nil {
+			logger.Debug("archive event rejected", zap.String("id", ev.ID), zap.Error(err))
+		} else if !skipBroadcast {
+			a.relay.BroadcastEvent(&ev)
+		}
+	}
+
+	npub, err := nip19.EncodePublicKey(ann.PubKey)
+	if err != nil {
+		return err
+	}
+	repo_path := shared.RepoPath(a.git_data_path, npub, repo.ID)
+	unlock := lockProvisioning(repo_path)
+	if _, err := os.Stat(repo_path); os.IsNotExist(err) {
+		// usually provisioned by EventReceiveHook when the announcement is first saved
+		if err := createBareRepo(repo_path, a.git_data_path, true); err != nil && !errors.Is(err, os.ErrExist) {
+			unlock()
+			logger.Error("failed to provision archived repository", zap.Error(err))
+			return fmt.Errorf("cannot provision archived repository %s: %w", repo_path, err)
+		}
+	}
+	unlock()
+
+	if err := shared.ProactiveSyncGit(ann.PubKey, repo.ID, a.git_data_path); err != nil {
+		logger.Debug("ProactiveSyncGit of archived repository not successful", zap.Error(err))
+	}
+	return nil
+}
+
+// fetchAnnouncements returns the latest announcement events for the entry
+func (a *Archive) fetchAnnouncements(ctx context.Context, entry RepoPointer) []nostr.Event {
+	filter := nostr.Filter{
+		Kinds:   []int{nostr.KindRepositoryAnnouncement},
+		Authors: []string{entry.PubKey},
+	}
+	if entry.Identifier != "" {
+		filter.Tags = nostr.TagMap{"d": []string{entry.Identifier}}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	latest := make(map[string]nostr.Event)
+	collect := func(ev *nostr.Event) {
+		if ev == nil {
+			return
+		}
+		d := ev.Tags.GetD()
+		if existing, exists := latest[d]; !exists || existing.CreatedAt < ev.CreatedAt {
+			latest[d] = *ev
+		}
+	}
+	for _, query := range a.relay.QueryEvents {
+		if ch, err := query(ctx, filter); err == nil {
+			for ev := range ch {
+				collect(ev)
+			}
+		}
+	}
+	for ev := range a.pool.FetchMany(ctx, a.relaysFor(entry.Relays), filter) {
+		collect(ev.Event)
+	}
+
+	events := make([]nostr.Event, 0, len(latest))
+	for _, ev := range latest {
+		events = append(events, ev)
+	}
+	return events
+}
+
+// loadEntries reads the archive entries from the config file and the owner's archive list
+func (a *Archive) loadEntries(ctx context.Context) []RepoPointer {
+	entries := []RepoPointer{}
+
+	if a.file != "" {
+		file, err := os.Open(a.file)
+		if err != nil {
+			a.logger.Error("cannot open archive file", zap.String("file", a.file), zap.Error(err))
+		} else {
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if line == "" || strings.HasPrefix(line, "#") {
+					continue
+				}
+				entry, err := ParseRepoPointer(line)
+				if err != nil {
+					a.logger.Warn("invalid archive file entry", zap.String("entry", line), zap.Error(err))
+					continue
+				}
+				entries = append(entries, entry)
+			}
+			file.Close()
+		}
+	}
+
+	filter := nostr.Filter{
+		Kinds:   []int{KindArchiveList},
+		Authors: []string{a.ownerPubkey},
+		Tags:    nostr.TagMap{"d": []string{ArchiveListIdentifier}},
+		Limit:   1,
+	}
+	for _, query := range a.relay.QueryEvents {
+		ch, err := query(ctx, filter)
+		if err != nil {
+			continue
+		}
+		for ev := range ch {
+			for _, tag := range ev.Tags {
+				if len(tag) < 2 || (tag[0] != "a" && tag[0] != "p") {
+					continue
+				}
+				entry, err := ParseRepoPointer(tag[1])
+				if err != nil {
+					continue
+				}
+				if len(tag) > 2 && tag[2] != "" {
+					entry.Relays = append(entry.Relays, tag[2])
+				}
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	return entries
+}
+
+func (a *Archive) relaysFor(relayLists ...[]string) []string {
+	relays := []string{}
+	for _, list := range append(relayLists, a.lookupRelays) {
+		for _, r := range list {
+			r = nostr.NormalizeURL(r)
+			if r != "" && !slices.Contains(relays, r) {
+				relays = append(relays, r)
+			}
+		}
+	}
+	return relays
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/zap"
+)
+
+// BlobMirrorPath is the BUD-04 endpoint asking the blossom server to fetch a blob from another
+// server
+const BlobMirrorPath = "/mirror"
+
+// serveMirror handles BUD-04 PUT /mirror. It replaces the blossom package's handler, which
+// holds the whole blob in memory and fetches any url, with one that applies the upload rules
+// before and after downloading, streams the blob to disk while hashing it and only connects
+// to public addresses.
+func (b *BlobStorage) serveMirror(w http.ResponseWriter, r *http.Request) {
+	auth, err := readBlobAuth(r)
+	if err != nil {
+		blobError(w, "invalid \"Authorization\": "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if auth == nil {
+		blobError(w, "missing \"Authorization\" header", http.StatusUnauthorized)
+		return
+	}
+	if auth.Tags.FindWithValue("t", "upload") == nil {
+		blobError(w, "invalid \"Authorization\" event \"t\" tag", http.StatusForbidden)
+		return
+	}
+	logger := b.logger.With(zap.String("pubkey", auth.PubKey))
+
+	var body struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&body); err != nil {
+		blobError(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	source, err := url.Parse(body.URL)
+	if err != nil || (source.Scheme != "https" && source.Scheme != "http") || source.Host == "" {
+		blobError(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, source.String(), nil)
+	if err != nil {
+		blobError(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		logger.Debug("cannot download blob to mirror", zap.String("url", body.URL), zap.Error(err))
+		blobError(w, "failed to download blob: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		blobError(w, fmt.Sprintf("failed to download blob: status %d", resp.StatusCode), http.StatusBadGateway)
+		return
+	}
+
+	mimetype := resp.Header.Get("Content-Type")
+	ext := path.Ext(source.Path)
+	if exts, _ := mime.ExtensionsByType(mimetype); ext == "" && len(exts) > 0 {
+		ext = exts[0]
+	}
+
+	// check what we can before downloading, and the rest once we know the size
+	size := resp.ContentLength
+	if size >= 0 {
+		if rejected, reason, code := b.RejectUpload(r.Context(), auth, int(size), ext); rejected {
+			blobError(w, reason, code)
+			return
+		}
+	}
+	var reader io.Reader = resp.Body
+	max_size := int64(b.config.BlossomMaxFileSizeMb) * 1024 * 1024
+	if max_size > 0 && auth.PubKey != b.ownerPubkey {
+		reader = io.LimitReader(resp.Body, max_size+1)
+	}
+
+	var rejectReason string
+	rejectCode := http.StatusBadRequest
+	bd, err := b.storeBlob(r.Context(), reader, size, auth.PubKey, mimetype, func(sha256 string, written int64) error {
+		if max_size > 0 && auth.PubKey != b.ownerPubkey && written > max_size {
+			rejectReason, rejectCode = "file too large", http.StatusRequestEntityTooLarge
+			return fmt.Errorf("more than %d bytes", max_size)
+		}
+		if auth.Tags.FindWithValue("x", sha256) == nil {
+			rejectReason, rejectCode = "blob hash does not match any \"x\" tag in authorization event", http.StatusForbidden
+			return fmt.Errorf("unexpected sha256 %s", sha256)
+		}
+		if size < 0 {
+			if rejected, reason, code := b.RejectUpload(r.Context(), auth, int(written), ext); rejected {
+				rejectReason, rejectCode = reason, code
+				return fmt.Errorf("rejected: %s", reason)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Debug("cannot mirror blob", zap.String("url", body.URL), zap.Error(err))
+		if rejectReason == "" {
+			rejectReason = "failed to store blob: " + err.Error()
+		}
+		blobError(w, rejectReason, rejectCode)
+		return
+	}
+	logger.Info("mirrored blob", zap.String("url", body.URL), zap.String("sha256", bd.SHA256), zap.Int("size", bd.Size))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bd)
+}
+
+// readBlobAuth reads a BUD-01 Authorization header, nil if there isn't one
+func readBlobAuth(r *http.Request) (*nostr.Event, error) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !found {
+		return nil, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 token")
+	}
+	var evt nostr.Event
+	if err := json.Unmarshal(data, &evt); err != nil {
+		return nil, fmt.Errorf("broken event")
+	}
+	if evt.Kind != 24242 || !evt.CheckID() {
+		return nil, fmt.Errorf("invalid event")
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	expiration := evt.Tags.Find("expiration")
+	if expiration == nil {
+		return nil, fmt.Errorf("missing \"expiration\" tag")
+	}
+	if ts, _ := strconv.ParseInt(expiration[1], 10, 64); nostr.Timestamp(ts) < nostr.Now() {
+		return nil, fmt.Errorf("event expired")
+	}
+	return &evt, nil
+}
+
+// blobError responds as the blossom package does, with the reason in the X-Reason header
+func blobError(w http.ResponseWriter, reason string, code int) {
+	w.Header().Add("X-Reason", reason)
+	w.WriteHeader(code)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"ngit-relay/shared"
+	"strconv"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func newTestBlobStorage(t *testing.T, config Config) *BlobStorage {
+	t.Setenv("NGIT_LOG_DIR", t.TempDir())
+	shared.Init("ngit-relay-khatru-test", false, false)
+
+	relay := khatru.NewRelay()
+	store := &slicestore.SliceStore{}
+	store.Init()
+	relay.StoreEvent = append(relay.StoreEvent, store.SaveEvent)
+	relay.QueryEvents = append(relay.QueryEvents, store.QueryEvents)
+	relay.CountEvents = append(relay.CountEvents, store.CountEvents)
+
+	ownerPubkey, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	config.OwnerNpub, _ = nip19.EncodePublicKey(ownerPubkey)
+	config.BlossomDataPath = t.TempDir()
+	config.BlossomOpenUploads = true
+	readAuth, err := NewReadAuth(config, ownerPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaders, err := NewBlobUploaders(relay, config, ownerPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return initBlossom(relay, config, readAuth, uploaders, nil)
+}
+
+func blobAuthHeader(t *testing.T, sk string, verb string, hashes ...string) string {
+	event := nostr.Event{
+		Kind:      24242,
+		CreatedAt: nostr.Now(),
+		Content:   verb,
+		Tags: nostr.Tags{
+			{"t", verb},
+			{"expiration", strconv.FormatInt(int64(nostr.Now())+60, 10)},
+		},
+	}
+	for _, hash := range hashes {
+		event.Tags = append(event.Tags, nostr.Tag{"x", hash})
+	}
+	if err := event.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(event)
+	return "Nostr " + base64.StdEncoding.EncodeToString(data)
+}
+
+func TestServeMirror(t *testing.T) {
+	blob := []byte("a screenshot moving between servers")
+	sum := sha256.Sum256(blob)
+	hash := hex.EncodeToString(sum[:])
+	large := bytes.Repeat([]byte("x"), 2*1024*1024)
+	largeSum := sha256.Sum256(large)
+	largeHash := hex.EncodeToString(largeSum[:])
+
+	// stands in for the server the blob is mirrored from
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + hash + ".png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(blob)
+		case "/large":
+			w.Write(large)
+		case "/streamed":
+			// no Content-Length so the size is only known once downloaded
+			w.(http.Flusher).Flush()
+			w.Write(large)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer origin.Close()
+
+	b := newTestBlobStorage(t, Config{BlossomMaxFileSizeMb: 1})
+	// the stand-in is on a loopback address, which the public client refuses
+	b.client = origin.Client()
+	server := httptest.NewServer(b.Handler(http.NotFoundHandler()))
+	defer server.Close()
+
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+
+	mirror := func(auth string, url string) *http.Response {
+		body, _ := json.Marshal(map[string]string{"url": url})
+		req, _ := http.NewRequest(http.MethodPut, server.URL+BlobMirrorPath, bytes.NewReader(body))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	tests := []struct {
+		name   string
+		auth   string
+		url    string
+		status int
+	}{
+		{"missing auth", "", origin.URL + "/" + hash + ".png", http.StatusUnauthorized},
+		{"delete auth", blobAuthHeader(t, sk, "delete", hash), origin.URL + "/" + hash + ".png", http.StatusForbidden},
+		{"invalid url", blobAuthHeader(t, sk, "upload", hash), "file:///etc/passwd", http.StatusBadRequest},
+		{"not found", blobAuthHeader(t, sk, "upload", hash), origin.URL + "/missing", http.StatusBadGateway},
+		{"sha256 mismatch", blobAuthHeader(t, sk, "upload", largeHash), origin.URL + "/" + hash + ".png", http.StatusForbidden},
+		{"too large", blobAuthHeader(t, sk, "upload", largeHash), origin.URL + "/large", http.StatusRequestEntityTooLarge},
+		{"too large without content length", blobAuthHeader(t, sk, "upload", largeHash), origin.URL + "/streamed", http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		resp := mirror(test.auth, test.url)
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: got status %d (%s), want %d", test.name, resp.StatusCode, resp.Header.Get("X-Reason"), test.status)
+		}
+	}
+	if b.HasBlob(hash) || b.HasBlob(largeHash) {
+		t.Fatal("rejected mirror requests stored a blob")
+	}
+	if used := b.ledger.Usage(pubkey); used != 0 {
+		t.Fatalf("rejected mirror requests were charged %d bytes", used)
+	}
+
+	resp := mirror(blobAuthHeader(t, sk, "upload", hash), origin.URL+"/"+hash+".png")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d (%s), want 200", resp.StatusCode, resp.Header.Get("X-Reason"))
+	}
+	var descriptor blossom.BlobDescriptor
+	if err := json.NewDecoder(resp.Body).Decode(&descriptor); err != nil {
+		t.Fatal(err)
+	}
+	if descriptor.SHA256 != hash || descriptor.Size != len(blob) || descriptor.Type != "image/png" {
+		t.Errorf("unexpected descriptor %+v", descriptor)
+	}
+	if !b.HasBlob(hash) {
+		t.Error("mirrored blob not stored")
+	}
+	if used := b.ledger.Usage(pubkey); used != int64(len(blob)) {
+		t.Errorf("usage = %d, want %d", used, len(blob))
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// BlobUsageAPIPath serves a pubkey's blossom usage and quota
+const BlobUsageAPIPath = "/api/blob-usage"
+
+// ledger keys in the blossom badger db. eventstore's keys start with bytes 0-8 and 255.
+const (
+	blobLedgerPrefix     = "ngit-blob-usage:"
+	blobLedgerTotalKey   = "ngit-blob-usage-total"
+	blobLedgerVersionKey = "ngit-blob-usage-version"
+	// blobLedgerVersion changes when the ledger is counted differently, to rebuild it
+	blobLedgerVersion = 2
+)
+
+// BlobLedger wraps the blossom blob index to keep a persistent count of the bytes each pubkey
+// owns, and of the bytes stored in total, in the blossom badger db. Usage changes exactly when
+// ownership does: a pubkey is charged when it first owns a blob and credited when it no
+// longer does, however the blob was stored or deleted.
+//
+// Blobs owned only by uncounted pubkeys, eg. the relay's own repository bundles, are left out
+// of the total so they don't use up the capacity for uploads.
+type BlobLedger struct {
+	blossom.BlobIndex
+	store     eventstore.Store
+	db        *badger.DB
+	uncounted []string
+	mu        sync.Mutex
+}
+
+// NewBlobLedger wraps index, building the ledger from it the first time
+func NewBlobLedger(index blossom.BlobIndex, store eventstore.Store, db *badger.DB, uncounted []string) (*BlobLedger, error) {
+	l := &BlobLedger{BlobIndex: index, store: store, db: db, uncounted: uncounted}
+	version := 0
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(blobLedgerVersionKey))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) == 1 {
+				version = int(val[0])
+			}
+			return nil
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) || (err == nil && version != blobLedgerVersion) {
+		return l, l.rebuild(context.Background())
+	}
+	return l, err
+}
+
+// counts reports whether blobs owned by pubkey count toward the total
+func (l *BlobLedger) counts(pubkey string) bool {
+	return !slices.Contains(l.uncounted, pubkey)
+}
+
+// countedOwner reports whether a pubkey whose blobs count toward the total owns the blob
+func (l *BlobLedger) countedOwner(ctx context.Context, sha256 string) (bool, error) {
+	ch, err := l.store.QueryEvents(ctx, nostr.Filter{Kinds: []int{24242}, Tags: nostr.TagMap{"x": []string{sha256}}})
+	if err != nil {
+		return false, err
+	}
+	counted := false
+	for evt := range ch {
+		counted = counted || l.counts(evt.PubKey)
+	}
+	return counted, nil
+}
+
+// rebuild recounts usage from the blob index
+func (l *BlobLedger) rebuild(ctx context.Context) error {
+	ch, err := l.store.QueryEvents(ctx, nostr.Filter{Kinds: []int{24242}})
+	if err != nil {
+		return err
+	}
+	usage := make(map[string]int64)
+	sizes := make(map[string]int64)
+	for evt := range ch {
+		if len(evt.Tags) < 3 {
+			continue
+		}
+		size, _ := strconv.ParseInt(evt.Tags[2][1], 10, 64)
+		usage[evt.PubKey] += size
+		if l.counts(evt.PubKey) {
+			sizes[evt.Tags[0][1]] = size
+		}
+	}
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	return l.db.Update(func(txn *badger.Txn) error {
+		for pubkey, used := range usage {
+			if err := txn.Set([]byte(blobLedgerPrefix+pubkey), encodeUsage(used)); err != nil {
+				return err
+			}
+		}
+		if err := txn.Set([]byte(blobLedgerTotalKey), encodeUsage(total)); err != nil {
+			return err
+		}
+		return txn.Set([]byte(blobLedgerVersionKey), []byte{blobLedgerVersion})
+	})
+}
+
+func encodeUsage(n int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(max(n, 0)))
+}
+
+func (l *BlobLedger) read(key string) int64 {
+	var n int64
+	l.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) == 8 {
+				n = int64(binary.BigEndian.Uint64(val))
+			}
+			return nil
+		})
+	})
+	return n
+}
+
+// add changes the usage of pubkey by delta, and the total when the blob is the first or last
+// counted copy, in one transaction
+func (l *BlobLedger) add(pubkey string, delta int64, changesTotal bool) error {
+	return l.db.Update(func(txn *badger.Txn) error {
+		keys := []string{blobLedgerPrefix + pubkey}
+		if changesTotal {
+			keys = append(keys, blobLedgerTotalKey)
+		}
+		for _, key := range keys {
+			var n int64
+			if item, err := txn.Get([]byte(key)); err == nil {
+				item.Value(func(val []byte) error {
+					if len(val) == 8 {
+						n = int64(binary.BigEndian.Uint64(val))
+					}
+					return nil
+				})
+			} else if !errors.Is(err, badger.ErrKeyNotFound) {
+				return err
+			}
+			if err := txn.Set([]byte(key), encodeUsage(n+delta)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// owned returns pubkey's record of owning a blob, nil if it doesn't
+func (l *BlobLedger) owned(ctx context.Context, sha256 string, pubkey string) *nostr.Event {
+	ch, err := l.store.QueryEvents(ctx, nostr.Filter{Authors: []string{pubkey}, Kinds: []int{24242}, Tags: nostr.TagMap{"x": []string{sha256}}, Limit: 1})
+	if err != nil {
+		return nil
+	}
+	var owned *nostr.Event
+	for evt := range ch {
+		owned = evt
+	}
+	return owned
+}
+
+// Keep records pubkey as an owner of the blob, charging it the blob's size if it didn't
+// already own it
+func (l *BlobLedger) Keep(ctx context.Context, blob blossom.BlobDescriptor, pubkey string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.owned(ctx, blob.SHA256, pubkey) != nil {
+		return nil
+	}
+	counted, err := l.countedOwner(ctx, blob.SHA256)
+	if err != nil {
+		return err
+	}
+	if err := l.BlobIndex.Keep(ctx, blob, pubkey); err != nil {
+		return err
+	}
+	return l.add(pubkey, int64(blob.Size), l.counts(pubkey) && !counted)
+}
+
+// Delete removes pubkey as an owner of the blob, crediting it the blob's size
+func (l *BlobLedger) Delete(ctx context.Context, sha256 string, pubkey string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	owned := l.owned(ctx, sha256, pubkey)
+	if owned == nil {
+		return nil
+	}
+	if err := l.BlobIndex.Delete(ctx, sha256, pubkey); err != nil {
+		return err
+	}
+	size := int64(0)
+	if len(owned.Tags) >= 3 {
+		size, _ = strconv.ParseInt(owned.Tags[2][1], 10, 64)
+	}
+	counted, err := l.countedOwner(ctx, sha256)
+	return l.add(pubkey, -size, err == nil && l.counts(pubkey) && !counted)
+}
+
+// Forget removes every owner of a blob whose file couldn't be stored, crediting each of them
+func (l *BlobLedger) Forget(ctx context.Context, sha256 string) error {
+	ch, err := l.store.QueryEvents(ctx, nostr.Filter{Kinds: []int{24242}, Tags: nostr.TagMap{"x": []string{sha256}}})
+	if err != nil {
+		return err
+	}
+	owners := []string{}
+	for evt := range ch {
+		owners = append(owners, evt.PubKey)
+	}
+	for _, pubkey := range owners {
+		if err := l.Delete(ctx, sha256, pubkey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Usage is the bytes of blobs pubkey owns
+func (l *BlobLedger) Usage(pubkey string) int64 {
+	return l.read(blobLedgerPrefix + pubkey)
+}
+
+// Total is the bytes of blobs stored, counting each blob once and leaving out blobs only
+// uncounted pubkeys own
+func (l *BlobLedger) Total() int64 {
+	return l.read(blobLedgerTotalKey)
+}
+
+type blobUsage struct {
+	PubKey string `json:"pubkey"`
+	Used   int64  `json:"used"`
+	Quota  int64  `json:"quota"` // 0 for no limit
+}
+
+// serveUsageAPI reports the usage and quota of the pubkey in the request's NIP-98
+// Authorization header. The owner can ask about another pubkey with ?pubkey=.
+func (b *BlobStorage) serveUsageAPI(w http.ResponseWriter, r *http.Request) {
+	auth, err := ValidateNip98Auth(r, nil)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Nostr")
+		http.Error(w, "auth-required: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	pubkey := auth.PubKey
+	if requested := r.URL.Query().Get("pubkey"); requested != "" && requested != pubkey {
+		if auth.PubKey != b.ownerPubkey {
+			http.Error(w, "restricted: only the owner can see the usage of other pubkeys", http.StatusForbidden)
+			return
+		}
+		if pk, err := ParseRepoPointer(requested); err == nil && pk.Identifier == "" {
+			requested = pk.PubKey
+		}
+		pubkey = requested
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blobUsage{
+		PubKey: pubkey,
+		Used:   b.ledger.Usage(pubkey),
+		Quota:  b.quota(r.Context(), pubkey),
+	})
+}
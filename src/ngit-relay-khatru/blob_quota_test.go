@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/badger"
+	"github.com/fiatjaf/khatru/blossom"
+)
+
+// pubkeys and blob hashes for ledger tests
+const (
+	testAlice   = "a000000000000000000000000000000000000000000000000000000000000000"
+	testBob     = "b000000000000000000000000000000000000000000000000000000000000000"
+	testRelay   = "c000000000000000000000000000000000000000000000000000000000000000"
+	testBlobOne = "1111111111111111111111111111111111111111111111111111111111111111"
+	testBlobTwo = "2222222222222222222222222222222222222222222222222222222222222222"
+	testBundle  = "3333333333333333333333333333333333333333333333333333333333333333"
+)
+
+func newTestBlobLedger(t *testing.T) (*BlobLedger, blossom.EventStoreBlobIndexWrapper, *badger.BadgerBackend) {
+	db := &badger.BadgerBackend{Path: t.TempDir()}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	index := blossom.EventStoreBlobIndexWrapper{Store: db, ServiceURL: "http://localhost:3334"}
+	ledger, err := NewBlobLedger(index, db, db.DB, []string{testRelay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ledger, index, db
+}
+
+func testBlob(sha256 string, size int) blossom.BlobDescriptor {
+	return blossom.BlobDescriptor{SHA256: sha256, Size: size, Type: "image/png"}
+}
+
+func TestBlobLedger(t *testing.T) {
+	ctx := context.Background()
+
+	// each step runs against the ledger left by the previous ones
+	tests := []struct {
+		name      string
+		run       func(l *BlobLedger) error
+		wantAlice int64
+		wantBob   int64
+		wantTotal int64
+	}{
+		{"keep charges the owner", func(l *BlobLedger) error {
+			return l.Keep(ctx, testBlob(testBlobOne, 100), testAlice)
+		}, 100, 0, 100},
+		{"keeping an owned blob again is free", func(l *BlobLedger) error {
+			return l.Keep(ctx, testBlob(testBlobOne, 100), testAlice)
+		}, 100, 0, 100},
+		{"another owner is charged but the total counts the blob once", func(l *BlobLedger) error {
+			return l.Keep(ctx, testBlob(testBlobOne, 100), testBob)
+		}, 100, 100, 100},
+		{"a second blob adds to the total", func(l *BlobLedger) error {
+			return l.Keep(ctx, testBlob(testBlobTwo, 50), testAlice)
+		}, 150, 100, 150},
+		{"delete credits the owner but keeps the total while others own it", func(l *BlobLedger) error {
+			return l.Delete(ctx, testBlobOne, testAlice)
+		}, 50, 100, 150},
+		{"deleting a blob not owned changes nothing", func(l *BlobLedger) error {
+			return l.Delete(ctx, testBlobTwo, testBob)
+		}, 50, 100, 150},
+		{"deleting the last copy credits the total", func(l *BlobLedger) error {
+			return l.Delete(ctx, testBlobOne, testBob)
+		}, 50, 0, 50},
+		{"forget after a failed store credits every owner", func(l *BlobLedger) error {
+			if err := l.Keep(ctx, testBlob(testBlobOne, 100), testAlice); err != nil {
+				return err
+			}
+			if err := l.Keep(ctx, testBlob(testBlobOne, 100), testBob); err != nil {
+				return err
+			}
+			return l.Forget(ctx, testBlobOne)
+		}, 50, 0, 50},
+		{"the relay's own blobs are left out of the total", func(l *BlobLedger) error {
+			return l.Keep(ctx, testBlob(testBlobOne, 100), testRelay)
+		}, 50, 0, 50},
+		{"an owner keeping a relay blob adds it to the total", func(l *BlobLedger) error {
+			return l.Keep(ctx, testBlob(testBlobOne, 100), testBob)
+		}, 50, 100, 150},
+		{"it leaves the total once only the relay owns it", func(l *BlobLedger) error {
+			return l.Delete(ctx, testBlobOne, testBob)
+		}, 50, 0, 50},
+	}
+
+	ledger, _, _ := newTestBlobLedger(t)
+	for _, test := range tests {
+		if err := test.run(ledger); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := ledger.Usage(testAlice); got != test.wantAlice {
+			t.Errorf("%s: alice usage = %d, want %d", test.name, got, test.wantAlice)
+		}
+		if got := ledger.Usage(testBob); got != test.wantBob {
+			t.Errorf("%s: bob usage = %d, want %d", test.name, got, test.wantBob)
+		}
+		if got := ledger.Total(); got != test.wantTotal {
+			t.Errorf("%s: total = %d, want %d", test.name, got, test.wantTotal)
+		}
+	}
+}
+
+func TestBlobLedgerRebuild(t *testing.T) {
+	ctx := context.Background()
+	_, index, db := newTestBlobLedger(t)
+
+	// blobs stored before there was a ledger, as kind 24242 events in the index
+	for _, keep := range []struct {
+		blob   blossom.BlobDescriptor
+		pubkey string
+	}{
+		{testBlob(testBlobOne, 100), testAlice},
+		{testBlob(testBlobOne, 100), testBob},
+		{testBlob(testBlobTwo, 50), testAlice},
+		{testBlob(testBundle, 70), testRelay},
+	} {
+		if err := index.Keep(ctx, keep.blob, keep.pubkey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.DB.DropPrefix([]byte(blobLedgerPrefix), []byte(blobLedgerTotalKey), []byte(blobLedgerVersionKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	ledger, err := NewBlobLedger(index, db, db.DB, []string{testRelay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		got  int64
+		want int64
+	}{
+		{"alice usage", ledger.Usage(testAlice), 150},
+		{"bob usage", ledger.Usage(testBob), 100},
+		{"relay usage", ledger.Usage(testRelay), 70},
+		{"total, without the relay's blobs", ledger.Total(), 150},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s = %d, want %d", test.name, test.got, test.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"ngit-relay/shared"
+	"sync"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip34"
+	"go.uber.org/zap"
+)
+
+// BlobUploaders decides who can upload blobs, so the blossom server hosts the media of the
+// repositories on this instance rather than working as a general-purpose media host. Uploads
+// are accepted from the owner, NGIT_BLOSSOM_UPLOAD_WHITELIST npubs, maintainers of stored
+// repositories and authors of stored NIP-34 events. Set NGIT_BLOSSOM_OPEN_UPLOADS to accept
+// uploads from anyone.
+type BlobUploaders struct {
+	relay       *khatru.Relay
+	open        bool
+	ownerPubkey string
+	whitelist   map[string]bool
+	logger      *zap.Logger
+
+	mu sync.Mutex
+	// authors and maintainers of stored announcements, nil until loaded and whenever an
+	// announcement is saved or deleted
+	maintainers map[string]bool
+}
+
+func NewBlobUploaders(relay *khatru.Relay, config Config, ownerPubkey string) (*BlobUploaders, error) {
+	u := &BlobUploaders{
+		relay:       relay,
+		open:        config.BlossomOpenUploads,
+		ownerPubkey: ownerPubkey,
+		whitelist:   make(map[string]bool),
+		logger:      shared.L().With(zap.String("type", "BlobUploaders")),
+	}
+	for _, item := range config.BlossomUploadWhitelist {
+		pointer, err := ParseRepoPointer(item)
+		if err != nil || pointer.Identifier != "" {
+			return nil, fmt.Errorf("invalid blossom upload whitelist entry, expected npub: %s", item)
+		}
+		u.whitelist[pointer.PubKey] = true
+	}
+	return u, nil
+}
+
+// Allows reports whether pubkey can upload blobs
+func (u *BlobUploaders) Allows(ctx context.Context, pubkey string) bool {
+	if u.open || pubkey == u.ownerPubkey || u.whitelist[pubkey] {
+		return true
+	}
+	return u.IsMaintainer(ctx, pubkey) || u.isContributor(ctx, pubkey)
+}
+
+// IsMaintainer reports whether pubkey has announced a repository stored on the relay, or is
+// listed as a maintainer in one
+func (u *BlobUploaders) IsMaintainer(ctx context.Context, pubkey string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.maintainers == nil {
+		maintainers, err := u.loadMaintainers(ctx)
+		if err != nil {
+			u.logger.Warn("cannot load repository maintainers", zap.Error(err))
+			return maintainers[pubkey]
+		}
+		u.maintainers = maintainers
+	}
+	return u.maintainers[pubkey]
+}
+
+// loadMaintainers returns the authors and maintainers of every stored announcement. The
+// maintainers tag isn't indexed so each announcement is checked.
+func (u *BlobUploaders) loadMaintainers(ctx context.Context) (map[string]bool, error) {
+	maintainers := make(map[string]bool)
+	for _, query := range u.relay.QueryEvents {
+		ch, err := query(ctx, nostr.Filter{Kinds: []int{nostr.KindRepositoryAnnouncement}})
+		if err != nil {
+			return maintainers, err
+		}
+		for event := range ch {
+			maintainers[event.PubKey] = true
+			for _, maintainer := range nip34.ParseRepository(*event).Maintainers {
+				maintainers[maintainer] = true
+			}
+		}
+	}
+	return maintainers, nil
+}
+
+// OnEventSaved reloads the maintainers when an announcement is saved
+func (u *BlobUploaders) OnEventSaved(ctx context.Context, event *nostr.Event) {
+	u.forgetMaintainers(event)
+}
+
+// OnEventDeleted reloads the maintainers when an announcement is deleted, eg. by a NIP-09
+// deletion request or a management ban. It is added to the relay's DeleteEvent functions so
+// never fails.
+func (u *BlobUploaders) OnEventDeleted(ctx context.Context, event *nostr.Event) error {
+	u.forgetMaintainers(event)
+	return nil
+}
+
+func (u *BlobUploaders) forgetMaintainers(event *nostr.Event) {
+	if event.Kind != nostr.KindRepositoryAnnouncement {
+		return
+	}
+	u.mu.Lock()
+	u.maintainers = nil
+	u.mu.Unlock()
+}
+
+// isContributor reports whether pubkey authored a stored NIP-34 event, eg. a repository state,
+// patch, PR, issue or status
+func (u *BlobUploaders) isContributor(ctx context.Context, pubkey string) bool {
+	kinds := append([]int{nostr.KindRepositoryState}, shared.RepoDiscussionKinds...)
+	return u.count(ctx, nostr.Filter{Kinds: kinds, Authors: []string{pubkey}, Limit: 1})
+}
+
+// count reports whether the relay's storage backend has an event matching filter
+func (u *BlobUploaders) count(ctx context.Context, filter nostr.Filter) bool {
+	for _, countFn := range u.relay.CountEvents {
+		if countFn == nil {
+			continue
+		}
+		count, err := countFn(ctx, filter)
+		if err == nil && count > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -3,9 +3,16 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"net/http"
 	"ngit-relay/shared"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/fiatjaf/eventstore/badger"
 	"github.com/fiatjaf/khatru"
@@ -16,17 +23,37 @@ import (
 	"go.uber.org/zap"
 )
 
-func initBlossom(relay *khatru.Relay, config Config) {
+// BlobStorage is the blossom server and the directory its blobs are stored in, so other
+// services storing content-addressed data, eg. git lfs, share the same blobs and limits
+type BlobStorage struct {
+	server      *blossom.BlossomServer
+	ledger      *BlobLedger
+	uploaders   *BlobUploaders
+	config      Config
+	ownerPubkey string
+	client      *http.Client // fetches blobs from other servers
+	blob_path   string
+	fs          afero.Fs
+	logger      *zap.Logger
+}
+
+// initBlossom starts the blossom server. Blobs owned only by uncounted pubkeys, eg. the
+// relay's own, don't count toward BlossomMaxCapacityGb.
+func initBlossom(relay *khatru.Relay, config Config, readAuth *ReadAuth, uploaders *BlobUploaders, uncounted []string) *BlobStorage {
 
 	logger := shared.L().With(zap.String("type", "Bossom"))
 
 	bl := blossom.New(relay, "http://localhost:3334")
 	bl_db := badger.BadgerBackend{Path: config.BlossomDataPath + "/db"}
 	bl_db.Init()
-	bl.Store = blossom.EventStoreBlobIndexWrapper{
+	ledger, err := NewBlobLedger(blossom.EventStoreBlobIndexWrapper{
 		Store:      &bl_db,
 		ServiceURL: bl.ServiceURL,
+	}, &bl_db, bl_db.DB, uncounted)
+	if err != nil {
+		logger.Fatal("cannot load blob usage ledger", zap.Error(err))
 	}
+	bl.Store = ledger
 
 	blob_path := config.BlossomDataPath + "/blobs/"
 
@@ -34,15 +61,37 @@ func initBlossom(relay *khatru.Relay, config Config) {
 
 	fs.MkdirAll(blob_path, os.ModeAppend)
 
+	b := &BlobStorage{
+		server:      bl,
+		ledger:      ledger,
+		uploaders:   uploaders,
+		config:      config,
+		ownerPubkey: nPubToPubkey(config.OwnerNpub),
+		client:      newPublicHTTPClient(5 * time.Minute),
+		blob_path:   blob_path,
+		fs:          fs,
+		logger:      logger,
+	}
+
 	bl.StoreBlob = append(bl.StoreBlob, func(ctx context.Context, sha256 string, body []byte) error {
 		logger.Debug("storing", zap.String("sha256", sha256))
+		if b.HasBlob(sha256) {
+			return nil
+		}
 		file, err := fs.Create(blob_path + "/" + sha256)
-		if err != nil {
-			logger.Error("error storing blob during fs.Create", zap.String("sha256", sha256), zap.Error((err)))
-			return err
+		if err == nil {
+			_, err = io.Copy(file, bytes.NewReader(body))
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
 		}
-		if _, err := io.Copy(file, bytes.NewReader(body)); err != nil {
-			logger.Error("error storing blob with io.Copy", zap.String("sha256", sha256), zap.Error((err)))
+		if err != nil {
+			logger.Error("error storing blob", zap.String("sha256", sha256), zap.Error((err)))
+			fs.Remove(blob_path + "/" + sha256)
+			// the upload was recorded before the blob was stored, so credit it back
+			if err := ledger.Forget(ctx, sha256); err != nil {
+				logger.Error("cannot credit failed upload", zap.String("sha256", sha256), zap.Error(err))
+			}
 			return err
 		}
 		return nil
@@ -56,18 +105,24 @@ func initBlossom(relay *khatru.Relay, config Config) {
 		return fs.Remove(blob_path + "/" + sha256)
 	})
 
-	total_stored, _ := getDirSize(fs, blob_path)
+	bl.RejectGet = append(bl.RejectGet, readAuth.RejectBlobGet)
+	bl.RejectList = append(bl.RejectList, readAuth.RejectBlobList)
 
 	bl.RejectUpload = append(bl.RejectUpload, func(ctx context.Context, event *nostr.Event, size int, ext string) (bool, string, int) {
 		rejLogger := logger.With(zap.String("pubkey", event.PubKey), zap.String("ext", ext), zap.Int("size", size))
 
 		// always allow uploads from owner
-		if event.PubKey == nPubToPubkey(config.OwnerNpub) {
-			total_stored = total_stored + size
+		if event.PubKey == b.ownerPubkey {
 			rejLogger.Debug("owner upload", zap.String("ext", ext), zap.Int("size", size))
 			return false, ext, size
 		}
 
+		// only host media for the repositories on this instance
+		if !uploaders.Allows(ctx, event.PubKey) {
+			rejLogger.Info("rejected blob - pubkey not a maintainer or contributor")
+			return true, "restricted: uploads are only accepted from maintainers and contributors of repositories on this relay", 403
+		}
+
 		// check file size
 		if config.BlossomMaxFileSizeMb > 0 && size > config.BlossomMaxFileSizeMb*1024*1024 {
 			rejLogger.Warn("rejected blob - file too large", zap.String("ext", ext), zap.Int("size", size))
@@ -75,36 +130,163 @@ func initBlossom(relay *khatru.Relay, config Config) {
 		}
 
 		// capacity usage
-		if config.BlossomMaxCapacityGb > 0 && (total_stored+size) > config.BlossomMaxCapacityGb*1024*1024*1024 {
-			total_stored = total_stored + size
-			rejLogger.Warn("rejected blob - blossom server full", zap.String("ext", ext), zap.Int("max_capacity_gb", config.BlossomMaxCapacityGb), zap.Int("total_stored", total_stored), zap.Int("size", size))
+		total_stored := ledger.Total()
+		if config.BlossomMaxCapacityGb > 0 && total_stored+int64(size) > int64(config.BlossomMaxCapacityGb)*1024*1024*1024 {
+			rejLogger.Warn("rejected blob - blossom server full", zap.String("ext", ext), zap.Int("max_capacity_gb", config.BlossomMaxCapacityGb), zap.Int64("total_stored", total_stored), zap.Int("size", size))
 			return true, "blossom server full", 507
 		}
 
+		// pubkey's quota
+		if quota := b.quota(ctx, event.PubKey); quota > 0 {
+			if used := ledger.Usage(event.PubKey); used+int64(size) > quota {
+				rejLogger.Info("rejected blob - quota exceeded", zap.Int64("used", used), zap.Int64("quota", quota))
+				return true, fmt.Sprintf("upload quota exceeded, using %d of %d MB", used/1024/1024, quota/1024/1024), 413
+			}
+		}
+
 		rejLogger.Debug("upload")
 		return false, ext, size
 
 	})
 
+	return b
 }
 
-func getDirSize(fs afero.Fs, dirPath string) (int, error) {
-	var totalSize int64
-	err := afero.Walk(fs, dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+// quota is the most bytes pubkey can own, 0 for no limit. Maintainers of repositories stored
+// on the relay get the larger maintainer quota.
+func (b *BlobStorage) quota(ctx context.Context, pubkey string) int64 {
+	if pubkey == b.ownerPubkey {
+		return 0
+	}
+	quota := b.config.BlossomUserQuotaMb
+	if b.config.BlossomMaintainerQuotaMb != quota && b.uploaders.IsMaintainer(ctx, pubkey) {
+		quota = b.config.BlossomMaintainerQuotaMb
+	}
+	return int64(quota) * 1024 * 1024
+}
+
+// Handler serves the blob usage api and BUD-04 mirror requests, and passes everything else to
+// next
+func (b *BlobStorage) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == BlobUsageAPIPath && r.Method == http.MethodGet {
+			b.serveUsageAPI(w, r)
+			return
 		}
-		if !info.IsDir() {
-			totalSize += info.Size()
+		if r.URL.Path == BlobMirrorPath && r.Method == http.MethodPut {
+			b.serveMirror(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isBlobHash reports whether s is a lowercase hex sha256, as used for blob file names
+func isBlobHash(s string) bool {
+	if len(s) != 64 || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// HasBlob reports whether the blob is stored
+func (b *BlobStorage) HasBlob(sha256 string) bool {
+	if !isBlobHash(sha256) {
+		return false
+	}
+	_, err := b.fs.Stat(filepath.Join(b.blob_path, sha256))
+	return err == nil
+}
+
+// OpenBlob opens a stored blob, as the blossom LoadBlob handler does
+func (b *BlobStorage) OpenBlob(sha256 string) (afero.File, error) {
+	if !isBlobHash(sha256) {
+		return nil, fmt.Errorf("invalid sha256: %s", sha256)
+	}
+	return b.fs.Open(filepath.Join(b.blob_path, sha256))
+}
+
+// RejectUpload applies the blossom upload rules, eg. file size and capacity limits, to an
+// upload of size bytes authorized by auth
+func (b *BlobStorage) RejectUpload(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+	for _, reject := range b.server.RejectUpload {
+		if rejected, reason, code := reject(ctx, auth, size, ext); rejected {
+			return rejected, reason, code
+		}
+	}
+	return false, "", 0
+}
+
+// DeleteBlob removes pubkey as an owner of a blob, deleting the blob if it has no other owner
+func (b *BlobStorage) DeleteBlob(ctx context.Context, sha256 string, pubkey string) error {
+	if err := b.server.Store.Delete(ctx, sha256, pubkey); err != nil {
+		return err
+	}
+	if bd, err := b.server.Store.Get(ctx, sha256); err == nil && bd == nil {
+		return b.fs.Remove(filepath.Join(b.blob_path, sha256))
+	}
+	return nil
+}
+
+// StoreBlobFromReader streams body into the blob directory, hashing it as it is written, and
+// records pubkey as an owner of the blob. Unlike the blossom StoreBlob handlers the body isn't
+// held in memory. The blob is rejected unless it has the expected sha256, and size when it
+// isn't negative.
+func (b *BlobStorage) StoreBlobFromReader(ctx context.Context, body io.Reader, expected string, size int64, pubkey string, mimetype string) (*blossom.BlobDescriptor, error) {
+	if !isBlobHash(expected) {
+		return nil, fmt.Errorf("invalid sha256: %s", expected)
+	}
+	return b.storeBlob(ctx, body, size, pubkey, mimetype, func(sha256 string, _ int64) error {
+		if sha256 != expected {
+			return fmt.Errorf("expected sha256 %s, got %s", expected, sha256)
 		}
 		return nil
 	})
+}
+
+// storeBlob streams body into the blob directory and, once check accepts its sha256 and
+// size, records pubkey as an owner of the blob
+func (b *BlobStorage) storeBlob(ctx context.Context, body io.Reader, size int64, pubkey string, mimetype string, check func(sha256 string, size int64) error) (*blossom.BlobDescriptor, error) {
+	tmp, err := afero.TempFile(b.fs, b.blob_path, ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer b.fs.Remove(tmp.Name())
+	defer tmp.Close()
 
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hash), body)
 	if err != nil {
-		return 0, err
+		return nil, fmt.Errorf("failed to read blob: %w", err)
+	}
+	if size >= 0 && written != size {
+		return nil, fmt.Errorf("expected %d bytes, got %d", size, written)
+	}
+	expected := hex.EncodeToString(hash.Sum(nil))
+	if err := check(expected, written); err != nil {
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
 	}
 
-	return int(totalSize), nil
+	bd := blossom.BlobDescriptor{
+		URL:      b.server.ServiceURL + "/" + expected,
+		SHA256:   expected,
+		Size:     int(written),
+		Type:     mimetype,
+		Uploaded: nostr.Now(),
+	}
+	if err := b.server.Store.Keep(ctx, bd, pubkey); err != nil {
+		return nil, err
+	}
+	if err := b.fs.Rename(tmp.Name(), filepath.Join(b.blob_path, expected)); err != nil {
+		b.server.Store.Delete(ctx, expected, pubkey)
+		return nil, err
+	}
+	b.logger.Debug("stored", zap.String("sha256", expected), zap.Int64("size", written))
+	return &bd, nil
 }
 
 func nPubToPubkey(nPub string) string {
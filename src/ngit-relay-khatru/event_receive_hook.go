@@ -2,180 +2,341 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"ngit-relay/shared"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/nbd-wtf/go-nostr/nip34"
 	"go.uber.org/zap"
 )
 
-func EventReceiveHook(git_data_path string) func(ctx context.Context, event *nostr.Event) {
+// kinds of job queued by EventReceiveHook
+const (
+	JobKindArchiveRefresh = "archive-refresh"
+	JobKindProvision      = "provision"
+	JobKindUpdateState    = "update-state"
+	JobKindSync           = "sync"
+)
+
+// EventReceiveHook queues the work for a saved event on the job queue so we don't delay
+// notifiying the user that the event was saved, and the work survives restarts
+func EventReceiveHook(jobs *JobQueue, archive *Archive) func(ctx context.Context, event *nostr.Event) {
 	return func(ctx context.Context, event *nostr.Event) {
-		// process event in a routine so we don't delay notifiying the user that the event was saved
-		go processEvent(context.Background(), event, git_data_path)
-	}
-}
+		logger := shared.L().With(zap.String("type", "EventReceiveHook"), zap.String("id", event.ID))
+		enqueue := func(kind string, key string, delay time.Duration) {
+			if err := jobs.Enqueue(kind, key, event, delay); err != nil {
+				logger.Error("cannot queue job", zap.String("kind", kind), zap.Error(err))
+			}
+		}
 
-func processEvent(ctx context.Context, event *nostr.Event, git_data_path string) {
-	// create empty git repo for new announcement events
-	if event.Kind == nostr.KindRepositoryAnnouncement {
-		// If you are looking enforcement that announcement events list this ngit instance, look in policies
-		logger := shared.L().With(zap.String("type", "RepoAnnEventReceiveHook"), zap.String("eventjson", event.String()))
-		logger.Debug("repo annoucement received")
-
-		npub, _ := nip19.EncodePublicKey(event.PubKey)
-		d_tags := event.Tags.Find("d")
-		if d_tags == nil {
-			logger.Error("repo announcement missing d tag")
+		// archive list updated by owner
+		if archive.IsArchiveListEvent(event) {
+			enqueue(JobKindArchiveRefresh, JobKindArchiveRefresh, 0)
+			return
+		}
+		d_tag := event.Tags.Find("d")
+		if d_tag == nil {
 			return
 		}
-		identifier := event.Tags.Find("d")[1]
-		repo_path := git_data_path + "/" + npub + "/" + identifier + ".git"
-
-		logger = logger.With(zap.String("repo_path", repo_path))
-
-		if _, err := os.Stat(repo_path); err == nil {
-			logger.Debug("git repo dir already exists for annoucement")
-		} else if !os.IsNotExist(err) {
-			logger.Error("Error checking repo path:", zap.Error(err))
-		} else {
-			// repo doesn't exist
-			logger.Debug("Creating empty git repo")
-
-			// create directory
-			err := os.MkdirAll(repo_path, os.ModePerm)
-			if err != nil {
-				logger.Error("Error creating directory:", zap.Error(err))
-				return
+		coordinate := shared.RepoCoordinate(event.PubKey, d_tag[1])
+		switch event.Kind {
+		case nostr.KindRepositoryAnnouncement:
+			// wait for state event to be processed, if sent with announcement
+			enqueue(JobKindProvision, JobKindProvision+":"+coordinate, 1*time.Second)
+		case nostr.KindRepositoryState:
+			enqueue(JobKindUpdateState, JobKindUpdateState+":"+coordinate, 0)
+			if shared.GetEnvBool("NGIT_PROACTIVE_SYNC_GIT", true) {
+				// Wait for 60 seconds before checking sync status and fetching data from other git servers - this allows time for ngit-cli clients to push git data to git servers
+				// further state events for the repository within this time restart the wait
+				enqueue(JobKindSync, JobKindSync+":"+d_tag[1], 60*time.Second)
 			}
+		}
+	}
+}
 
-			// init git repo
-			cmd := exec.Command("git", "init", "--bare", repo_path)
-			cmd.Dir = git_data_path // Set the working directory for the command
-			_, err = cmd.Output()
-			if err != nil {
-				logger.Error("Error initializing Git repository:", zap.Error(err))
-				return
-			}
+// HandleEventJobs registers the handlers for the jobs queued by EventReceiveHook
+func HandleEventJobs(jobs *JobQueue, git_data_path string, domain string, archive *Archive, management *RelayManagement, provisioning *Provisioning) {
+	jobs.Handle(JobKindArchiveRefresh, func(ctx context.Context, job *Job) error {
+		return archive.Refresh(ctx)
+	})
+	jobs.Handle(JobKindProvision, func(ctx context.Context, job *Job) error {
+		return provisionRepo(ctx, job.Event, git_data_path, domain, archive, management, provisioning)
+	})
+	jobs.Handle(JobKindUpdateState, func(ctx context.Context, job *Job) error {
+		return updateRepoState(ctx, job.Event, git_data_path, archive)
+	})
+	jobs.Handle(JobKindSync, func(ctx context.Context, job *Job) error {
+		return syncRepos(ctx, job.Event.Tags.GetD(), git_data_path, archive)
+	})
+}
 
-			// allow unauthenticated push (we handle write permissions via pre-receive git hook)
-			cmd = exec.Command("git", "config", "http.receivepack", "true")
-			cmd.Dir = repo_path // Set the working directory for the command
-			_, err = cmd.Output()
-			if err != nil {
-				logger.Error("Error configuring Git to enable push:", zap.Error(err))
-				return
-			}
+// provisionRepo creates an empty git repo for new announcement events
+func provisionRepo(ctx context.Context, event *nostr.Event, git_data_path string, domain string, archive *Archive, management *RelayManagement, provisioning *Provisioning) error {
+	// If you are looking enforcement that announcement events list this ngit instance, look in policies
+	logger := shared.L().With(zap.String("type", "RepoAnnEventReceiveHook"), zap.String("eventjson", event.String()))
+	logger.Debug("repo annoucement received")
 
-			// allow uploadpack from tips - required for ngit remote helper to pull desired data
-			// without it ngit won't be able to fetch, pull or clone.
-			cmd = exec.Command("git", "config", "uploadpack.allowTipSHA1InWant", "true")
-			cmd.Dir = repo_path // Set the working directory for the command
-			_, err = cmd.Output()
-			if err != nil {
-				logger.Error("Error configuring Git to enable uploadpakc.allowTipSHA1InWant", zap.Error(err))
-				return
-			}
+	npub, _ := nip19.EncodePublicKey(event.PubKey)
+	identifier := event.Tags.GetD()
 
-			// allow allowUnreachable which enables ngit to download blobs not in the ancestory of tips.
-			// this might be useful if we store blobs related to pr/* without storing the tips.
-			// it is also might be helpful in other scenarios where the git server and nostr state
-			// event is out of sync.
-			cmd = exec.Command("git", "config", "uploadpack.allowUnreachable", "true")
-			cmd.Dir = repo_path // Set the working directory for the command
-			_, err = cmd.Output()
-			if err != nil {
-				logger.Error("Error configuring Git to enable uploadpakc.allowUnreachable", zap.Error(err))
-				return
-			}
+	if !shared.IsValidIdentifier(identifier) {
+		logger.Info("not provisioning repository with invalid identifier", zap.String("identifier", identifier))
+		return nil
+	}
+	if blocked, reason := management.IsRepoBlocked(event.PubKey, identifier); blocked {
+		logger.Info("not provisioning blocked repository", zap.String("reason", reason))
+		return nil
+	}
 
-			// Create symlink to pre-receive hook
-			err = os.Symlink("/usr/local/bin/ngit-relay-pre-receive", repo_path+"/hooks/pre-receive")
-			if err != nil {
-				logger.Error("Error creating symlink", zap.Error(err))
-				return
-			}
+	// archived repositories that don't list this instance, or that the provisioning mode
+	// doesn't allow, live in a separate read-only namespace
+	repo_git_data_path := git_data_path
+	read_only := false
+	if allowed, _ := provisioning.Allows(ctx, event); !ListsInstance(event, domain) || !allowed {
+		if !archive.Includes(event.PubKey, identifier) {
+			logger.Debug("repo announcement doesn't list this instance, or isn't allowed to provision, and isn't archived")
+			return nil
+		}
+		repo_git_data_path = archive.GitDataPath()
+		read_only = true
+	}
+	repo_path := shared.RepoPath(repo_git_data_path, npub, identifier)
 
-			// Create symlink to post-receive hook
-			err = os.Symlink("/usr/local/bin/ngit-relay-post-receive", repo_path+"/hooks/post-receive")
-			if err != nil {
-				logger.Error("Error creating symlink", zap.Error(err))
-				return
-			}
+	logger = logger.With(zap.String("repo_path", repo_path))
 
-			// set permissions
-			err = os.Chmod(repo_path, 0777)
-			if err != nil {
-				logger.Error("Error changing permissions", zap.Error(err))
-				return
-			}
+	unlock := lockProvisioning(repo_path)
+	defer unlock()
 
-			// ensure correct ownership for git-http-backend
-			cmd = exec.Command("chown", "-R", "nginx:nginx", repo_path)
-			_, err = cmd.Output()
-			if err != nil {
-				logger.Error("Error changing ownership", zap.Error(err))
-				return
-			}
+	if _, err := os.Stat(repo_path); err == nil {
+		logger.Debug("git repo dir already exists for annoucement")
+		joinObjectPool(repo_path, event, logger)
+		return nil
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("error checking repo path: %w", err)
+	}
+
+	// repo doesn't exist
+	logger.Debug("Creating empty git repo")
+
+	if err := createBareRepo(repo_path, repo_git_data_path, read_only); errors.Is(err, os.ErrExist) {
+		logger.Debug("git repo created by someone else while provisioning")
+		joinObjectPool(repo_path, event, logger)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error creating git repo: %w", err)
+	}
+
+	logger.Info("Created empty git repo for " + npub + "/" + identifier + ".git")
+	joinObjectPool(repo_path, event, logger)
+
+	// sync git repository (useful if an existing repository just added this ngit instance)
+	if err := shared.ProactiveSyncGit(event.PubKey, identifier, repo_git_data_path); err != nil {
+		logger.Debug("ProactiveSyncGit on creation error, usually because 1. its a fresh repo or 2. our relay doesnt have the state event yet", zap.Error(err))
+	} else {
+		logger.Debug("ProactiveSyncGit on creation completed without error")
+	}
+	return nil
+}
+
+// joinObjectPool shares object storage with other copies of the project, eg. forks and
+// co-maintainers' repositories, identified by the announcement's earliest unique commit
+func joinObjectPool(repo_path string, event *nostr.Event, logger *zap.Logger) {
+	if !shared.ObjectPoolsEnabled() {
+		return
+	}
+	euc := shared.EarliestUniqueCommit(*event)
+	if euc == "" {
+		return
+	}
+	err := shared.JoinObjectPool(repo_path, euc, nip34.ParseRepository(*event).Maintainers)
+	if errors.Is(err, shared.ErrObjectPoolNotReady) {
+		// joined once pushed, by ngit-relay-proactive-sync
+		logger.Debug("not joining object pool yet", zap.String("euc", euc), zap.Error(err))
+	} else if err != nil {
+		logger.Warn("cannot join object pool", zap.String("euc", euc), zap.Error(err))
+	}
+}
+
+// updateRepoState updates the repository to match a new state event, eg. to correct HEAD.
+// A 'missing ref' error is expected when the state event arrives before the push of its refs,
+// in which case the retry picks them up once pushed.
+func updateRepoState(ctx context.Context, event *nostr.Event, git_data_path string, archive *Archive) error {
+	identifier := event.Tags.GetD()
+	npub, err := nip19.EncodePublicKey(event.PubKey)
+	if err != nil {
+		return fmt.Errorf("cannot get npub from event pubkey: %w", err)
+	}
+	return shared.UpdateState(ctx, event, event.PubKey, npub, identifier, repoGitDataPath(git_data_path, archive, event.PubKey, identifier))
+}
 
-			logger.Info("Created empty git repo for " + npub + "/" + identifier + ".git")
+// syncRepos fetches missing state from other git servers for each maintainer's copy of the
+// repository
+func syncRepos(ctx context.Context, identifier string, git_data_path string, archive *Archive) error {
+	events, err := shared.FetchAnnouncementAndStateEventsFromRelay(ctx, identifier)
+	if err != nil {
+		return fmt.Errorf("FetchAnnouncementAndStateEventsFromRelay failed during KindRepositoryState path: %w", err)
+	}
 
-			// sync git repository (useful if an existing repository just added this ngit instance)
-			time.Sleep(1 * time.Second) // wait for state event to be processed, if sent with announcement
-			err = shared.ProactiveSyncGit(event.PubKey, identifier, git_data_path)
-			if err != nil {
-				logger.Debug("ProactiveSyncGit on creation error, usually because 1. its a fresh repo or 2. our relay doesnt have the state event yet", zap.Error(err))
-				return
-			} else {
-				logger.Debug("ProactiveSyncGit on creation completed without error")
+	processed := make([]string, 0) // Initialize processed as a slice of strings
+	var syncErrors []error
+	for _, e := range events {
+		if e.Kind == nostr.KindRepositoryAnnouncement && !contains(processed, e.PubKey) {
+			processed = append(processed, e.PubKey) // Add the processed PubKey to the list
+			repo_git_data_path := repoGitDataPath(git_data_path, archive, e.PubKey, identifier)
+			npub, _ := nip19.EncodePublicKey(e.PubKey)
+			if _, err := os.Stat(shared.RepoPath(repo_git_data_path, npub, identifier)); err != nil {
+				continue // not hosted here
+			}
+			if err := shared.ProactiveSyncGit(e.PubKey, identifier, repo_git_data_path); err != nil {
+				syncErrors = append(syncErrors, fmt.Errorf("ProactiveSyncGit failed for %s: %w", npub, err))
 			}
 		}
 	}
-	// proactive sync git repos
-	if event.Kind == nostr.KindRepositoryState {
-		logger := shared.L().With(
-			zap.String("type", "RepoAnnEventReceiveHook"),
-			zap.String("eventjson", event.String()),
-		)
-
-		identifier := event.Tags.Find("d")[1]
-		npub, err := nip19.EncodePublicKey(event.PubKey)
-		if err != nil {
-			logger.Error("event_receive_hook cannot get npub form event.PubKey", zap.String("npub", npub), zap.String("identifier", identifier), zap.Error(err))
-			return
-		}
+	return errors.Join(syncErrors...)
+}
+
+// provisioning serialises creating each repository, as both provision jobs and archive
+// refreshes may create it
+var provisioningLocks = struct {
+	mu    sync.Mutex
+	repos map[string]*sync.Mutex
+}{repos: make(map[string]*sync.Mutex)}
 
-		// update state to correct HEAD if needed.
-		if err := shared.UpdateState(ctx, event, event.PubKey, npub, identifier, git_data_path); err != nil {
-			// don't report error. we expect a 'missing ref' error as we need to receive the new state event before accepting the new ref via http git service.
-			// logger.Error("UpdateState failed", zap.String("npub", npub), zap.String("identifier", identifier), zap.String("git_data_path", git_data_path), zap.Error(err))
+// lockProvisioning holds the provisioning lock for repo_path until the returned func is called
+func lockProvisioning(repo_path string) func() {
+	provisioningLocks.mu.Lock()
+	mu, exists := provisioningLocks.repos[repo_path]
+	if !exists {
+		mu = &sync.Mutex{}
+		provisioningLocks.repos[repo_path] = mu
+	}
+	provisioningLocks.mu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+// createBareRepo provisions an empty bare git repository with the ngit-relay hooks installed.
+// read_only repositories don't accept pushes over http. The repository is set up in a
+// temporary directory and renamed into place, so a failure never leaves a partial repository
+// and never touches one created by someone else. Returns os.ErrExist if repo_path exists.
+func createBareRepo(repo_path string, git_data_path string, read_only bool) error {
+	parent := filepath.Dir(repo_path)
+	if err := os.MkdirAll(parent, os.ModePerm); err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
+	// not named *.git so it isn't listed as a repository
+	tmp_path, err := os.MkdirTemp(parent, "."+filepath.Base(repo_path)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
+	defer os.RemoveAll(tmp_path) // nothing left to remove once renamed
+
+	if err := initBareRepo(tmp_path, git_data_path, read_only); err != nil {
+		return err
+	}
+	if _, err := os.Stat(repo_path); err == nil {
+		return os.ErrExist
+	}
+	if err := os.Rename(tmp_path, repo_path); err != nil {
+		if _, statErr := os.Stat(repo_path); statErr == nil {
+			return os.ErrExist
 		}
+		return fmt.Errorf("error moving git repo into place: %w", err)
+	}
+	return nil
+}
+
+// initBareRepo sets up an empty bare git repository in repo_path. Pushes are validated
+// in-process by GitHTTP so it needs no hooks, and it stays owned by this process's user,
+// unless NGIT_GIT_HTTP_BACKEND_HOOKS is set.
+func initBareRepo(repo_path string, git_data_path string, read_only bool) error {
+	// init git repo
+	cmd := exec.Command("git", "init", "--bare", repo_path)
+	cmd.Dir = git_data_path // Set the working directory for the command
+	_, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("error initializing Git repository: %w", err)
+	}
 
-		if shared.GetEnvBool("NGIT_PROACTIVE_SYNC_GIT", true) {
-			// Wait for 60 seconds before checking sync status and fetching data from other git servers - this allows time for ngit-cli clients to push git data to git servers
-			time.Sleep(60 * time.Second)
+	// allow unauthenticated push (we handle write permissions via pre-receive git hook)
+	cmd = exec.Command("git", "config", "http.receivepack", strconv.FormatBool(!read_only))
+	cmd.Dir = repo_path // Set the working directory for the command
+	_, err = cmd.Output()
+	if err != nil {
+		return fmt.Errorf("error configuring Git to enable push: %w", err)
+	}
 
-			events, err := shared.FetchAnnouncementAndStateEventsFromRelay(ctx, identifier)
-			if err != nil {
-				logger.Error("FetchAnnouncementAndStateEventsFromRelay failed during KindRepositoryState path", zap.Error(err))
-				return
-			}
+	// allow uploadpack from tips - required for ngit remote helper to pull desired data
+	// without it ngit won't be able to fetch, pull or clone.
+	cmd = exec.Command("git", "config", "uploadpack.allowTipSHA1InWant", "true")
+	cmd.Dir = repo_path // Set the working directory for the command
+	_, err = cmd.Output()
+	if err != nil {
+		return fmt.Errorf("error configuring Git to enable uploadpakc.allowTipSHA1InWant: %w", err)
+	}
 
-			processed := make([]string, 0) // Initialize processed as a slice of strings
-			for _, e := range events {
-				if e.Kind == nostr.KindRepositoryAnnouncement && !contains(processed, e.PubKey) {
-					if err := shared.ProactiveSyncGit(e.PubKey, identifier, git_data_path); err != nil {
-						logger.Error("ProactiveSyncGit failed", zap.String("pubKey", e.PubKey), zap.Error(err))
-						return
-					}
-					processed = append(processed, e.PubKey) // Add the processed PubKey to the list
-				}
-			}
+	// allow allowUnreachable which enables ngit to download blobs not in the ancestory of tips.
+	// this might be useful if we store blobs related to pr/* without storing the tips.
+	// it is also might be helpful in other scenarios where the git server and nostr state
+	// event is out of sync.
+	cmd = exec.Command("git", "config", "uploadpack.allowUnreachable", "true")
+	cmd.Dir = repo_path // Set the working directory for the command
+	_, err = cmd.Output()
+	if err != nil {
+		return fmt.Errorf("error configuring Git to enable uploadpakc.allowUnreachable: %w", err)
+	}
+
+	// set permissions
+	err = os.Chmod(repo_path, 0777)
+	if err != nil {
+		return fmt.Errorf("error changing permissions: %w", err)
+	}
+
+	// repositories served by git-http-backend, rather than GitHTTP, run the ngit-relay hooks
+	// as the nginx user
+	if shared.GetEnvBool("NGIT_GIT_HTTP_BACKEND_HOOKS", false) {
+		if err := installGitHTTPBackendHooks(repo_path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installGitHTTPBackendHooks links the ngit-relay hooks into a repository and hands it to
+// the nginx user, for serving with git-http-backend
+func installGitHTTPBackendHooks(repo_path string) error {
+	for _, hook := range []string{"pre-receive", "post-receive"} {
+		if err := os.Symlink("/usr/local/bin/ngit-relay-"+hook, repo_path+"/hooks/"+hook); err != nil {
+			return fmt.Errorf("error creating symlink: %w", err)
+		}
+	}
+	if output, err := exec.Command("chown", "-R", "nginx:nginx", repo_path).CombinedOutput(); err != nil {
+		return fmt.Errorf("error changing ownership: %w, output: %s", err, string(output))
+	}
+	return nil
+}
+
+// repoGitDataPath returns archive.GitDataPath() if the repository only exists in the archive
+// namespace, otherwise git_data_path
+func repoGitDataPath(git_data_path string, archive *Archive, pubkey string, identifier string) string {
+	npub, err := nip19.EncodePublicKey(pubkey)
+	if err != nil {
+		return git_data_path
+	}
+	if _, err := os.Stat(shared.RepoPath(git_data_path, npub, identifier)); os.IsNotExist(err) {
+		if _, err := os.Stat(shared.RepoPath(archive.GitDataPath(), npub, identifier)); err == nil {
+			return archive.GitDataPath()
 		}
 	}
+	return git_data_path
 }
 
 func contains(slice []string, item string) bool {
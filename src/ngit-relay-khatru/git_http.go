@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"ngit-relay/shared"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/zap"
+)
+
+// matches /npub123/repo.git/... and /archive/npub123/repo.git/...
+var gitRepoURLPath = regexp.MustCompile(`^/(archive/)?(npub1[a-z0-9]+)/([^/]+\.git)(/.*)$`)
+
+// GitHTTP serves hosted repositories over the git smart HTTP protocol. Pushes are validated
+// in-process against the latest state event in the relay's event store, so no pre-receive
+// or post-receive hook process is run.
+type GitHTTP struct {
+	relay         *khatru.Relay
+	git_data_path string
+	management    *RelayManagement
+	readAuth      *ReadAuth
+	stateWaiters  *StateWaiters
+	blobs         *BlobStorage
+	lfsTokens     *GitLFSTokens
+	logger        *zap.Logger
+}
+
+func NewGitHTTP(relay *khatru.Relay, git_data_path string, management *RelayManagement, readAuth *ReadAuth, blobs *BlobStorage) *GitHTTP {
+	return &GitHTTP{
+		relay:         relay,
+		git_data_path: git_data_path,
+		management:    management,
+		readAuth:      readAuth,
+		stateWaiters:  NewStateWaiters(),
+		blobs:         blobs,
+		lfsTokens:     NewGitLFSTokens(),
+		logger:        shared.L().With(zap.String("type", "GitHTTP")),
+	}
+}
+
+// OnEventSaved lets pushes waiting for a matching state event re-evaluate their ref updates
+func (g *GitHTTP) OnEventSaved(ctx context.Context, event *nostr.Event) {
+	g.stateWaiters.OnEventSaved(ctx, event)
+}
+
+// Handler serves git requests and passes everything else to next
+func (g *GitHTTP) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == SyncStatusAPIPath && r.Method == http.MethodGet {
+			g.serveSyncStatusAPI(w, r)
+			return
+		}
+		if r.URL.Path == GitServerHealthAPIPath && r.Method == http.MethodGet {
+			g.serveGitServerHealthAPI(w, r)
+			return
+		}
+		m := gitRepoURLPath.FindStringSubmatch(r.URL.Path)
+		if m == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		g.serveGit(w, r, m[1] != "", m[2], m[3], m[4])
+	})
+}
+
+func (g *GitHTTP) serveGit(w http.ResponseWriter, r *http.Request, archived bool, npub string, repo_name string, suffix string) {
+	repo_git_data_path := g.git_data_path
+	repo_url_path := "/" + npub + "/" + repo_name
+	if archived {
+		repo_git_data_path = filepath.Join(g.git_data_path, shared.ArchiveDirName)
+		repo_url_path = "/" + shared.ArchiveDirName + repo_url_path
+	}
+	repo_path := shared.RepoPath(repo_git_data_path, npub, strings.TrimSuffix(repo_name, ".git"))
+	if info, err := os.Stat(repo_path); err != nil || !info.IsDir() {
+		http.Error(w, "repository not found", http.StatusNotFound)
+		return
+	}
+	logger := g.logger.With(zap.String("repo_path", repo_path))
+
+	if suffix == RepoSyncStatusSuffix && r.Method == http.MethodGet {
+		if status, err := g.readAuth.AuthorizeGitRead(r, RequestBaseURL(r)+repo_url_path); err != nil {
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", "Nostr")
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		g.serveRepoSyncStatus(w, repo_path)
+		return
+	}
+
+	if strings.HasPrefix(suffix, GitLFSPathPrefix+"/") {
+		g.serveLFS(w, r, archived, repo_path, repo_url_path, suffix, logger)
+		return
+	}
+
+	var service string
+	switch {
+	case suffix == "/info/refs" && r.Method == http.MethodGet:
+		service = r.URL.Query().Get("service")
+	case suffix == "/git-upload-pack" && r.Method == http.MethodPost:
+		service = "git-upload-pack"
+	case suffix == "/git-receive-pack" && r.Method == http.MethodPost:
+		service = "git-receive-pack"
+	default:
+		http.Error(w, "only the git smart http protocol is supported", http.StatusNotFound)
+		return
+	}
+
+	switch service {
+	case "git-upload-pack":
+		if status, err := g.readAuth.AuthorizeGitRead(r, RequestBaseURL(r)+repo_url_path); err != nil {
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", "Nostr")
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+	case "git-receive-pack":
+		if archived {
+			http.Error(w, "this is a read-only archive of a repository that doesn't list this ngit-relay instance", http.StatusForbidden)
+			return
+		}
+		pubkey, _, identifier, err := shared.GetPubKeyAndIdentifierFromPath(repo_path)
+		if err != nil {
+			http.Error(w, "invalid repository path", http.StatusNotFound)
+			return
+		}
+		if blocked, reason := g.management.IsRepoBlocked(pubkey, identifier); blocked {
+			http.Error(w, reason, http.StatusForbidden)
+			return
+		}
+	default:
+		http.Error(w, "only the git smart http protocol is supported", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	if suffix == "/info/refs" {
+		w.Header().Set("Content-Type", "application/x-"+service+"-advertisement")
+		if !strings.Contains(r.Header.Get("Git-Protocol"), "version=2") {
+			w.Write(pktLine("# service=" + service + "\n"))
+			w.Write([]byte("0000"))
+		}
+		if err := g.runService(r.Context(), r, w, service, repo_path, nil, "--advertise-refs"); err != nil {
+			logger.Debug("git advertise refs failed", zap.String("service", service), zap.Error(err))
+		}
+		return
+	}
+
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "invalid gzip request body", http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	if service == "git-upload-pack" {
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+		if err := g.runService(r.Context(), r, w, service, repo_path, body); err != nil {
+			logger.Debug("git-upload-pack failed", zap.Error(err))
+		}
+		return
+	}
+
+	g.receivePack(w, r, body, repo_path, logger)
+}
+
+// receivePack validates the ref updates in a push against the latest state event before
+// passing the request to git receive-pack
+func (g *GitHTTP) receivePack(w http.ResponseWriter, r *http.Request, body io.Reader, repo_path string, logger *zap.Logger) {
+	w.Header().Set("Content-Type", "application/x-git-receive-pack-result")
+
+	br := bufio.NewReader(body)
+	updates, capabilities, raw, err := readReceivePackCommands(br)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pubkey, _, identifier, _ := shared.GetPubKeyAndIdentifierFromPath(repo_path)
+	// watch before querying so a state event saved in between isn't missed
+	saved, stopWatching := g.stateWaiters.Watch(identifier)
+	defer stopWatching()
+	events := queryAnnouncementAndStateEvents(r.Context(), g.relay, identifier)
+	state, stateErr := shared.GetState(events, pubkey, identifier)
+	if stateErr != nil {
+		logger.Warn("state event not in event store, will only allow refs/nostr/ refs", zap.Error(stateErr))
+	}
+
+	// the state event is often published just after the git data is pushed so wait for it
+	pack := io.Reader(br)
+	var states <-chan nostr.Event
+	window := shared.StateGraceWindow()
+	if maintainers := shared.GetMaintainers(events, pubkey, identifier); window > 0 && len(maintainers) > 0 && len(shared.CheckRefUpdates(updates, state)) > 0 {
+		// git clients expect the whole request to be read before the response
+		spool, err := os.CreateTemp("", "ngit-relay-push-*")
+		if err != nil {
+			logger.Error("cannot create temp file for push", zap.Error(err))
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		if _, err := io.Copy(spool, br); err != nil {
+			http.Error(w, "invalid receive-pack request", http.StatusBadRequest)
+			return
+		}
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		pack = spool
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		states = fromAuthors(ctx, saved, maintainers)
+	}
+	state, rejected := shared.WaitForMatchingState(r.Context(), updates, state, states, window, func(msg string) {
+		writeSideband(w, capabilities, 2, []byte(msg+"\n"))
+	})
+
+	// refs/nostr/ refs must be for a PR, PR update or patch event for this repository, or
+	// are held until the event arrives
+	nostrRejected, pendingNostrRefs := shared.CheckNostrRefUpdates(updates, queryEventsByID(r.Context(), g.relay, shared.NostrRefEventIDs(updates)), repoCoordinates(events, pubkey, identifier))
+	for ref, err := range nostrRejected {
+		rejected[ref] = err
+	}
+
+	if len(rejected) > 0 {
+		logger.Debug("push rejected", zap.Any("rejected", rejected))
+		// git clients expect the whole request to be read before the response
+		io.Copy(io.Discard, pack)
+		writeReceivePackRejection(w, updates, rejected, capabilities)
+		return
+	}
+
+	// syncs mustn't change refs while the push is applied
+	lock, err := shared.LockRepo(r.Context(), repo_path, "push")
+	if err != nil {
+		logger.Warn("cannot lock repository for push", zap.Error(err))
+		io.Copy(io.Discard, pack)
+		for _, update := range updates {
+			rejected[update.RefName] = fmt.Errorf("repository is busy, try again later")
+		}
+		writeReceivePackRejection(w, updates, rejected, capabilities)
+		return
+	}
+	err = g.runService(r.Context(), r, w, "git-receive-pack", repo_path, io.MultiReader(bytes.NewReader(raw), pack))
+	if err == nil {
+		if err := shared.RecordPendingNostrRefs(repo_path, pendingNostrRefs); err != nil {
+			logger.Warn("cannot record refs/nostr/ refs pushed before their event", zap.Error(err))
+		}
+	}
+	lock.Unlock()
+	if err != nil {
+		logger.Debug("git-receive-pack failed", zap.Error(err))
+		return
+	}
+	logger.Debug("push accepted as it matches nostr state event", zap.Int("refs", len(updates)))
+
+	// equivalent of the post-receive hook
+	go func() {
+		ctx := context.Background()
+		state, err := shared.GetState(queryAnnouncementAndStateEvents(ctx, g.relay, identifier), pubkey, identifier)
+		if err != nil {
+			return
+		}
+		if logger.Core().Enabled(zap.DebugLevel) {
+			if plan, err := shared.PlanProactiveSyncGitFromStateAndServers(state, []string{}, repo_path); err == nil {
+				logger.Debug("aligning repository with state event after push", zap.Reflect("plan", plan))
+			}
+		}
+		if err := shared.ProactiveSyncGitFromStateAndServers(state, []string{}, repo_path); err != nil {
+			logger.Debug("ProactiveSyncGitFromStateAndServers after push not successful", zap.Error(err))
+		}
+	}()
+}
+
+// runService runs a git service with --stateless-rpc, streaming its output to w
+func (g *GitHTTP) runService(ctx context.Context, r *http.Request, w http.ResponseWriter, service string, repo_path string, stdin io.Reader, args ...string) error {
+	cmdArgs := []string{
+		"-c", "safe.directory=" + repo_path,
+		// pushes are validated in-process rather than by the pre-receive hook
+		"-c", "core.hooksPath=/dev/null",
+		strings.TrimPrefix(service, "git-"), "--stateless-rpc",
+	}
+	cmdArgs = append(append(cmdArgs, args...), repo_path)
+	cmd := exec.CommandContext(ctx, "git", cmdArgs...)
+	cmd.Env = os.Environ()
+	if protocol := r.Header.Get("Git-Protocol"); protocol != "" {
+		cmd.Env = append(cmd.Env, "GIT_PROTOCOL="+protocol)
+	}
+	var stderr bytes.Buffer
+	cmd.Stdin = stdin
+	cmd.Stdout = flushWriter{w}
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// readReceivePackCommands reads the ref update commands at the start of a receive-pack
+// request. raw holds the bytes read so the request can be passed on to git.
+func readReceivePackCommands(br *bufio.Reader) (updates []shared.RefUpdate, capabilities []string, raw []byte, err error) {
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(br, header); err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid receive-pack request: %w", err)
+		}
+		raw = append(raw, header...)
+		length, err := strconv.ParseUint(string(header), 16, 16)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid pkt-line length: %s", header)
+		}
+		if length == 0 {
+			// flush-pkt ends the commands
+			return updates, capabilities, raw, nil
+		}
+		if length < 4 {
+			return nil, nil, nil, fmt.Errorf("invalid pkt-line length: %s", header)
+		}
+		payload := make([]byte, length-4)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid receive-pack request: %w", err)
+		}
+		raw = append(raw, payload...)
+
+		line := strings.TrimSuffix(string(payload), "\n")
+		if command, caps, found := strings.Cut(line, "\x00"); found {
+			line = command
+			capabilities = strings.Fields(caps)
+		}
+		if strings.HasPrefix(line, "shallow ") {
+			continue
+		}
+		if strings.HasPrefix(line, "push-cert") {
+			return nil, nil, nil, fmt.Errorf("push certificates are not supported")
+		}
+		update, err := shared.ParseRefUpdate(line)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		updates = append(updates, update)
+	}
+}
+
+// writeReceivePackRejection reports every ref update as rejected, as the pre-receive hook
+// would have done, using the report-status format and side-band requested by the client
+func writeReceivePackRejection(w http.ResponseWriter, updates []shared.RefUpdate, rejected map[string]error, capabilities []string) {
+	for _, update := range updates {
+		if err, exists := rejected[update.RefName]; exists {
+			writeSideband(w, capabilities, 2, []byte("error: "+err.Error()+"\n"))
+		}
+	}
+
+	if slices.Contains(capabilities, "report-status") || slices.Contains(capabilities, "report-status-v2") {
+		var report bytes.Buffer
+		report.Write(pktLine("unpack ok\n"))
+		for _, update := range updates {
+			reason := "pre-receive hook declined"
+			if err, exists := rejected[update.RefName]; exists {
+				reason = err.Error()
+			}
+			report.Write(pktLine("ng " + update.RefName + " " + reason + "\n"))
+		}
+		report.WriteString("0000")
+		writeSideband(w, capabilities, 1, report.Bytes())
+	}
+
+	if usesSideband(capabilities) {
+		w.Write([]byte("0000"))
+	}
+}
+
+func usesSideband(capabilities []string) bool {
+	return slices.Contains(capabilities, "side-band-64k") || slices.Contains(capabilities, "side-band")
+}
+
+// writeSideband writes data to a side-band channel requested by the client: 1 for pack
+// data, 2 for progress shown as "remote: ". Without side-band only channel 1 is written.
+func writeSideband(w http.ResponseWriter, capabilities []string, band byte, data []byte) {
+	if !usesSideband(capabilities) {
+		if band == 1 {
+			w.Write(data)
+		}
+		return
+	}
+	// max pkt-line payload, excluding the band byte
+	chunkSize := 999
+	if slices.Contains(capabilities, "side-band-64k") {
+		chunkSize = 65515
+	}
+	for chunk := range slices.Chunk(data, chunkSize) {
+		flushWriter{w}.Write(pktLine(string(append([]byte{band}, chunk...))))
+	}
+}
+
+// queryAnnouncementAndStateEvents is the in-process equivalent of
+// shared.FetchAnnouncementAndStateEventsFromRelay
+func queryAnnouncementAndStateEvents(ctx context.Context, relay *khatru.Relay, identifier string) []nostr.Event {
+	events := []nostr.Event{}
+	for _, query := range relay.QueryEvents {
+		ch, err := query(ctx, nostr.Filter{
+			Kinds: []int{nostr.KindRepositoryAnnouncement, nostr.KindRepositoryState},
+			Tags:  nostr.TagMap{"d": []string{identifier}},
+		})
+		if err != nil {
+			continue
+		}
+		for ev := range ch {
+			events = append(events, *ev)
+		}
+	}
+	return events
+}
+
+func pktLine(s string) []byte {
+	return []byte(fmt.Sprintf("%04x%s", len(s)+4, s))
+}
+
+// flushWriter flushes after every write so git progress is streamed to the client
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
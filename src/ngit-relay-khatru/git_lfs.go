@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"ngit-relay/shared"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/zap"
+)
+
+// GitLFSPathPrefix is where the git lfs api of a repository is served, the default lfs url
+// for the remote /npub123/repo.git
+const GitLFSPathPrefix = "/info/lfs"
+
+const gitLFSContentType = "application/vnd.git-lfs+json"
+
+// gitLFSTokenExpiry is how long the transfer urls returned by the batch api can be used
+const gitLFSTokenExpiry = time.Hour
+
+type gitLFSBatchRequest struct {
+	Operation string            `json:"operation"`
+	Transfers []string          `json:"transfers,omitempty"`
+	HashAlgo  string            `json:"hash_algo,omitempty"`
+	Objects   []gitLFSObjectRef `json:"objects"`
+}
+
+type gitLFSObjectRef struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+type gitLFSBatchResponse struct {
+	Transfer string         `json:"transfer"`
+	HashAlgo string         `json:"hash_algo"`
+	Objects  []gitLFSObject `json:"objects"`
+}
+
+type gitLFSObject struct {
+	Oid           string                  `json:"oid"`
+	Size          int64                   `json:"size"`
+	Authenticated bool                    `json:"authenticated,omitempty"`
+	Actions       map[string]gitLFSAction `json:"actions,omitempty"`
+	Error         *gitLFSError            `json:"error,omitempty"`
+}
+
+type gitLFSAction struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header,omitempty"`
+	ExpiresIn int               `json:"expires_in,omitempty"`
+}
+
+type gitLFSError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// gitLFSGrant is what a transfer url issued by the batch api allows
+type gitLFSGrant struct {
+	repo_path string
+	operation string
+	oid       string
+	size      int64
+	auth      *nostr.Event // the NIP-98 event that authorized an upload
+	expires   time.Time
+}
+
+// GitLFSTokens are the bearer tokens for the transfer urls returned by the batch api. They
+// are only kept in memory; clients request new ones with another batch request.
+type GitLFSTokens struct {
+	mu     sync.Mutex
+	grants map[string]gitLFSGrant
+}
+
+func NewGitLFSTokens() *GitLFSTokens {
+	return &GitLFSTokens{grants: make(map[string]gitLFSGrant)}
+}
+
+func (t *GitLFSTokens) issue(grant gitLFSGrant) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for existing, g := range t.grants {
+		if time.Now().After(g.expires) {
+			delete(t.grants, existing)
+		}
+	}
+	grant.expires = time.Now().Add(gitLFSTokenExpiry)
+	t.grants[token] = grant
+	return token
+}
+
+// check returns the grant for the token in the Authorization header if it allows operation
+// on the object
+func (t *GitLFSTokens) check(r *http.Request, repo_path string, operation string, oid string) (gitLFSGrant, bool) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return gitLFSGrant{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	grant, exists := t.grants[token]
+	if !exists || time.Now().After(grant.expires) || grant.repo_path != repo_path || grant.operation != operation || grant.oid != oid {
+		return gitLFSGrant{}, false
+	}
+	return grant, true
+}
+
+// serveLFS serves the git lfs batch api and basic transfers for a repository, storing objects
+// as blossom blobs as both are identified by their sha256. Uploads need a NIP-98
+// Authorization header on the batch request from a maintainer of the repository. Downloads
+// follow the same rules as git fetches.
+func (g *GitHTTP) serveLFS(w http.ResponseWriter, r *http.Request, archived bool, repo_path string, repo_url_path string, suffix string, logger *zap.Logger) {
+	path := strings.TrimPrefix(suffix, GitLFSPathPrefix)
+	switch {
+	case path == "/objects/batch" && r.Method == http.MethodPost:
+		g.serveLFSBatch(w, r, archived, repo_path, repo_url_path, logger)
+	case strings.HasPrefix(path, "/objects/") && r.Method == http.MethodGet:
+		g.serveLFSDownload(w, r, repo_path, repo_url_path, strings.TrimPrefix(path, "/objects/"))
+	case strings.HasPrefix(path, "/objects/") && r.Method == http.MethodPut:
+		g.serveLFSUpload(w, r, repo_path, strings.TrimPrefix(path, "/objects/"), logger)
+	default:
+		// includes the locking api, which git lfs carries on without
+		writeLFSError(w, http.StatusNotFound, "not supported by this server")
+	}
+}
+
+func (g *GitHTTP) serveLFSBatch(w http.ResponseWriter, r *http.Request, archived bool, repo_path string, repo_url_path string, logger *zap.Logger) {
+	var batch gitLFSBatchRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 10*1024*1024)).Decode(&batch); err != nil {
+		writeLFSError(w, http.StatusUnprocessableEntity, "invalid batch request")
+		return
+	}
+	if batch.HashAlgo != "" && batch.HashAlgo != "sha256" {
+		writeLFSError(w, http.StatusConflict, "only sha256 is supported")
+		return
+	}
+	if len(batch.Transfers) > 0 && !slices.Contains(batch.Transfers, "basic") {
+		writeLFSError(w, http.StatusConflict, "only the basic transfer adapter is supported")
+		return
+	}
+	repo_url := RequestBaseURL(r) + repo_url_path
+
+	var auth *nostr.Event
+	switch batch.Operation {
+	case "download":
+		if status, err := g.readAuth.AuthorizeGitRead(r, repo_url); err != nil {
+			writeLFSAuthError(w, status, err.Error())
+			return
+		}
+	case "upload":
+		if archived {
+			writeLFSError(w, http.StatusForbidden, "this is a read-only archive of a repository that doesn't list this ngit-relay instance")
+			return
+		}
+		pubkey, _, identifier, err := shared.GetPubKeyAndIdentifierFromPath(repo_path)
+		if err != nil {
+			writeLFSError(w, http.StatusNotFound, "invalid repository path")
+			return
+		}
+		if blocked, reason := g.management.IsRepoBlocked(pubkey, identifier); blocked {
+			writeLFSError(w, http.StatusForbidden, reason)
+			return
+		}
+		auth, err = ValidateNip98Auth(r, nil, repo_url)
+		if err != nil {
+			writeLFSAuthError(w, http.StatusUnauthorized, "auth-required: "+err.Error())
+			return
+		}
+		maintainers := shared.GetMaintainers(queryAnnouncementAndStateEvents(r.Context(), g.relay, identifier), pubkey, identifier)
+		if !slices.Contains(maintainers, auth.PubKey) {
+			logger.Debug("lfs upload rejected", zap.String("pubkey", auth.PubKey))
+			writeLFSError(w, http.StatusForbidden, "restricted: only maintainers of the repository can upload lfs objects")
+			return
+		}
+	default:
+		writeLFSError(w, http.StatusUnprocessableEntity, "unknown operation: "+batch.Operation)
+		return
+	}
+
+	response := gitLFSBatchResponse{Transfer: "basic", HashAlgo: "sha256", Objects: []gitLFSObject{}}
+	for _, ref := range batch.Objects {
+		object := gitLFSObject{Oid: ref.Oid, Size: ref.Size}
+		exists := g.blobs.HasBlob(ref.Oid)
+		switch {
+		case !isBlobHash(ref.Oid) || ref.Size < 0:
+			object.Error = &gitLFSError{Code: http.StatusUnprocessableEntity, Message: "invalid object"}
+		case batch.Operation == "download" && !exists:
+			object.Error = &gitLFSError{Code: http.StatusNotFound, Message: "object not found"}
+		case batch.Operation == "upload" && exists:
+			// already stored, so there's nothing to upload
+		default:
+			token := g.lfsTokens.issue(gitLFSGrant{
+				repo_path: repo_path,
+				operation: batch.Operation,
+				oid:       ref.Oid,
+				size:      ref.Size,
+				auth:      auth,
+			})
+			object.Authenticated = true
+			object.Actions = map[string]gitLFSAction{
+				batch.Operation: {
+					Href:      repo_url + GitLFSPathPrefix + "/objects/" + ref.Oid,
+					Header:    map[string]string{"Authorization": "Bearer " + token},
+					ExpiresIn: int(gitLFSTokenExpiry.Seconds()),
+				},
+			}
+		}
+		response.Objects = append(response.Objects, object)
+	}
+
+	w.Header().Set("Content-Type", gitLFSContentType)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (g *GitHTTP) serveLFSDownload(w http.ResponseWriter, r *http.Request, repo_path string, repo_url_path string, oid string) {
+	if _, ok := g.lfsTokens.check(r, repo_path, "download", oid); !ok {
+		if status, err := g.readAuth.AuthorizeGitRead(r, RequestBaseURL(r)+repo_url_path); err != nil {
+			writeLFSAuthError(w, status, err.Error())
+			return
+		}
+	}
+	file, err := g.blobs.OpenBlob(oid)
+	if err != nil {
+		writeLFSError(w, http.StatusNotFound, "object not found")
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "public, max-age=604800, immutable")
+	http.ServeContent(w, r, oid, time.Unix(0, 0), file)
+}
+
+func (g *GitHTTP) serveLFSUpload(w http.ResponseWriter, r *http.Request, repo_path string, oid string, logger *zap.Logger) {
+	grant, ok := g.lfsTokens.check(r, repo_path, "upload", oid)
+	if !ok {
+		writeLFSAuthError(w, http.StatusUnauthorized, "request an upload with the batch api first")
+		return
+	}
+	if g.blobs.HasBlob(oid) {
+		io.Copy(io.Discard, io.LimitReader(r.Body, grant.size+1))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	size := grant.size
+	if length, err := strconv.ParseInt(r.Header.Get("Content-Length"), 10, 64); err == nil && length != size {
+		writeLFSError(w, http.StatusUnprocessableEntity, "Content-Length doesn't match the size in the batch request")
+		return
+	}
+	if reject, reason, code := g.blobs.RejectUpload(r.Context(), grant.auth, int(size), ""); reject {
+		writeLFSError(w, code, reason)
+		return
+	}
+	// a body longer than the batch request said is read no further than needed to reject it
+	body := io.LimitReader(r.Body, size+1)
+	if _, err := g.blobs.StoreBlobFromReader(r.Context(), body, oid, size, grant.auth.PubKey, "application/octet-stream"); err != nil {
+		logger.Debug("lfs upload failed", zap.String("oid", oid), zap.Error(err))
+		writeLFSError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	logger.Debug("lfs object stored", zap.String("oid", oid), zap.Int64("size", size), zap.String("pubkey", grant.auth.PubKey))
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeLFSError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", gitLFSContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+// writeLFSAuthError asks git lfs to retry with credentials on 401
+func writeLFSAuthError(w http.ResponseWriter, status int, message string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("LFS-Authenticate", "Nostr")
+		w.Header().Set("WWW-Authenticate", "Nostr")
+	}
+	writeLFSError(w, status, message)
+}
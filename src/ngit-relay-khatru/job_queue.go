@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"ngit-relay/shared"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/zap"
+)
+
+const (
+	JobStatusQueued  = "queued"
+	JobStatusRunning = "running"
+	JobStatusFailed  = "failed"
+)
+
+const (
+	// jobs are retried with exponential backoff until they have been attempted this many times
+	jobMaxAttempts = 5
+	jobBaseBackoff = 30 * time.Second
+	jobMaxBackoff  = 30 * time.Minute
+	// debouncing never delays a job more than this since it was first queued
+	jobMaxDebounce = 5 * time.Minute
+	// failed jobs are kept this long to be listed, apart from the queue dispatch scans
+	jobFailedTTL = 7 * 24 * time.Hour
+)
+
+// Job is a unit of background work. Jobs with the same Key are coalesced: enqueuing a job
+// that is still being debounced replaces its event and restarts its debounce delay.
+type Job struct {
+	Key       string        `json:"key"`
+	Kind      string        `json:"kind"`
+	Event     *nostr.Event  `json:"event,omitempty"`
+	Status    string        `json:"status"`
+	Delay     time.Duration `json:"delay"`
+	Attempts  int           `json:"attempts"`
+	LastError string        `json:"last_error,omitempty"`
+	QueuedAt  time.Time     `json:"queued_at"`
+	NotBefore time.Time     `json:"not_before"`
+	// Rerun is set when the job is enqueued again while running
+	Rerun bool `json:"rerun,omitempty"`
+}
+
+type JobHandler func(ctx context.Context, job *Job) error
+
+// JobQueue is a persistent queue of background jobs stored in badger, so pending work
+// survives restarts, run by a bounded number of workers
+type JobQueue struct {
+	db       *badger.DB
+	workers  int
+	handlers map[string]JobHandler
+	logger   *zap.Logger
+
+	mu      sync.Mutex // serialises updates to jobs
+	running map[string]bool
+	work    chan *Job
+	wake    chan struct{}
+}
+
+func NewJobQueue(path string, workers int) (*JobQueue, error) {
+	db, err := badger.Open(badger.DefaultOptions(path).WithLogger(nil))
+	if err != nil {
+		return nil, fmt.Errorf("cannot open job queue db: %w", err)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return &JobQueue{
+		db:       db,
+		workers:  workers,
+		handlers: make(map[string]JobHandler),
+		logger:   shared.L().With(zap.String("type", "JobQueue")),
+		running:  make(map[string]bool),
+		work:     make(chan *Job),
+		wake:     make(chan struct{}, 1),
+	}, nil
+}
+
+// Handle registers the handler for a kind of job. It must be called before Start.
+func (q *JobQueue) Handle(kind string, handler JobHandler) {
+	q.handlers[kind] = handler
+}
+
+// Start recovers jobs interrupted by a restart and starts the workers
+func (q *JobQueue) Start() {
+	q.mu.Lock()
+	jobs, err := q.list()
+	if err != nil {
+		q.logger.Error("cannot list jobs to recover", zap.Error(err))
+	}
+	for _, job := range jobs {
+		if job.Status == JobStatusFailed {
+			// failed before they were kept apart from the queue
+			if err := q.saveFailed(job); err != nil {
+				q.logger.Error("cannot move failed job", zap.String("key", job.Key), zap.Error(err))
+			}
+			continue
+		}
+		if job.Status == JobStatusRunning {
+			job.Status = JobStatusQueued
+			job.Rerun = false
+			if err := q.save(job); err != nil {
+				q.logger.Error("cannot recover job", zap.String("key", job.Key), zap.Error(err))
+			}
+		}
+	}
+	q.mu.Unlock()
+	if len(jobs) > 0 {
+		q.logger.Info("recovered jobs", zap.Int("jobs", len(jobs)))
+	}
+
+	for i := 0; i < q.workers; i++ {
+		go q.worker()
+	}
+	go q.dispatch()
+}
+
+// Enqueue queues a job to run after delay, coalescing it with a job with the same key that
+// is still being debounced. A job waiting to be retried is replaced by a fresh one, with its
+// own debounce and attempts.
+func (q *JobQueue) Enqueue(kind string, key string, event *nostr.Event, delay time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	job, err := q.get(key)
+	if err != nil {
+		return err
+	}
+	switch {
+	case job == nil || job.Status == JobStatusFailed || (job.Status == JobStatusQueued && job.Attempts > 0):
+		job = &Job{Key: key, Kind: kind, Status: JobStatusQueued, QueuedAt: now}
+	case job.Status == JobStatusRunning:
+		job.Rerun = true
+	}
+	job.Event = event
+	job.Delay = delay
+	job.NotBefore = now.Add(delay)
+	if limit := job.QueuedAt.Add(jobMaxDebounce); job.Status == JobStatusQueued && job.NotBefore.After(limit) {
+		job.NotBefore = limit
+	}
+	if err := q.save(job); err != nil {
+		return err
+	}
+	if err := q.deleteFailed(key); err != nil {
+		return err
+	}
+	q.signal()
+	return nil
+}
+
+// List returns every queued, running and failed job
+func (q *JobQueue) List() ([]*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs, err := q.list()
+	if err != nil {
+		return nil, err
+	}
+	failed, err := q.listPrefix(failedJobDBPrefix)
+	return append(jobs, failed...), err
+}
+
+func (q *JobQueue) dispatch() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		q.mu.Lock()
+		jobs, err := q.list()
+		q.mu.Unlock()
+		if err != nil {
+			q.logger.Error("cannot list jobs", zap.Error(err))
+		}
+
+		now := time.Now()
+		jobs = slices.DeleteFunc(jobs, func(job *Job) bool {
+			return job.Status != JobStatusQueued || job.NotBefore.After(now)
+		})
+		slices.SortFunc(jobs, func(a, b *Job) int { return a.NotBefore.Compare(b.NotBefore) })
+
+	dispatching:
+		for _, candidate := range jobs {
+			q.mu.Lock()
+			// the job may have been coalesced with a newer one since it was listed
+			job, err := q.get(candidate.Key)
+			if err != nil || job == nil || job.Status != JobStatusQueued || job.NotBefore.After(now) || q.running[job.Key] {
+				q.mu.Unlock()
+				continue
+			}
+			job.Status = JobStatusRunning
+			job.Attempts++
+			if err := q.save(job); err != nil {
+				q.logger.Error("cannot mark job as running", zap.String("key", job.Key), zap.Error(err))
+				q.mu.Unlock()
+				continue
+			}
+			select {
+			case q.work <- job:
+				q.running[job.Key] = true
+				q.mu.Unlock()
+			default:
+				// all workers are busy
+				job.Status = JobStatusQueued
+				job.Attempts--
+				q.save(job)
+				q.mu.Unlock()
+				break dispatching
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+func (q *JobQueue) worker() {
+	for job := range q.work {
+		logger := q.logger.With(zap.String("key", job.Key), zap.Int("attempt", job.Attempts))
+		var err error
+		if handler, ok := q.handlers[job.Kind]; ok {
+			err = handler(context.Background(), job)
+		} else {
+			err = fmt.Errorf("no handler for job kind %s", job.Kind)
+		}
+		if err != nil {
+			logger.Debug("job failed", zap.Error(err))
+		}
+		q.finish(job.Key, err)
+	}
+}
+
+// finish removes a successful job, or schedules a retry of a failed one. Jobs enqueued again
+// while running are queued to run again.
+func (q *JobQueue) finish(key string, jobErr error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.signal()
+	delete(q.running, key)
+
+	job, err := q.get(key)
+	if err != nil || job == nil {
+		q.logger.Error("cannot find finished job", zap.String("key", key), zap.Error(err))
+		return
+	}
+
+	switch {
+	case job.Rerun:
+		job = &Job{Key: job.Key, Kind: job.Kind, Event: job.Event, Status: JobStatusQueued, Delay: job.Delay, QueuedAt: time.Now(), NotBefore: time.Now().Add(job.Delay)}
+	case jobErr == nil:
+		if err := q.delete(key); err != nil {
+			q.logger.Error("cannot delete finished job", zap.String("key", key), zap.Error(err))
+		}
+		return
+	case job.Attempts >= jobMaxAttempts:
+		job.Status = JobStatusFailed
+		job.LastError = jobErr.Error()
+		q.logger.Warn("job failed too many times, giving up", zap.String("key", key), zap.Error(jobErr))
+		if err := q.saveFailed(job); err != nil {
+			q.logger.Error("cannot save failed job", zap.String("key", key), zap.Error(err))
+		}
+		return
+	default:
+		backoff := min(jobBaseBackoff<<(job.Attempts-1), jobMaxBackoff)
+		job.Status = JobStatusQueued
+		job.LastError = jobErr.Error()
+		job.NotBefore = time.Now().Add(backoff)
+	}
+	if err := q.save(job); err != nil {
+		q.logger.Error("cannot save finished job", zap.String("key", key), zap.Error(err))
+	}
+}
+
+func (q *JobQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// queued and running jobs are kept under jobDBPrefix, scanned by dispatch every second, and
+// failed jobs under failedJobDBPrefix until they expire
+const (
+	jobDBPrefix       = "job:"
+	failedJobDBPrefix = "failed-job:"
+)
+
+func jobDBKey(key string) []byte {
+	return []byte(jobDBPrefix + key)
+}
+
+func (q *JobQueue) get(key string) (*Job, error) {
+	var job *Job
+	err := q.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(jobDBKey(key))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			job = &Job{}
+			return json.Unmarshal(val, job)
+		})
+	})
+	return job, err
+}
+
+func (q *JobQueue) save(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return q.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(jobDBKey(job.Key), data)
+	})
+}
+
+func (q *JobQueue) delete(key string) error {
+	return q.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(jobDBKey(key))
+	})
+}
+
+// saveFailed moves a job out of the queue, to be listed until it expires
+func (q *JobQueue) saveFailed(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return q.db.Update(func(txn *badger.Txn) error {
+		if err := txn.SetEntry(badger.NewEntry([]byte(failedJobDBPrefix+job.Key), data).WithTTL(jobFailedTTL)); err != nil {
+			return err
+		}
+		return txn.Delete(jobDBKey(job.Key))
+	})
+}
+
+func (q *JobQueue) deleteFailed(key string) error {
+	return q.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(failedJobDBPrefix + key))
+	})
+}
+
+// list returns the queued and running jobs
+func (q *JobQueue) list() ([]*Job, error) {
+	return q.listPrefix(jobDBPrefix)
+}
+
+func (q *JobQueue) listPrefix(prefix string) ([]*Job, error) {
+	jobs := []*Job{}
+	err := q.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte(prefix)})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			err := it.Item().Value(func(val []byte) error {
+				job := &Job{}
+				if err := json.Unmarshal(val, job); err != nil {
+					return err
+				}
+				jobs = append(jobs, job)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return jobs, err
+}
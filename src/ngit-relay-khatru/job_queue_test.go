@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"ngit-relay/shared"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func newTestJobQueue(t *testing.T, path string) *JobQueue {
+	t.Setenv("NGIT_LOG_DIR", t.TempDir())
+	shared.Init("ngit-relay-khatru-test", false, false)
+	q, err := NewJobQueue(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestJobQueueEnqueueCoalesces(t *testing.T) {
+	q := newTestJobQueue(t, t.TempDir())
+	defer q.db.Close()
+
+	first := &nostr.Event{ID: "first"}
+	second := &nostr.Event{ID: "second"}
+	if err := q.Enqueue(JobKindSync, "sync:repo", first, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue(JobKindSync, "sync:repo", second, 2*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue(JobKindSync, "sync:other", first, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("got %d jobs, want 2", len(jobs))
+	}
+	job, _ := q.get("sync:repo")
+	if job.Event.ID != "second" {
+		t.Errorf("coalesced job has event %s, want the latest", job.Event.ID)
+	}
+	if wait := time.Until(job.NotBefore); wait < time.Minute || wait > 2*time.Minute {
+		t.Errorf("coalesced job runs in %s, want its delay restarted", wait)
+	}
+
+	// debouncing never delays a job more than jobMaxDebounce since it was first queued
+	if err := q.Enqueue(JobKindSync, "sync:repo", second, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	job, _ = q.get("sync:repo")
+	if limit := job.QueuedAt.Add(jobMaxDebounce); !job.NotBefore.Equal(limit) {
+		t.Errorf("NotBefore = %s, want capped at %s", job.NotBefore, limit)
+	}
+
+	// a job waiting to be retried is replaced by a fresh one, debounced from now
+	job.Attempts = 2
+	job.LastError = "git server unavailable"
+	job.QueuedAt = time.Now().Add(-time.Hour)
+	job.NotBefore = time.Now().Add(time.Hour)
+	q.save(job)
+	if err := q.Enqueue(JobKindSync, "sync:repo", first, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	job, _ = q.get("sync:repo")
+	if job.Attempts != 0 || job.LastError != "" || time.Since(job.QueuedAt) > time.Minute {
+		t.Errorf("job replacing a retry has attempts %d, error %q and was queued %s ago, want a fresh job", job.Attempts, job.LastError, time.Since(job.QueuedAt))
+	}
+	if wait := time.Until(job.NotBefore); wait < 55*time.Second || wait > time.Minute {
+		t.Errorf("job replacing a retry runs in %s, want its own delay", wait)
+	}
+
+	// enqueued while running, it is marked to run again rather than replaced
+	job.Status = JobStatusRunning
+	q.save(job)
+	if err := q.Enqueue(JobKindSync, "sync:repo", first, 0); err != nil {
+		t.Fatal(err)
+	}
+	job, _ = q.get("sync:repo")
+	if job.Status != JobStatusRunning || !job.Rerun {
+		t.Errorf("job enqueued while running has status %s and rerun %v, want running and true", job.Status, job.Rerun)
+	}
+}
+
+func TestJobQueueFinish(t *testing.T) {
+	q := newTestJobQueue(t, t.TempDir())
+	defer q.db.Close()
+
+	jobErr := errors.New("git server unavailable")
+	tests := []struct {
+		name       string
+		attempts   int
+		rerun      bool
+		err        error
+		wantStatus string // "" for removed from the queue
+		wantWait   time.Duration
+	}{
+		{"success is removed", 1, false, nil, "", 0},
+		{"first failure is retried", 1, false, jobErr, JobStatusQueued, jobBaseBackoff},
+		{"retries back off exponentially", 3, false, jobErr, JobStatusQueued, 4 * jobBaseBackoff},
+		{"gives up after max attempts", jobMaxAttempts, false, jobErr, "", 0},
+		{"rerun is queued afresh", 2, true, jobErr, JobStatusQueued, time.Second},
+	}
+	for _, test := range tests {
+		key := "test:" + test.name
+		q.save(&Job{Key: key, Kind: JobKindSync, Status: JobStatusRunning, Attempts: test.attempts, Rerun: test.rerun, Delay: time.Second, QueuedAt: time.Now()})
+		q.running[key] = true
+
+		q.finish(key, test.err)
+
+		job, err := q.get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.running[key] {
+			t.Errorf("%s: still marked as running", test.name)
+		}
+		if test.wantStatus == "" {
+			if job != nil {
+				t.Errorf("%s: job not removed, status %s", test.name, job.Status)
+			}
+			continue
+		}
+		if job == nil {
+			t.Errorf("%s: job removed, want status %s", test.name, test.wantStatus)
+			continue
+		}
+		if job.Status != test.wantStatus {
+			t.Errorf("%s: status %s, want %s", test.name, job.Status, test.wantStatus)
+		}
+		if test.wantWait > 0 {
+			if wait := time.Until(job.NotBefore); wait > test.wantWait || wait < test.wantWait-5*time.Second {
+				t.Errorf("%s: retries in %s, want %s", test.name, wait, test.wantWait)
+			}
+		}
+		if test.rerun && (job.Attempts != 0 || job.LastError != "") {
+			t.Errorf("%s: rerun kept attempts %d and error %q", test.name, job.Attempts, job.LastError)
+		}
+		if !test.rerun && job.LastError != jobErr.Error() {
+			t.Errorf("%s: last error %q, want %q", test.name, job.LastError, jobErr.Error())
+		}
+	}
+}
+
+func TestJobQueueKeepsFailedJobsOutOfTheQueue(t *testing.T) {
+	q := newTestJobQueue(t, t.TempDir())
+	defer q.db.Close()
+
+	key := "sync:repo"
+	q.save(&Job{Key: key, Kind: JobKindSync, Status: JobStatusRunning, Attempts: jobMaxAttempts, QueuedAt: time.Now()})
+	q.running[key] = true
+	q.finish(key, errors.New("git server unavailable"))
+
+	// dispatch doesn't see it, but it is listed
+	if queued, _ := q.list(); len(queued) != 0 {
+		t.Errorf("failed job left in the queue dispatch scans")
+	}
+	jobs, err := q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Status != JobStatusFailed {
+		t.Fatalf("List() = %v, want the failed job", jobs)
+	}
+
+	// enqueued again, it replaces the failed job
+	if err := q.Enqueue(JobKindSync, key, nil, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	jobs, _ = q.List()
+	if len(jobs) != 1 || jobs[0].Status != JobStatusQueued || jobs[0].Attempts != 0 {
+		t.Errorf("List() after enqueuing again = %v, want one fresh queued job", jobs)
+	}
+}
+
+func TestJobQueueRecoversAfterRestart(t *testing.T) {
+	path := t.TempDir()
+	q := newTestJobQueue(t, path)
+	// interrupted while running, and one still waiting
+	q.save(&Job{Key: "sync:interrupted", Kind: JobKindSync, Status: JobStatusRunning, Attempts: 1, QueuedAt: time.Now()})
+	if err := q.Enqueue(JobKindSync, "sync:waiting", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	q.db.Close()
+
+	q = newTestJobQueue(t, path)
+	ran := make(chan string, 2)
+	q.Handle(JobKindSync, func(ctx context.Context, job *Job) error {
+		ran <- job.Key
+		return nil
+	})
+	q.Start()
+
+	got := map[string]bool{}
+	for len(got) < 2 {
+		select {
+		case key := <-ran:
+			got[key] = true
+		case <-time.After(10 * time.Second):
+			t.Fatalf("jobs run after restart: %v, want both", got)
+		}
+	}
+	// finished jobs are removed
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		jobs, _ := q.List()
+		if len(jobs) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d jobs left after running", len(jobs))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/fiatjaf/eventstore/badger"
@@ -18,15 +20,25 @@ import (
 )
 
 type Config struct {
-	Domain               string
-	RelayDataPath        string
-	GitDataPath          string
-	BlossomDataPath      string
-	OwnerNpub            string `json:"pubkey"`
-	RelayName            string
-	RelayDescription     string
-	BlossomMaxFileSizeMb int
-	BlossomMaxCapacityGb int
+	Domain                   string
+	RelayDataPath            string
+	GitDataPath              string
+	BlossomDataPath          string
+	OwnerNpub                string `json:"pubkey"`
+	RelayName                string
+	RelayDescription         string
+	BlossomMaxFileSizeMb     int
+	BlossomMaxCapacityGb     int
+	BlossomUserQuotaMb       int
+	BlossomMaintainerQuotaMb int
+	BlossomOpenUploads       bool
+	BlossomUploadWhitelist   []string
+	ArchiveFile              string
+	ArchiveLookupRelays      []string
+	ProvisioningMode         string
+	ProvisioningWhitelist    []string
+	AuthToRead               bool
+	ReadWhitelist            []string
 }
 
 var commitID string
@@ -54,15 +66,25 @@ func main() {
 	}
 
 	config := Config{
-		Domain:               getEnv("NGIT_DOMAIN"),
-		RelayDataPath:        *relay_data_path,   // Dereference the pointer to get the string value
-		GitDataPath:          *git_data_path,     // Dereference the pointer to get the string value
-		BlossomDataPath:      *blossom_data_path, // Dereference the pointer to get the string value
-		OwnerNpub:            getEnv("NGIT_OWNER_NPUB"),
-		RelayName:            getEnv("NGIT_RELAY_NAME"),
-		RelayDescription:     getEnv("NGIT_RELAY_DESCRIPTION"),
-		BlossomMaxFileSizeMb: getEnvInt("NGIT_BLOSSOM_MAX_FILE_SIZE_MB", 100),
-		BlossomMaxCapacityGb: getEnvInt("NGIT_BLOSSOM_MAX_CAPACITY_GB", 50),
+		Domain:                   getEnv("NGIT_DOMAIN"),
+		RelayDataPath:            *relay_data_path,   // Dereference the pointer to get the string value
+		GitDataPath:              *git_data_path,     // Dereference the pointer to get the string value
+		BlossomDataPath:          *blossom_data_path, // Dereference the pointer to get the string value
+		OwnerNpub:                getEnv("NGIT_OWNER_NPUB"),
+		RelayName:                getEnv("NGIT_RELAY_NAME"),
+		RelayDescription:         getEnv("NGIT_RELAY_DESCRIPTION"),
+		BlossomMaxFileSizeMb:     getEnvInt("NGIT_BLOSSOM_MAX_FILE_SIZE_MB", 100),
+		BlossomMaxCapacityGb:     getEnvInt("NGIT_BLOSSOM_MAX_CAPACITY_GB", 50),
+		BlossomUserQuotaMb:       getEnvInt("NGIT_BLOSSOM_USER_QUOTA_MB", 500),
+		BlossomMaintainerQuotaMb: getEnvInt("NGIT_BLOSSOM_MAINTAINER_QUOTA_MB", 5000),
+		BlossomOpenUploads:       shared.GetEnvBool("NGIT_BLOSSOM_OPEN_UPLOADS", false),
+		BlossomUploadWhitelist:   getEnvList("NGIT_BLOSSOM_UPLOAD_WHITELIST", []string{}),
+		ArchiveFile:              getEnvDefault("NGIT_ARCHIVE_FILE", ""),
+		ArchiveLookupRelays:      getEnvList("NGIT_ARCHIVE_LOOKUP_RELAYS", []string{"wss://relay.damus.io", "wss://nos.lol", "wss://relay.nostr.band"}),
+		ProvisioningMode:         getEnvDefault("NGIT_PROVISIONING_MODE", ProvisioningModeOpen),
+		ProvisioningWhitelist:    getEnvList("NGIT_PROVISIONING_WHITELIST", []string{}),
+		AuthToRead:               shared.GetEnvBool("NGIT_AUTH_TO_READ", false),
+		ReadWhitelist:            getEnvList("NGIT_READ_WHITELIST", []string{}),
 	}
 	OwnerPubkey, err := shared.GetPubkeyFromNpub(config.OwnerNpub)
 	if err != nil {
@@ -84,22 +106,97 @@ func main() {
 		relay.Info.Version = relay.Info.Version + "-" + commitID
 	}
 
+	management, err := NewRelayManagement(relay, config.GitDataPath, OwnerPubkey)
+	if err != nil {
+		logger.Fatal("cannot load relay management state", zap.Error(err))
+	}
+	archive := NewArchive(relay, config, OwnerPubkey, management)
+	provisioning, err := NewProvisioning(relay, config, OwnerPubkey, management)
+	if err != nil {
+		logger.Fatal("invalid provisioning config", zap.Error(err))
+	}
+	readAuth, err := NewReadAuth(config, OwnerPubkey)
+	if err != nil {
+		logger.Fatal("invalid auth to read config", zap.Error(err))
+	}
+
 	db := badger.BadgerBackend{Path: config.RelayDataPath}
 	db.Init()
-	relay.OnEventSaved = append(relay.OnEventSaved, EventReceiveHook(config.GitDataPath))
+	jobs, err := NewJobQueue(filepath.Join(config.RelayDataPath, "jobs"), getEnvInt("NGIT_JOB_WORKERS", 4))
+	if err != nil {
+		logger.Fatal("cannot open job queue", zap.Error(err))
+	}
+	HandleEventJobs(jobs, config.GitDataPath, config.Domain, archive, management, provisioning)
+	management.jobs = jobs
+
+	relay.OnEventSaved = append(relay.OnEventSaved, EventReceiveHook(jobs, archive))
 	relay.StoreEvent = append(relay.StoreEvent, db.SaveEvent)
 	relay.QueryEvents = append(relay.QueryEvents, db.QueryEvents)
 	relay.CountEvents = append(relay.CountEvents, db.CountEvents)
 	relay.DeleteEvent = append(relay.DeleteEvent, db.DeleteEvent)
 	relay.ReplaceEvent = append(relay.ReplaceEvent, db.ReplaceEvent)
-	relay.RejectEvent = append(relay.RejectEvent, getRelayPolicies(relay, config.Domain)...)
+	relay.RejectEvent = append(relay.RejectEvent, getRelayPolicies(relay, config.Domain, archive, management, provisioning)...)
+	relay.RejectFilter = append(relay.RejectFilter, readAuth.RejectFilter)
+	relay.RejectCountFilter = append(relay.RejectCountFilter, readAuth.RejectFilter)
 	relay.RejectConnection = append(relay.RejectConnection, ConnectionRateLimiterForOtherIPs(10, time.Minute, 2000))
 
-	initBlossom(relay, config)
+	uploaders, err := NewBlobUploaders(relay, config, OwnerPubkey)
+	if err != nil {
+		logger.Fatal("invalid blossom upload config", zap.Error(err))
+	}
+	relay.OnEventSaved = append(relay.OnEventSaved, uploaders.OnEventSaved)
+	relay.DeleteEvent = append(relay.DeleteEvent, uploaders.OnEventDeleted)
+	// repository bundles are stored as blobs owned by the relay key, outside of the capacity
+	// for uploads
+	var relaySecretKey string
+	uncountedBlobOwners := []string{}
+	if shared.RepoBundlesEnabled() {
+		if relaySecretKey, err = loadRelaySecretKey(config.RelayDataPath); err != nil {
+			logger.Fatal("cannot load relay key", zap.Error(err))
+		}
+		relayPubkey, err := nostr.GetPublicKey(relaySecretKey)
+		if err != nil {
+			logger.Fatal("invalid relay key", zap.Error(err))
+		}
+		uncountedBlobOwners = append(uncountedBlobOwners, relayPubkey)
+	}
+	blobs := initBlossom(relay, config, readAuth, uploaders, uncountedBlobOwners)
+
+	gitHTTP := NewGitHTTP(relay, config.GitDataPath, management, readAuth, blobs)
+	relay.OnEventSaved = append(relay.OnEventSaved, gitHTTP.OnEventSaved)
+
+	if socket_path := shared.QuerySocketPath(); socket_path != "" {
+		if err := StartQuerySocket(relay, socket_path); err != nil {
+			logger.Error("cannot start query socket, hooks will use NGIT_INTERNAL_RELAY_URL", zap.Error(err))
+		}
+	}
+
+	if shared.RepoBundlesEnabled() {
+		bundles, err := NewRepoBundles(relay, config.GitDataPath, config.Domain, blobs, relaySecretKey)
+		if err != nil {
+			logger.Fatal("invalid relay key", zap.Error(err))
+		}
+		logger.Info("repository bundles are listed in kind 1063 events", zap.String("relay_pubkey", bundles.pubkey))
+		bundles.Start(time.Minute)
+	} else {
+		go WithdrawRepoBundles(config.GitDataPath)
+	}
+
+	jobs.Start()
+	archive.Start(15 * time.Minute)
+	provisioning.Start(15 * time.Minute)
+	StartNostrRefSweeper(relay, config.GitDataPath, time.Minute)
+
+	if shared.GetEnvBool("NGIT_PROACTIVE_SYNC_NOSTR", true) {
+		StartProactiveSyncNostr(relay, config.GitDataPath, config.Domain, 15*time.Minute)
+	}
+	if shared.GetEnvBool("NGIT_PROACTIVE_SYNC_BLOSSOM", true) {
+		StartProactiveSyncBlossom(relay, config, blobs, 30*time.Minute)
+	}
 
 	// Start HTTP server on port 3334
 	logger.Info("Starting nostr relay HTTP server", zap.String("address", ":3334"))
-	if err := http.ListenAndServe(":3334", relay); err != nil {
+	if err := http.ListenAndServe(":3334", management.Handler(gitHTTP.Handler(blobs.Handler(relay)))); err != nil {
 		logger.Fatal("Failed to start HTTP server", zap.Error(err))
 	}
 }
@@ -112,6 +209,29 @@ func getEnv(key string) string {
 	return value
 }
 
+func getEnvDefault(key string, defaultValue string) string {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvList reads a comma separated list
+func getEnvList(key string, defaultValue []string) []string {
+	valueStr, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	list := []string{}
+	for _, item := range strings.Split(valueStr, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func getEnvInt(key string, defaultValue int) int {
 	valueStr, exists := os.LookupEnv(key)
 	if !exists {
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"ngit-relay/shared"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/nbd-wtf/go-nostr/nip86"
+	"go.uber.org/zap"
+)
+
+// methods not defined by NIP-86 that are handled by RelayManagement.Handler
+var customManagementMethods = []string{
+	"blockrepo", "unblockrepo", "listblockedrepos", "listjobs",
+	"listremovedrefs", "restoreremovedrefs", "confirmrefdeletion",
+}
+
+// methods khatru doesn't handle correctly, so RelayManagement.Handler handles them instead
+var overriddenManagementMethods = []string{"supportedmethods", "listbannedevents"}
+
+// RelayManagement implements the NIP-86 relay management API for the instance owner.
+// Decisions are persisted via shared.Management so they survive restarts and can be
+// enforced by the git hooks.
+type RelayManagement struct {
+	relay         *khatru.Relay
+	git_data_path string
+	ownerPubkey   string
+	jobs          *JobQueue // lists background jobs and queues syncs, when set
+	logger        *zap.Logger
+
+	mu    sync.RWMutex
+	state *shared.Management
+}
+
+func NewRelayManagement(relay *khatru.Relay, git_data_path string, ownerPubkey string) (*RelayManagement, error) {
+	state, err := shared.LoadManagement(git_data_path)
+	if err != nil {
+		return nil, err
+	}
+	m := &RelayManagement{
+		relay:         relay,
+		git_data_path: git_data_path,
+		ownerPubkey:   ownerPubkey,
+		logger:        shared.L().With(zap.String("type", "RelayManagement")),
+		state:         state,
+	}
+
+	// persisted settings override environment variables
+	if state.RelayName != "" {
+		relay.Info.Name = state.RelayName
+	}
+	if state.RelayDescription != "" {
+		relay.Info.Description = state.RelayDescription
+	}
+
+	relay.ManagementAPI.RejectAPICall = append(relay.ManagementAPI.RejectAPICall,
+		func(ctx context.Context, mp nip86.MethodParams) (reject bool, msg string) {
+			if khatru.GetAuthed(ctx) != m.ownerPubkey {
+				return true, "restricted: only the relay owner can use the management API"
+			}
+			return false, ""
+		},
+	)
+	relay.ManagementAPI.BanPubKey = m.BanPubKey
+	relay.ManagementAPI.ListBannedPubKeys = m.ListBannedPubKeys
+	relay.ManagementAPI.AllowPubKey = m.AllowPubKey
+	relay.ManagementAPI.ListAllowedPubKeys = m.ListAllowedPubKeys
+	relay.ManagementAPI.BanEvent = m.BanEvent
+	relay.ManagementAPI.AllowEvent = m.AllowEvent
+	relay.ManagementAPI.ListBannedEvents = m.ListBannedEvents
+	relay.ManagementAPI.ChangeRelayName = m.ChangeRelayName
+	relay.ManagementAPI.ChangeRelayDescription = m.ChangeRelayDescription
+
+	return m, nil
+}
+
+func (m *RelayManagement) BanPubKey(ctx context.Context, pubkey string, reason string) error {
+	return m.update(func(state *shared.Management) {
+		delete(state.AllowedPubkeys, pubkey)
+		state.BannedPubkeys[pubkey] = reason
+	})
+}
+
+func (m *RelayManagement) AllowPubKey(ctx context.Context, pubkey string, reason string) error {
+	return m.update(func(state *shared.Management) {
+		delete(state.BannedPubkeys, pubkey)
+		state.AllowedPubkeys[pubkey] = reason
+	})
+}
+
+func (m *RelayManagement) ListBannedPubKeys(ctx context.Context) ([]nip86.PubKeyReason, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return toPubKeyReasons(m.state.BannedPubkeys), nil
+}
+
+func (m *RelayManagement) ListAllowedPubKeys(ctx context.Context) ([]nip86.PubKeyReason, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return toPubKeyReasons(m.state.AllowedPubkeys), nil
+}
+
+// BanEvent rejects the event in future and deletes it from the store
+func (m *RelayManagement) BanEvent(ctx context.Context, id string, reason string) error {
+	if err := m.update(func(state *shared.Management) {
+		state.BannedEvents[id] = reason
+	}); err != nil {
+		return err
+	}
+	for _, query := range m.relay.QueryEvents {
+		ch, err := query(ctx, nostr.Filter{IDs: []string{id}})
+		if err != nil {
+			continue
+		}
+		for ev := range ch {
+			for _, del := range m.relay.DeleteEvent {
+				if err := del(ctx, ev); err != nil {
+					m.logger.Error("failed to delete banned event", zap.String("id", id), zap.Error(err))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (m *RelayManagement) AllowEvent(ctx context.Context, id string, reason string) error {
+	return m.update(func(state *shared.Management) {
+		delete(state.BannedEvents, id)
+	})
+}
+
+func (m *RelayManagement) ListBannedEvents(ctx context.Context) ([]nip86.IDReason, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := make([]nip86.IDReason, 0, len(m.state.BannedEvents))
+	for id, reason := range m.state.BannedEvents {
+		list = append(list, nip86.IDReason{ID: id, Reason: reason})
+	}
+	return list, nil
+}
+
+func (m *RelayManagement) ChangeRelayName(ctx context.Context, name string) error {
+	if err := m.update(func(state *shared.Management) {
+		state.RelayName = name
+	}); err != nil {
+		return err
+	}
+	m.relay.Info.Name = name
+	return nil
+}
+
+func (m *RelayManagement) ChangeRelayDescription(ctx context.Context, desc string) error {
+	if err := m.update(func(state *shared.Management) {
+		state.RelayDescription = desc
+	}); err != nil {
+		return err
+	}
+	m.relay.Info.Description = desc
+	return nil
+}
+
+// BlockRepo prevents a repository coordinate from being provisioned, pushed to or having
+// related events stored
+func (m *RelayManagement) BlockRepo(ctx context.Context, coordinate string, reason string) error {
+	parts := strings.SplitN(coordinate, ":", 3)
+	if len(parts) != 3 || parts[0] != strconv.Itoa(nostr.KindRepositoryAnnouncement) || !nostr.IsValidPublicKey(parts[1]) || !shared.IsValidIdentifier(parts[2]) {
+		return fmt.Errorf("invalid repository coordinate: %s", coordinate)
+	}
+	return m.update(func(state *shared.Management) {
+		state.BlockedRepos[coordinate] = reason
+	})
+}
+
+func (m *RelayManagement) UnblockRepo(ctx context.Context, coordinate string) error {
+	return m.update(func(state *shared.Management) {
+		delete(state.BlockedRepos, coordinate)
+	})
+}
+
+func (m *RelayManagement) ListBlockedRepos(ctx context.Context) ([]nip86.IDReason, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := make([]nip86.IDReason, 0, len(m.state.BlockedRepos))
+	for coordinate, reason := range m.state.BlockedRepos {
+		list = append(list, nip86.IDReason{ID: coordinate, Reason: reason})
+	}
+	return list, nil
+}
+
+// repoPathFromCoordinate returns the path of a hosted or archived repository
+func (m *RelayManagement) repoPathFromCoordinate(coordinate string) (string, error) {
+	parts := strings.SplitN(coordinate, ":", 3)
+	if len(parts) != 3 || parts[0] != strconv.Itoa(nostr.KindRepositoryAnnouncement) || !nostr.IsValidPublicKey(parts[1]) || !shared.IsValidIdentifier(parts[2]) {
+		return "", fmt.Errorf("invalid repository coordinate: %s", coordinate)
+	}
+	npub, err := nip19.EncodePublicKey(parts[1])
+	if err != nil {
+		return "", err
+	}
+	for _, git_data_path := range []string{m.git_data_path, filepath.Join(m.git_data_path, shared.ArchiveDirName)} {
+		repo_path := shared.RepoPath(git_data_path, npub, parts[2])
+		if _, err := os.Stat(repo_path); err == nil {
+			return repo_path, nil
+		}
+	}
+	return "", fmt.Errorf("repository %s is not hosted here", coordinate)
+}
+
+// ListRemovedRefs lists the refs a sync removed from a repository that can be restored
+func (m *RelayManagement) ListRemovedRefs(ctx context.Context, coordinate string) ([]shared.RemovedRef, error) {
+	repo_path, err := m.repoPathFromCoordinate(coordinate)
+	if err != nil {
+		return nil, err
+	}
+	return shared.ListRemovedRefs(repo_path)
+}
+
+// RestoreRemovedRefs restores refs a sync removed from a repository. See
+// shared.RestoreRemovedRefs for selector.
+func (m *RelayManagement) RestoreRemovedRefs(ctx context.Context, coordinate string, selector string) ([]shared.RemovedRef, error) {
+	repo_path, err := m.repoPathFromCoordinate(coordinate)
+	if err != nil {
+		return nil, err
+	}
+	restored, err := shared.RestoreRemovedRefs(repo_path, selector)
+	if err != nil {
+		return nil, err
+	}
+	m.logger.Info("restored removed refs", zap.String("repo_path", repo_path), zap.Int("refs", len(restored)))
+	return restored, nil
+}
+
+// ConfirmRefDeletion allows a sync to remove more refs from a repository than
+// NGIT_REF_DELETION_THRESHOLD, and queues a sync of the repository to apply it
+func (m *RelayManagement) ConfirmRefDeletion(ctx context.Context, coordinate string) (*shared.PendingRefDeletion, error) {
+	if m.jobs == nil {
+		return nil, fmt.Errorf("job queue not available")
+	}
+	repo_path, err := m.repoPathFromCoordinate(coordinate)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := shared.ConfirmPendingRefDeletion(repo_path)
+	if err != nil {
+		return nil, err
+	}
+	// the sync job syncs every copy of the repository by identifier, as after a state event
+	parts := strings.SplitN(coordinate, ":", 3)
+	event := &nostr.Event{Kind: nostr.KindRepositoryState, PubKey: parts[1], Tags: nostr.Tags{{"d", parts[2]}}}
+	if err := m.jobs.Enqueue(JobKindSync, JobKindSync+":"+parts[2], event, 0); err != nil {
+		return nil, fmt.Errorf("confirmed but cannot queue sync: %w", err)
+	}
+	m.logger.Info("confirmed ref deletion", zap.String("repo_path", repo_path), zap.Int("refs", len(pending.Refs)))
+	return pending, nil
+}
+
+// IsPubKeyAllowed reports whether the owner has allowed the pubkey via the management API
+func (m *RelayManagement) IsPubKeyAllowed(pubkey string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, allowed := m.state.AllowedPubkeys[pubkey]
+	return allowed
+}
+
+// IsRepoBlocked reports whether the repository has been blocked, or its author banned
+func (m *RelayManagement) IsRepoBlocked(pubkey string, identifier string) (bool, string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state.IsRepoBlocked(pubkey, identifier)
+}
+
+// RejectBanned is a relay policy enforcing banned pubkeys, events and blocked repositories
+func (m *RelayManagement) RejectBanned(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if event.PubKey == m.ownerPubkey {
+		return false, ""
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if _, banned := m.state.BannedPubkeys[event.PubKey]; banned {
+		return true, "blocked: pubkey banned by relay owner"
+	}
+	if _, banned := m.state.BannedEvents[event.ID]; banned {
+		return true, "blocked: event banned by relay owner"
+	}
+	if event.Kind == nostr.KindRepositoryAnnouncement || event.Kind == nostr.KindRepositoryState {
+		if _, blocked := m.state.BlockedRepos[shared.RepoCoordinate(event.PubKey, event.Tags.GetD())]; blocked {
+			return true, "blocked: repository blocked by relay owner"
+		}
+	}
+	for _, tag := range event.Tags {
+		if len(tag) > 1 && (tag[0] == "a" || tag[0] == "A") {
+			if _, blocked := m.state.BlockedRepos[tag[1]]; blocked {
+				return true, "blocked: repository blocked by relay owner"
+			}
+		}
+	}
+	return false, ""
+}
+
+// Handler handles NIP-86 methods that khatru can't: repository blocking, which isn't part of
+// NIP-86, supportedmethods and listbannedevents. Everything else is passed to next.
+func (m *RelayManagement) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/nostr+json+rpc" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		payload, err := io.ReadAll(r.Body)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(payload))
+
+		var req nip86.Request
+		if err := json.Unmarshal(payload, &req); err != nil ||
+			(!contains(customManagementMethods, req.Method) && !contains(overriddenManagementMethods, req.Method)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/nostr+json+rpc")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		var resp nip86.Response
+		if evt, err := ValidateNip98Auth(r, payload); err != nil {
+			resp.Error = err.Error()
+		} else if evt.PubKey != m.ownerPubkey {
+			resp.Error = "restricted: only the relay owner can use the management API"
+		} else if result, err := m.handleMethod(r.Context(), req); err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Result = result
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+func (m *RelayManagement) handleMethod(ctx context.Context, req nip86.Request) (any, error) {
+	param := func(i int) string {
+		if len(req.Params) > i {
+			if s, ok := req.Params[i].(string); ok {
+				return s
+			}
+		}
+		return ""
+	}
+	switch req.Method {
+	case "supportedmethods":
+		return append([]string{
+			"supportedmethods",
+			"banpubkey", "listbannedpubkeys", "allowpubkey", "listallowedpubkeys",
+			"banevent", "allowevent", "listbannedevents",
+			"changerelayname", "changerelaydescription",
+		}, customManagementMethods...), nil
+	case "listbannedevents":
+		return m.ListBannedEvents(ctx)
+	case "blockrepo":
+		if err := m.BlockRepo(ctx, param(0), param(1)); err != nil {
+			return nil, err
+		}
+		return true, nil
+	case "unblockrepo":
+		if err := m.UnblockRepo(ctx, param(0)); err != nil {
+			return nil, err
+		}
+		return true, nil
+	case "listblockedrepos":
+		return m.ListBlockedRepos(ctx)
+	case "listjobs":
+		if m.jobs == nil {
+			return []*Job{}, nil
+		}
+		return m.jobs.List()
+	case "listremovedrefs":
+		return m.ListRemovedRefs(ctx, param(0))
+	case "restoreremovedrefs":
+		return m.RestoreRemovedRefs(ctx, param(0), param(1))
+	case "confirmrefdeletion":
+		return m.ConfirmRefDeletion(ctx, param(0))
+	}
+	return nil, fmt.Errorf("method '%s' not known", req.Method)
+}
+
+// update applies a change to the management state and persists it
+func (m *RelayManagement) update(change func(state *shared.Management)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	change(m.state)
+	if err := m.state.Save(m.git_data_path); err != nil {
+		m.logger.Error("failed to save management state", zap.Error(err))
+		return fmt.Errorf("failed to save: %w", err)
+	}
+	return nil
+}
+
+func toPubKeyReasons(pubkeys map[string]string) []nip86.PubKeyReason {
+	list := make([]nip86.PubKeyReason, 0, len(pubkeys))
+	for pubkey, reason := range pubkeys {
+		list = append(list, nip86.PubKeyReason{PubKey: pubkey, Reason: reason})
+	}
+	return list
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ValidateNip98Auth checks a NIP-98 `Authorization: Nostr <base64 event>` header. The `u`
+// tag must match the request URL, or start with urlPrefix when provided, the `method` tag
+// must match and, when payload is not nil, the `payload` tag must be its sha256.
+func ValidateNip98Auth(r *http.Request, payload []byte, urlPrefix ...string) (*nostr.Event, error) {
+	auth := r.Header.Get("Authorization")
+	spl := strings.SplitN(auth, "Nostr ", 2)
+	if len(spl) != 2 || spl[0] != "" {
+		return nil, fmt.Errorf("missing auth")
+	}
+	evtj, err := base64.StdEncoding.DecodeString(spl[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 auth")
+	}
+	var evt nostr.Event
+	if err := json.Unmarshal(evtj, &evt); err != nil {
+		return nil, fmt.Errorf("invalid auth event json")
+	}
+	if evt.Kind != nostr.KindHTTPAuth {
+		return nil, fmt.Errorf("auth event must be kind %d", nostr.KindHTTPAuth)
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return nil, fmt.Errorf("invalid auth event")
+	}
+	if evt.CreatedAt < nostr.Now()-60 || evt.CreatedAt > nostr.Now()+60 {
+		return nil, fmt.Errorf("auth event is too old")
+	}
+
+	uTag := evt.Tags.Find("u")
+	if uTag == nil {
+		return nil, fmt.Errorf("auth event missing 'u' tag")
+	}
+	if len(urlPrefix) > 0 && urlPrefix[0] != "" {
+		if !strings.HasPrefix(strings.TrimRight(uTag[1], "/")+"/", strings.TrimRight(urlPrefix[0], "/")+"/") {
+			return nil, fmt.Errorf("invalid 'u' tag, got '%s', expected prefix '%s'", uTag[1], urlPrefix[0])
+		}
+	} else if nostr.NormalizeURL(uTag[1]) != nostr.NormalizeURL(RequestURL(r)) {
+		return nil, fmt.Errorf("invalid 'u' tag, got '%s', expected '%s'", uTag[1], RequestURL(r))
+	}
+	if methodTag := evt.Tags.Find("method"); methodTag != nil && !strings.EqualFold(methodTag[1], r.Method) {
+		return nil, fmt.Errorf("invalid 'method' tag, got '%s', expected '%s'", methodTag[1], r.Method)
+	}
+	if payload != nil {
+		payloadHash := sha256.Sum256(payload)
+		if evt.Tags.FindWithValue("payload", hex.EncodeToString(payloadHash[:])) == nil {
+			return nil, fmt.Errorf("invalid auth event payload hash")
+		}
+	}
+	return &evt, nil
+}
+
+// RequestBaseURL returns the scheme and host the client used to reach us. Headers set by the
+// nginx proxy are only taken into account on requests from a trusted proxy, as a client
+// connecting directly could set them to anything.
+func RequestBaseURL(r *http.Request) string {
+	if !fromTrustedProxy(r) {
+		return baseURL(r.Host, "")
+	}
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+	return baseURL(host, r.Header.Get("X-Forwarded-Proto"))
+}
+
+// fromTrustedProxy reports whether the request came from an address in NGIT_TRUSTED_PROXIES,
+// a comma separated list of IPs and CIDRs which defaults to loopback, where nginx proxies from
+func fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range getEnvList("NGIT_TRUSTED_PROXIES", []string{"127.0.0.0/8", "::1/128"}) {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(proxy)) {
+			return true
+		}
+	}
+	return false
+}
+
+// DomainBaseURL returns the base URL of this instance for urls published outside of a
+// request, eg. in events
+func DomainBaseURL(domain string) string {
+	return baseURL(domain, "")
+}
+
+// baseURL guesses proto from host when it isn't known
+func baseURL(host string, proto string) string {
+	if proto == "" {
+		if host == "localhost" {
+			proto = "http"
+		} else if strings.Contains(host, ":") {
+			// has a port number
+			proto = "http"
+		} else if _, err := strconv.Atoi(strings.ReplaceAll(host, ".", "")); err == nil {
+			// it's a naked IP
+			proto = "http"
+		} else {
+			proto = "https"
+		}
+	}
+	return proto + "://" + host
+}
+
+// RequestURL returns the full URL the client used to reach us, excluding the query string
+func RequestURL(r *http.Request) string {
+	return RequestBaseURL(r) + r.URL.Path
+}
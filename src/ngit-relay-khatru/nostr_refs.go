@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"ngit-relay/shared"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/zap"
+)
+
+// StartNostrRefSweeper periodically removes refs/nostr/ refs that were pushed before their
+// PR, PR update or patch event arrived, once the event turns out not to match or hasn't
+// arrived within the grace window
+func StartNostrRefSweeper(relay *khatru.Relay, git_data_path string, interval time.Duration) {
+	logger := shared.L().With(zap.String("type", "NostrRefSweeper"))
+	go func() {
+		for {
+			time.Sleep(interval)
+			repo_paths, err := shared.ListRepoPaths(git_data_path)
+			if err != nil {
+				logger.Warn("cannot list repositories", zap.Error(err))
+				continue
+			}
+			for _, repo_path := range repo_paths {
+				if _, err := os.Stat(filepath.Join(repo_path, shared.PendingNostrRefsFileName)); err != nil {
+					continue
+				}
+				deleted, err := sweepPendingNostrRefs(context.Background(), relay, repo_path)
+				if err != nil {
+					logger.Warn("cannot sweep pending refs/nostr/ refs", zap.String("repo_path", repo_path), zap.Error(err))
+				}
+				if len(deleted) > 0 {
+					logger.Info("removed refs/nostr/ refs without a matching event", zap.String("repo_path", repo_path), zap.Strings("refs", deleted))
+				}
+			}
+		}
+	}()
+}
+
+func sweepPendingNostrRefs(ctx context.Context, relay *khatru.Relay, repo_path string) ([]string, error) {
+	pubkey, _, identifier, err := shared.GetPubKeyAndIdentifierFromPath(repo_path)
+	if err != nil {
+		return nil, err
+	}
+	coordinates := repoCoordinates(queryAnnouncementAndStateEvents(ctx, relay, identifier), pubkey, identifier)
+	return shared.SweepPendingNostrRefs(repo_path, coordinates, func(id string) *nostr.Event {
+		if events := queryEventsByID(ctx, relay, []string{id}); len(events) > 0 {
+			return &events[0]
+		}
+		return nil
+	}, shared.NostrRefGraceWindow())
+}
+
+// repoCoordinates returns the coordinates PRs and patches for a hosted repository may tag:
+// one for each maintainer, or just the repository's own when it has no announcement
+func repoCoordinates(events []nostr.Event, pubkey string, identifier string) []string {
+	maintainers := shared.GetMaintainers(events, pubkey, identifier)
+	if len(maintainers) == 0 {
+		return []string{shared.RepoCoordinate(pubkey, identifier)}
+	}
+	return shared.GetRepoCoordinates(maintainers, identifier)
+}
+
+func queryEventsByID(ctx context.Context, relay *khatru.Relay, ids []string) []nostr.Event {
+	events := []nostr.Event{}
+	if len(ids) == 0 {
+		return events
+	}
+	for _, query := range relay.QueryEvents {
+		ch, err := query(ctx, nostr.Filter{IDs: ids})
+		if err != nil {
+			continue
+		}
+		for ev := range ch {
+			events = append(events, *ev)
+		}
+	}
+	return events
+}
@@ -12,54 +12,79 @@ import (
 	"github.com/nbd-wtf/go-nostr"
 )
 
-func getRelayPolicies(relay *khatru.Relay, domain string) []func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+func getRelayPolicies(relay *khatru.Relay, domain string, archive *Archive, management *RelayManagement, provisioning *Provisioning) []func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
 	return []func(ctx context.Context, event *nostr.Event) (reject bool, msg string){
 		policies.PreventLargeTags(120),
 		policies.PreventTimestampsInTheFuture(time.Minute * 30),
 		policies.EventIPRateLimiter(3, time.Minute*3, 15),
-		RelatesToExistingRepoOrAllowedNewRepo(relay, domain),
+		management.RejectBanned,
+		RelatesToExistingRepoOrAllowedNewRepo(relay, domain, archive, provisioning),
 	}
 }
 
-func RelatesToExistingRepoOrAllowedNewRepo(relay *khatru.Relay, domain string) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+func RelatesToExistingRepoOrAllowedNewRepo(relay *khatru.Relay, domain string, archive *Archive, provisioning *Provisioning) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
 	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
 		// allow all state announcements
 		if event.Kind == nostr.KindRepositoryState {
 			return false, ""
 		}
+		// allow the owner to curate the archive
+		if archive.IsArchiveListEvent(event) {
+			return false, ""
+		}
+		// used to decide who can provision repositories in owner-follows mode
+		if provisioning.IsOwnerFollowList(event) {
+			return false, ""
+		}
 		// Only accept announcement events when the ngit-relay instance is listed correctly
+		// and the provisioning mode allows it
 		if event.Kind == nostr.KindRepositoryAnnouncement {
-			listed_in_clones := false
-			for _, tag := range event.Tags {
-				if len(tag) > 1 && tag[0] == "clone" {
-					for _, val := range tag[1:] {
-						if strings.Contains(val, "://"+domain) {
-							listed_in_clones = true
-							break
-						}
-					}
+			msg := "repository announcement doesn't list ngit-relay in tags: clones and relays"
+			if ListsInstance(event, domain) {
+				allowed, reason := provisioning.Allows(ctx, event)
+				if allowed {
+					return false, ""
 				}
+				msg = reason
 			}
-			listed_in_relays := false
-			for _, tag := range event.Tags {
-				if len(tag) > 1 && tag[0] == "relays" {
-					for _, val := range tag[1:] {
-						if strings.Contains(val, "://"+domain) {
-							listed_in_relays = true
-							break
-						}
-					}
-				}
-			}
-			if listed_in_clones && listed_in_relays {
+			// or the owner has chosen to archive the repository
+			if archive.Includes(event.PubKey, event.Tags.GetD()) {
 				return false, ""
 			}
-			return true, "repository announcement doesn't list ngit-relay in tags: clones and relays"
+			return true, msg
 		}
 		return RelatesToExistingEvent(relay, domain)(ctx, event)
 	}
 }
 
+// ListsInstance reports whether a repository announcement lists this ngit-relay instance
+// in both its clone and relays tags
+func ListsInstance(event *nostr.Event, domain string) bool {
+	listed_in_clones := false
+	for _, tag := range event.Tags {
+		if len(tag) > 1 && tag[0] == "clone" {
+			for _, val := range tag[1:] {
+				if strings.Contains(val, "://"+domain) {
+					listed_in_clones = true
+					break
+				}
+			}
+		}
+	}
+	listed_in_relays := false
+	for _, tag := range event.Tags {
+		if len(tag) > 1 && tag[0] == "relays" {
+			for _, val := range tag[1:] {
+				if strings.Contains(val, "://"+domain) {
+					listed_in_relays = true
+					break
+				}
+			}
+		}
+	}
+	return listed_in_clones && listed_in_relays
+}
+
 func RelatesToExistingEvent(relay *khatru.Relay, domain string) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
 	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
 		// accept event that refers to a stored event, or is referenced by a stored event
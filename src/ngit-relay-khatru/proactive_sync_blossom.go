@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"ngit-relay/shared"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/zap"
+)
+
+// blossomURLPattern matches BUD-01 blob urls, ie. ending in the blob's sha256 and an
+// optional extension
+var blossomURLPattern = regexp.MustCompile(`https?://[^\s"'<>()\[\]]+/([0-9a-f]{64})(?:\.[A-Za-z0-9]+)?`)
+
+// how long to wait before trying again to fetch a blob that couldn't be found
+const proactiveSyncBlossomRetry = 24 * time.Hour
+
+// ProactiveSyncBlossom mirrors the blobs referenced by the discussion of hosted repositories,
+// eg. screenshots and attachments in issues, patches, PRs and comments, so they outlive the
+// media hosts they were uploaded to. Blobs are fetched from the referenced urls and the
+// servers in the author's BUD-03 server list, verified against their sha256 and stored as
+// owned by the author, subject to the same limits as the author's own uploads.
+type ProactiveSyncBlossom struct {
+	relay         *khatru.Relay
+	git_data_path string
+	domain        string
+	blobs         *BlobStorage
+	lookupRelays  []string
+	pool          *nostr.SimplePool
+	client        *http.Client
+	logger        *zap.Logger
+
+	mu     sync.Mutex
+	failed map[string]time.Time // sha256 -> when to try again
+}
+
+// blobRef is a blob referenced by an event and where it was seen
+type blobRef struct {
+	sha256   string
+	urls     []string
+	mimetype string
+}
+
+func StartProactiveSyncBlossom(relay *khatru.Relay, config Config, blobs *BlobStorage, interval time.Duration) *ProactiveSyncBlossom {
+	ps := &ProactiveSyncBlossom{
+		relay:         relay,
+		git_data_path: config.GitDataPath,
+		domain:        config.Domain,
+		blobs:         blobs,
+		lookupRelays:  config.ArchiveLookupRelays,
+		pool:          nostr.NewSimplePool(context.Background(), nostr.WithPenaltyBox()),
+		client:        blobs.client,
+		logger:        shared.L().With(zap.String("type", "ProactiveSyncBlossom")),
+		failed:        make(map[string]time.Time),
+	}
+
+	go func() {
+		// wait for the relay to start listening
+		time.Sleep(30 * time.Second)
+		for {
+			ps.Sync(context.Background())
+			time.Sleep(interval)
+		}
+	}()
+
+	return ps
+}
+
+// Sync fetches the missing blobs referenced by stored events of each hosted repository
+func (ps *ProactiveSyncBlossom) Sync(ctx context.Context) {
+	repoPaths, err := shared.ListRepoPaths(ps.git_data_path)
+	if err != nil {
+		ps.logger.Error("failed to list repositories", zap.Error(err))
+		return
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	serverLists := make(map[string][]string) // author -> BUD-03 servers
+	mirrored := 0
+	for _, repoPath := range repoPaths {
+		pubkey, _, identifier, err := shared.GetPubKeyAndIdentifierFromPath(repoPath)
+		if err != nil {
+			continue
+		}
+		events, err := shared.FetchAnnouncementAndStateEventsFromRelay(ctx, identifier)
+		if err != nil {
+			ps.logger.Error("FetchAnnouncementAndStateEventsFromRelay failed", zap.String("repo_path", repoPath), zap.Error(err))
+			continue
+		}
+		maintainers := shared.GetMaintainers(events, pubkey, identifier)
+		if len(maintainers) == 0 {
+			continue
+		}
+		relays := append(shared.GetRelaysFromMaintainers(events, maintainers), ps.lookupRelays...)
+
+		for _, ev := range ps.getDiscussion(ctx, shared.GetRepoCoordinates(maintainers, identifier)) {
+			for _, ref := range extractBlobRefs(ev) {
+				if ps.blobs.HasBlob(ref.sha256) || time.Now().Before(ps.failed[ref.sha256]) {
+					continue
+				}
+				servers, exists := serverLists[ev.PubKey]
+				if !exists {
+					servers = ps.getServerList(ctx, ev.PubKey, relays)
+					serverLists[ev.PubKey] = servers
+				}
+				if err := ps.mirror(ctx, ev.PubKey, ref, servers); err != nil {
+					ps.logger.Debug("cannot mirror blob", zap.String("sha256", ref.sha256), zap.String("event", ev.ID), zap.Error(err))
+					ps.failed[ref.sha256] = time.Now().Add(proactiveSyncBlossomRetry)
+					continue
+				}
+				delete(ps.failed, ref.sha256)
+				mirrored++
+			}
+		}
+	}
+	ps.logger.Debug("finished proactive sync blossom", zap.Int("mirrored", mirrored))
+}
+
+// getDiscussion returns the stored events tagging the repository coordinates and the replies
+// to its patches, PRs and issues
+func (ps *ProactiveSyncBlossom) getDiscussion(ctx context.Context, coordinates []string) []*nostr.Event {
+	events := []*nostr.Event{}
+	seen := make(map[string]bool)
+	query := func(filter nostr.Filter) {
+		for _, queryFn := range ps.relay.QueryEvents {
+			ch, err := queryFn(ctx, filter)
+			if err != nil {
+				continue
+			}
+			for ev := range ch {
+				if !seen[ev.ID] {
+					seen[ev.ID] = true
+					events = append(events, ev)
+				}
+			}
+		}
+	}
+	query(nostr.Filter{Kinds: shared.RepoDiscussionKinds, Tags: nostr.TagMap{"a": coordinates}})
+
+	rootIds := []string{}
+	for _, ev := range events {
+		if slices.Contains([]int{nostr.KindPatch, shared.KindPullRequest, nostr.KindIssue}, ev.Kind) {
+			rootIds = append(rootIds, ev.ID)
+		}
+	}
+	for ids := range slices.Chunk(rootIds, 200) {
+		query(nostr.Filter{Kinds: shared.RepoReplyKinds, Tags: nostr.TagMap{"e": ids}})
+		query(nostr.Filter{Kinds: shared.RepoReplyKinds, Tags: nostr.TagMap{"E": ids}})
+	}
+	return events
+}
+
+// getServerList returns the servers in pubkey's BUD-03 server list, from the relay or else
+// the relays of the repository and the lookup relays
+func (ps *ProactiveSyncBlossom) getServerList(ctx context.Context, pubkey string, relays []string) []string {
+	filter := nostr.Filter{Kinds: []int{nostr.KindUserServerList}, Authors: []string{pubkey}, Limit: 1}
+	var latest *nostr.Event
+	for _, queryFn := range ps.relay.QueryEvents {
+		ch, err := queryFn(ctx, filter)
+		if err != nil {
+			continue
+		}
+		for ev := range ch {
+			if latest == nil || ev.CreatedAt > latest.CreatedAt {
+				latest = ev
+			}
+		}
+	}
+	if latest == nil && len(relays) > 0 {
+		fetchCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		if ev := ps.pool.QuerySingle(fetchCtx, relays, filter); ev != nil {
+			latest = ev.Event
+		}
+		cancel()
+	}
+	servers := []string{}
+	if latest == nil {
+		return servers
+	}
+	for _, tag := range latest.Tags {
+		if len(tag) > 1 && tag[0] == "server" {
+			if u, err := url.Parse(tag[1]); err == nil && (u.Scheme == "https" || u.Scheme == "http") {
+				servers = append(servers, strings.TrimSuffix(tag[1], "/"))
+			}
+		}
+	}
+	return servers
+}
+
+// mirror fetches a blob from the urls it was referenced at, then from the author's servers,
+// and stores the first copy matching its sha256
+func (ps *ProactiveSyncBlossom) mirror(ctx context.Context, author string, ref blobRef, servers []string) error {
+	candidates := []string{}
+	for _, u := range ref.urls {
+		// we don't have it so there's no point asking ourselves
+		if ps.domain != "" && strings.Contains(u, "://"+ps.domain) {
+			continue
+		}
+		candidates = append(candidates, u)
+	}
+	for _, server := range servers {
+		if ps.domain != "" && strings.Contains(server, "://"+ps.domain) {
+			continue
+		}
+		candidates = append(candidates, server+"/"+ref.sha256)
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("no servers to fetch from")
+	}
+
+	var lastErr error
+	for _, u := range candidates {
+		if err := ps.fetch(ctx, author, ref, u); err != nil {
+			lastErr = fmt.Errorf("%s: %w", u, err)
+			continue
+		}
+		ps.logger.Info("mirrored blob", zap.String("sha256", ref.sha256), zap.String("url", u), zap.String("author", author))
+		return nil
+	}
+	return lastErr
+}
+
+// fetch downloads the blob at u and stores it as owned by author. Like serveMirror it streams
+// the blob to disk through storeBlob rather than the blossom StoreBlob hooks, which hold the
+// whole blob in memory and expect an upload authorized by the author, and applies the upload
+// rules before downloading, or once downloaded when the size isn't known in advance.
+func (ps *ProactiveSyncBlossom) fetch(ctx context.Context, author string, ref blobRef, u string) error {
+	fetchCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(fetchCtx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := ps.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	// the mirrored blob counts against the author's quota so apply the limits of their uploads
+	auth := &nostr.Event{PubKey: author}
+	size := resp.ContentLength
+	if size >= 0 {
+		if rejected, reason, _ := ps.blobs.RejectUpload(ctx, auth, int(size), ""); rejected {
+			return fmt.Errorf("rejected: %s", reason)
+		}
+	}
+	var body io.Reader = resp.Body
+	max_size := int64(ps.blobs.config.BlossomMaxFileSizeMb) * 1024 * 1024
+	if max_size > 0 {
+		body = io.LimitReader(resp.Body, max_size+1)
+	}
+
+	mimetype := ref.mimetype
+	if mimetype == "" {
+		mimetype = resp.Header.Get("Content-Type")
+	}
+	_, err = ps.blobs.storeBlob(ctx, body, size, author, mimetype, func(sha256 string, written int64) error {
+		if max_size > 0 && written > max_size {
+			return fmt.Errorf("rejected: more than %d bytes", max_size)
+		}
+		if sha256 != ref.sha256 {
+			return fmt.Errorf("expected sha256 %s, got %s", ref.sha256, sha256)
+		}
+		if size < 0 {
+			if rejected, reason, _ := ps.blobs.RejectUpload(ctx, auth, int(written), ""); rejected {
+				return fmt.Errorf("rejected: %s", reason)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// extractBlobRefs finds the blobs referenced by an event in imeta tags and blossom urls in
+// its content
+func extractBlobRefs(ev *nostr.Event) []blobRef {
+	refs := []blobRef{}
+	add := func(sha256 string, u string, mimetype string) {
+		for i := range refs {
+			if refs[i].sha256 == sha256 {
+				if u != "" && !slices.Contains(refs[i].urls, u) {
+					refs[i].urls = append(refs[i].urls, u)
+				}
+				if refs[i].mimetype == "" {
+					refs[i].mimetype = mimetype
+				}
+				return
+			}
+		}
+		ref := blobRef{sha256: sha256, mimetype: mimetype}
+		if u != "" {
+			ref.urls = append(ref.urls, u)
+		}
+		refs = append(refs, ref)
+	}
+
+	for _, tag := range ev.Tags {
+		if len(tag) < 2 || tag[0] != "imeta" {
+			continue
+		}
+		var u, x, m string
+		for _, entry := range tag[1:] {
+			key, value, _ := strings.Cut(entry, " ")
+			switch key {
+			case "url":
+				u = value
+			case "x":
+				x = strings.ToLower(value)
+			case "m":
+				m = value
+			}
+		}
+		if !isBlobHash(x) {
+			if match := blossomURLPattern.FindStringSubmatch(u); match != nil && match[0] == u {
+				x = match[1]
+			}
+		}
+		if isBlobHash(x) {
+			add(x, u, m)
+		}
+	}
+	for _, match := range blossomURLPattern.FindAllStringSubmatch(ev.Content, -1) {
+		add(match[1], match[0], "")
+	}
+	return refs
+}
+
+// newPublicHTTPClient returns a client that refuses to connect to loopback, private and
+// link-local addresses, for fetching urls found in events
+func newPublicHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+				return fmt.Errorf("refusing to connect to %s", host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
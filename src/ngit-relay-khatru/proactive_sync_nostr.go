@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"ngit-relay/shared"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/zap"
+)
+
+// ProactiveSyncNostr imports NIP-34 events related to hosted repositories from the relays
+// listed in their announcements. It backfills history once per repository / root event and
+// then follows each relay with a live subscription.
+type ProactiveSyncNostr struct {
+	relay         *khatru.Relay
+	git_data_path string
+	domain        string
+	pool          *nostr.SimplePool
+	logger        *zap.Logger
+
+	mu         sync.Mutex
+	backfilled map[string]bool                  // relay url + " " + coordinate or root event id
+	live       map[string]proactiveSyncNostrSub // relay url -> live subscription
+}
+
+type proactiveSyncNostrSub struct {
+	key    string
+	cancel context.CancelFunc
+}
+
+// desired coordinates and root event ids to follow on a relay
+type proactiveSyncNostrTarget struct {
+	coordinates []string
+	rootIds     []string
+}
+
+func StartProactiveSyncNostr(relay *khatru.Relay, git_data_path string, domain string, interval time.Duration) *ProactiveSyncNostr {
+	ps := &ProactiveSyncNostr{
+		relay:         relay,
+		git_data_path: git_data_path,
+		domain:        domain,
+		pool:          nostr.NewSimplePool(context.Background(), nostr.WithPenaltyBox()),
+		logger:        shared.L().With(zap.String("type", "ProactiveSyncNostr")),
+		backfilled:    make(map[string]bool),
+		live:          make(map[string]proactiveSyncNostrSub),
+	}
+
+	go func() {
+		// wait for the relay to start listening
+		time.Sleep(20 * time.Second)
+		for {
+			ps.Sync(context.Background())
+			time.Sleep(interval)
+		}
+	}()
+
+	return ps
+}
+
+// Sync refreshes the list of relays and repositories to follow, backfills anything new and
+// restarts live subscriptions that have changed
+func (ps *ProactiveSyncNostr) Sync(ctx context.Context) {
+	targets := ps.getTargets(ctx)
+	ps.logger.Debug("starting proactive sync nostr", zap.Int("relays", len(targets)))
+
+	// backfill coordinates and root events we haven't seen on each relay before. ps.mu isn't
+	// held while fetching as it would block the live subscriptions.
+	for url, target := range targets {
+		ps.mu.Lock()
+		newCoordinates := []string{}
+		for _, c := range target.coordinates {
+			if !ps.backfilled[url+" "+c] {
+				newCoordinates = append(newCoordinates, c)
+			}
+		}
+		newRootIds := []string{}
+		for _, id := range target.rootIds {
+			if !ps.backfilled[url+" "+id] {
+				newRootIds = append(newRootIds, id)
+			}
+		}
+		ps.mu.Unlock()
+		if len(newCoordinates) == 0 && len(newRootIds) == 0 {
+			continue
+		}
+
+		imported, complete := 0, true
+		for _, filter := range proactiveSyncNostrFilters(newCoordinates, newRootIds, nil) {
+			n, eose := ps.backfill(ctx, url, filter)
+			imported += n
+			complete = complete && eose
+		}
+		// the live subscription only overlaps a few minutes, so anything the relay didn't
+		// confirm it sent in full is backfilled again next time
+		if complete {
+			ps.mu.Lock()
+			for _, c := range newCoordinates {
+				ps.backfilled[url+" "+c] = true
+			}
+			for _, id := range newRootIds {
+				ps.backfilled[url+" "+id] = true
+			}
+			ps.mu.Unlock()
+		}
+		ps.logger.Debug("backfilled repo events", zap.String("relay", url), zap.Int("imported", imported), zap.Bool("complete", complete))
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for url, target := range targets {
+		// (re)start live subscription if what we need to follow has changed
+		key := strings.Join(target.coordinates, ",") + "|" + strings.Join(target.rootIds, ",")
+		if sub, exists := ps.live[url]; exists {
+			if sub.key == key {
+				continue
+			}
+			sub.cancel()
+		}
+		subCtx, cancel := context.WithCancel(context.Background())
+		ps.live[url] = proactiveSyncNostrSub{key: key, cancel: cancel}
+		// overlap with the previous subscription so we don't miss anything while switching
+		since := nostr.Timestamp(time.Now().Add(-5 * time.Minute).Unix())
+		for _, filter := range proactiveSyncNostrFilters(target.coordinates, target.rootIds, &since) {
+			go func(filter nostr.Filter) {
+				for ev := range ps.pool.SubscribeMany(subCtx, []string{url}, filter) {
+					ps.importEvent(subCtx, ev.Event)
+				}
+				// the relay closed the subscription, so restart it during the next sync
+				if subCtx.Err() == nil {
+					ps.mu.Lock()
+					if sub, exists := ps.live[url]; exists && sub.key == key {
+						sub.cancel()
+						delete(ps.live, url)
+					}
+					ps.mu.Unlock()
+				}
+			}(filter)
+		}
+	}
+
+	// stop following relays that are no longer listed by any hosted repository
+	for url, sub := range ps.live {
+		if _, exists := targets[url]; !exists {
+			sub.cancel()
+			delete(ps.live, url)
+		}
+	}
+}
+
+// backfill imports the stored events matching filter from a relay. It returns the number of
+// events newly stored and whether the relay sent them all, ending with EOSE.
+func (ps *ProactiveSyncNostr) backfill(ctx context.Context, url string, filter nostr.Filter) (int, bool) {
+	relay, err := ps.pool.EnsureRelay(url)
+	if err != nil {
+		ps.logger.Debug("cannot connect to relay to backfill", zap.String("relay", url), zap.Error(err))
+		return 0, false
+	}
+	fetchCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	sub, err := relay.Subscribe(fetchCtx, nostr.Filters{filter})
+	if err != nil {
+		ps.logger.Debug("cannot subscribe to relay to backfill", zap.String("relay", url), zap.Error(err))
+		return 0, false
+	}
+	defer sub.Unsub()
+
+	imported := 0
+	for {
+		select {
+		case ev, ok := <-sub.Events:
+			if !ok {
+				return imported, false
+			}
+			if ps.importEvent(fetchCtx, ev) {
+				imported++
+			}
+		case <-sub.EndOfStoredEvents:
+			return imported, true
+		case <-sub.ClosedReason:
+			return imported, false
+		case <-fetchCtx.Done():
+			return imported, false
+		}
+	}
+}
+
+// getTargets finds, for each relay listed by hosted repositories, the repository coordinates
+// and locally stored root events to follow
+func (ps *ProactiveSyncNostr) getTargets(ctx context.Context) map[string]*proactiveSyncNostrTarget {
+	targets := make(map[string]*proactiveSyncNostrTarget)
+
+	repoPaths, err := shared.ListRepoPaths(ps.git_data_path)
+	if err != nil {
+		ps.logger.Error("failed to list repositories", zap.Error(err))
+		return targets
+	}
+
+	for _, repoPath := range repoPaths {
+		pubkey, _, identifier, err := shared.GetPubKeyAndIdentifierFromPath(repoPath)
+		if err != nil {
+			continue
+		}
+		events, err := shared.FetchAnnouncementAndStateEventsFromRelay(ctx, identifier)
+		if err != nil {
+			ps.logger.Error("FetchAnnouncementAndStateEventsFromRelay failed", zap.String("repo_path", repoPath), zap.Error(err))
+			continue
+		}
+		maintainers := shared.GetMaintainers(events, pubkey, identifier)
+		if len(maintainers) == 0 {
+			continue
+		}
+		coordinates := shared.GetRepoCoordinates(maintainers, identifier)
+		rootIds := ps.getStoredRootIds(ctx, coordinates)
+
+		for _, url := range shared.GetRelaysFromMaintainers(events, maintainers) {
+			// don't subscribe to ourselves
+			if ps.domain != "" && strings.Contains(url, "://"+ps.domain) {
+				continue
+			}
+			target, exists := targets[url]
+			if !exists {
+				target = &proactiveSyncNostrTarget{}
+				targets[url] = target
+			}
+			for _, c := range coordinates {
+				if !slices.Contains(target.coordinates, c) {
+					target.coordinates = append(target.coordinates, c)
+				}
+			}
+			for _, id := range rootIds {
+				if !slices.Contains(target.rootIds, id) {
+					target.rootIds = append(target.rootIds, id)
+				}
+			}
+		}
+	}
+
+	for _, target := range targets {
+		slices.Sort(target.coordinates)
+		slices.Sort(target.rootIds)
+	}
+	return targets
+}
+
+// getStoredRootIds returns the ids of stored patches, PRs and issues for the repository
+func (ps *ProactiveSyncNostr) getStoredRootIds(ctx context.Context, coordinates []string) []string {
+	ids := []string{}
+	filter := nostr.Filter{
+		Kinds: []int{nostr.KindPatch, shared.KindPullRequest, nostr.KindIssue},
+		Tags:  nostr.TagMap{"a": coordinates},
+	}
+	for _, query := range ps.relay.QueryEvents {
+		ch, err := query(ctx, filter)
+		if err != nil {
+			continue
+		}
+		for ev := range ch {
+			if !slices.Contains(ids, ev.ID) {
+				ids = append(ids, ev.ID)
+			}
+		}
+	}
+	return ids
+}
+
+// importEvent adds an event via the relay's normal pipeline so it is subject to the same
+// policies as events published directly to us. returns true if the event was newly stored.
+func (ps *ProactiveSyncNostr) importEvent(ctx context.Context, ev *nostr.Event) bool {
+	if ev == nil {
+		return false
+	}
+	if ok, _ := ev.CheckSignature(); !ok {
+		return false
+	}
+	skipBroadcast, err := ps.relay.AddEvent(ctx, ev)
+	if err != nil {
+		ps.logger.Debug("rejected event from proactive sync nostr", zap.String("id", ev.ID), zap.Error(err))
+		return false
+	}
+	if skipBroadcast {
+		// duplicate
+		return false
+	}
+	ps.relay.BroadcastEvent(ev)
+	return true
+}
+
+// proactiveSyncNostrFilters returns filters for events that tag the coordinates and replies
+// to the root events
+func proactiveSyncNostrFilters(coordinates []string, rootIds []string, since *nostr.Timestamp) []nostr.Filter {
+	filters := []nostr.Filter{}
+	if len(coordinates) > 0 {
+		filters = append(filters, nostr.Filter{
+			Kinds: shared.RepoDiscussionKinds,
+			Tags:  nostr.TagMap{"a": coordinates},
+			Since: since,
+		})
+	}
+	// relays often limit the number of values in a filter
+	for ids := range slices.Chunk(rootIds, 200) {
+		filters = append(filters,
+			nostr.Filter{
+				Kinds: shared.RepoReplyKinds,
+				Tags:  nostr.TagMap{"e": ids},
+				Since: since,
+			},
+			nostr.Filter{
+				Kinds: shared.RepoReplyKinds,
+				Tags:  nostr.TagMap{"E": ids},
+				Since: since,
+			},
+		)
+	}
+	return filters
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"ngit-relay/shared"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/nbd-wtf/go-nostr/nip34"
+	"go.uber.org/zap"
+)
+
+// provisioning modes, set with NGIT_PROVISIONING_MODE
+const (
+	ProvisioningModeOpen         = "open"          // any announcement listing this instance
+	ProvisioningModeNpubs        = "npubs"         // whitelisted npubs and pubkeys allowed via NIP-86
+	ProvisioningModeRepos        = "repos"         // whitelisted repository coordinates
+	ProvisioningModeOwnerFollows = "owner-follows" // pubkeys in the owner's kind 3 contact list
+)
+
+var ProvisioningModes = []string{ProvisioningModeOpen, ProvisioningModeNpubs, ProvisioningModeRepos, ProvisioningModeOwnerFollows}
+
+// Provisioning decides whether an announcement that lists this instance may provision a new
+// repository. Repositories that already exist are always allowed so they keep working when
+// the mode gets stricter.
+type Provisioning struct {
+	relay         *khatru.Relay
+	git_data_path string
+	mode          string
+	ownerPubkey   string
+	management    *RelayManagement
+	lookupRelays  []string
+	pool          *nostr.SimplePool
+	logger        *zap.Logger
+
+	pubkeys     map[string]bool
+	coordinates map[string]bool
+}
+
+func NewProvisioning(relay *khatru.Relay, config Config, ownerPubkey string, management *RelayManagement) (*Provisioning, error) {
+	if !slices.Contains(ProvisioningModes, config.ProvisioningMode) {
+		return nil, fmt.Errorf("unknown provisioning mode '%s', expected one of %v", config.ProvisioningMode, ProvisioningModes)
+	}
+	p := &Provisioning{
+		relay:         relay,
+		git_data_path: config.GitDataPath,
+		mode:          config.ProvisioningMode,
+		ownerPubkey:   ownerPubkey,
+		management:    management,
+		lookupRelays:  config.ArchiveLookupRelays,
+		pool:          nostr.NewSimplePool(context.Background(), nostr.WithPenaltyBox()),
+		logger:        shared.L().With(zap.String("type", "Provisioning")),
+		pubkeys:       make(map[string]bool),
+		coordinates:   make(map[string]bool),
+	}
+	for _, item := range config.ProvisioningWhitelist {
+		pointer, err := ParseRepoPointer(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid provisioning whitelist entry: %w", err)
+		}
+		if pointer.Identifier == "" {
+			p.pubkeys[pointer.PubKey] = true
+		} else {
+			p.coordinates[shared.RepoCoordinate(pointer.PubKey, pointer.Identifier)] = true
+		}
+	}
+	return p, nil
+}
+
+// Start keeps the owner's contact list up to date in owner-follows mode, as it is usually
+// published to other relays
+func (p *Provisioning) Start(interval time.Duration) {
+	if p.mode != ProvisioningModeOwnerFollows {
+		return
+	}
+	go func() {
+		// wait for the relay to start listening
+		time.Sleep(20 * time.Second)
+		for {
+			p.fetchOwnerFollowList(context.Background())
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// IsOwnerFollowList reports whether event is the owner's contact list, which is stored in
+// owner-follows mode
+func (p *Provisioning) IsOwnerFollowList(event *nostr.Event) bool {
+	return p.mode == ProvisioningModeOwnerFollows && event.Kind == nostr.KindFollowList && event.PubKey == p.ownerPubkey
+}
+
+// Allows reports whether the announcement may provision a repository, and if not why
+func (p *Provisioning) Allows(ctx context.Context, event *nostr.Event) (bool, string) {
+	if p.mode == ProvisioningModeOpen || event.PubKey == p.ownerPubkey {
+		return true, ""
+	}
+	identifier := event.Tags.GetD()
+	if p.repoExists(ctx, event.PubKey, identifier) {
+		return true, ""
+	}
+
+	switch p.mode {
+	case ProvisioningModeNpubs:
+		if p.pubkeys[event.PubKey] || p.management.IsPubKeyAllowed(event.PubKey) {
+			return true, ""
+		}
+		return false, "blocked: this ngit-relay instance only provisions repositories for whitelisted npubs"
+	case ProvisioningModeRepos:
+		if p.coordinates[shared.RepoCoordinate(event.PubKey, identifier)] {
+			return true, ""
+		}
+		return false, "blocked: this ngit-relay instance only provisions whitelisted repositories"
+	case ProvisioningModeOwnerFollows:
+		if p.ownerFollows(ctx, event.PubKey) {
+			return true, ""
+		}
+		return false, "blocked: this ngit-relay instance only provisions repositories for npubs followed by the owner"
+	}
+	return false, "blocked: repository provisioning is closed"
+}
+
+// repoExists reports whether the repository is already hosted, either by this pubkey or by
+// another maintainer whose stored announcement lists this pubkey as a maintainer
+func (p *Provisioning) repoExists(ctx context.Context, pubkey string, identifier string) bool {
+	exists := func(pubkey string) bool {
+		npub, err := nip19.EncodePublicKey(pubkey)
+		if err != nil {
+			return false
+		}
+		_, err = os.Stat(shared.RepoPath(p.git_data_path, npub, identifier))
+		return err == nil
+	}
+	if exists(pubkey) {
+		return true
+	}
+	for _, query := range p.relay.QueryEvents {
+		ch, err := query(ctx, nostr.Filter{
+			Kinds: []int{nostr.KindRepositoryAnnouncement},
+			Tags:  nostr.TagMap{"d": []string{identifier}},
+		})
+		if err != nil {
+			continue
+		}
+		for ev := range ch {
+			if slices.Contains(nip34.ParseRepository(*ev).Maintainers, pubkey) && exists(ev.PubKey) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ownerFollows reports whether pubkey is in the owner's stored contact list
+func (p *Provisioning) ownerFollows(ctx context.Context, pubkey string) bool {
+	for _, query := range p.relay.QueryEvents {
+		ch, err := query(ctx, nostr.Filter{
+			Kinds:   []int{nostr.KindFollowList},
+			Authors: []string{p.ownerPubkey},
+			Limit:   1,
+		})
+		if err != nil {
+			continue
+		}
+		for ev := range ch {
+			if ev.Tags.FindWithValue("p", pubkey) != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fetchOwnerFollowList imports the owner's latest contact list from the lookup relays
+func (p *Provisioning) fetchOwnerFollowList(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var latest *nostr.Event
+	for ev := range p.pool.FetchMany(ctx, p.lookupRelays, nostr.Filter{
+		Kinds:   []int{nostr.KindFollowList},
+		Authors: []string{p.ownerPubkey},
+	}) {
+		if latest == nil || ev.CreatedAt > latest.CreatedAt {
+			latest = ev.Event
+		}
+	}
+	if latest == nil {
+		p.logger.Debug("owner contact list not found on lookup relays")
+		return
+	}
+	if ok, _ := latest.CheckSignature(); !ok {
+		return
+	}
+	if skipBroadcast, err := p.relay.AddEvent(ctx, latest); err != nil {
+		p.logger.Debug("owner contact list rejected", zap.Error(err))
+	} else if !skipBroadcast {
+		p.relay.BroadcastEvent(latest)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"ngit-relay/shared"
+	"os"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"go.uber.org/zap"
+)
+
+// StartQuerySocket serves announcement and state events over a unix-domain socket so the
+// git hooks and proactive sync can query the event store without a websocket handshake
+func StartQuerySocket(relay *khatru.Relay, socket_path string) error {
+	logger := shared.L().With(zap.String("type", "QuerySocket"), zap.String("socket_path", socket_path))
+
+	// remove a stale socket left by a previous run
+	if err := os.Remove(socket_path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", socket_path)
+	if err != nil {
+		return err
+	}
+	// the hooks may run as a different user, eg. nginx
+	if err := os.Chmod(socket_path, 0666); err != nil {
+		listener.Close()
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(shared.QuerySocketEventsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if ids := r.URL.Query()["id"]; len(ids) > 0 {
+			json.NewEncoder(w).Encode(queryEventsByID(r.Context(), relay, ids))
+			return
+		}
+		identifier := r.URL.Query().Get("identifier")
+		if coordinate := r.URL.Query().Get("coordinate"); coordinate != "" {
+			if parts := strings.SplitN(coordinate, ":", 3); len(parts) == 3 {
+				identifier = parts[2]
+			}
+		}
+		if identifier == "" {
+			http.Error(w, "identifier, coordinate or id required", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(queryAnnouncementAndStateEvents(r.Context(), relay, identifier))
+	})
+
+	go func() {
+		logger.Info("Starting query socket")
+		if err := http.Serve(listener, mux); err != nil {
+			logger.Error("query socket stopped", zap.Error(err))
+		}
+	}()
+	return nil
+}
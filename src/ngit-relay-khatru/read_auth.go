@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"ngit-relay/shared"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/zap"
+)
+
+// ReadAuth restricts reading events, git repositories and blobs to whitelisted pubkeys when
+// NGIT_AUTH_TO_READ is enabled. Relay clients authenticate with NIP-42, git clients with a
+// NIP-98 Authorization header and blossom clients with a BUD-01 get Authorization header.
+type ReadAuth struct {
+	enabled     bool
+	ownerPubkey string
+	whitelist   map[string]bool
+	logger      *zap.Logger
+}
+
+func NewReadAuth(config Config, ownerPubkey string) (*ReadAuth, error) {
+	ra := &ReadAuth{
+		enabled:     config.AuthToRead,
+		ownerPubkey: ownerPubkey,
+		whitelist:   make(map[string]bool),
+		logger:      shared.L().With(zap.String("type", "ReadAuth")),
+	}
+	for _, item := range config.ReadWhitelist {
+		pointer, err := ParseRepoPointer(item)
+		if err != nil || pointer.Identifier != "" {
+			return nil, fmt.Errorf("invalid read whitelist entry, expected npub: %s", item)
+		}
+		ra.whitelist[pointer.PubKey] = true
+	}
+	return ra, nil
+}
+
+// CanRead reports whether pubkey may read from this instance
+func (ra *ReadAuth) CanRead(pubkey string) bool {
+	return !ra.enabled || pubkey == ra.ownerPubkey || ra.whitelist[pubkey]
+}
+
+// RejectFilter is a relay policy requiring NIP-42 auth from a whitelisted pubkey for REQ
+// and COUNT. Connections from our own processes (hooks and proactive sync) are exempt.
+func (ra *ReadAuth) RejectFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	if !ra.enabled {
+		return false, ""
+	}
+	if conn := khatru.GetConnection(ctx); conn == nil || isInternalRequest(conn.Request) {
+		return false, ""
+	}
+	pubkey := khatru.GetAuthed(ctx)
+	if pubkey == "" {
+		khatru.RequestAuth(ctx)
+		return true, "auth-required: this ngit-relay instance requires authentication to read"
+	}
+	if !ra.CanRead(pubkey) {
+		return true, "restricted: pubkey not on the read whitelist"
+	}
+	return false, ""
+}
+
+// RejectBlobGet is a blossom policy requiring get authorization from a whitelisted pubkey
+func (ra *ReadAuth) RejectBlobGet(ctx context.Context, auth *nostr.Event, sha256 string) (bool, string, int) {
+	if !ra.enabled {
+		return false, "", 0
+	}
+	if auth == nil {
+		return true, "authorization required to read from this server", 401
+	}
+	if !ra.CanRead(auth.PubKey) {
+		return true, "pubkey not on the read whitelist", 403
+	}
+	return false, "", 0
+}
+
+// RejectBlobList applies the same rules as RejectBlobGet to listing blobs
+func (ra *ReadAuth) RejectBlobList(ctx context.Context, auth *nostr.Event, pubkey string) (bool, string, int) {
+	return ra.RejectBlobGet(ctx, auth, "")
+}
+
+// AuthorizeGitRead checks git fetches have a NIP-98 Authorization header from a whitelisted
+// pubkey. The `u` tag can be the repository url, or a url within it, so one header can be
+// used for the whole fetch. Returns the http status code to respond with on error.
+func (ra *ReadAuth) AuthorizeGitRead(r *http.Request, repo_url string) (int, error) {
+	if !ra.enabled {
+		return http.StatusOK, nil
+	}
+	evt, err := ValidateNip98Auth(r, nil, repo_url)
+	if err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("auth-required: %w", err)
+	}
+	if !ra.CanRead(evt.PubKey) {
+		ra.logger.Debug("git read rejected", zap.String("pubkey", evt.PubKey), zap.String("repo_url", repo_url))
+		return http.StatusForbidden, fmt.Errorf("restricted: pubkey not on the read whitelist")
+	}
+	return http.StatusOK, nil
+}
+
+// isInternalRequest reports whether the request came directly from a process in this
+// container rather than via nginx, which always sets X-Real-IP
+func isInternalRequest(r *http.Request) bool {
+	if r == nil || r.Header.Get("X-Real-IP") != "" || r.Header.Get("X-Forwarded-For") != "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
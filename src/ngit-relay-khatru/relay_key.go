@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"ngit-relay/shared"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// relayKeyFileName is where the relay's generated secret key is kept within the relay data dir
+const relayKeyFileName = "ngit-relay.key"
+
+// loadRelaySecretKey returns the key the relay signs its own events with, eg. the kind 1063
+// events listing repository bundles. Set with NGIT_RELAY_NSEC, otherwise a key is generated
+// and kept in the relay data dir.
+func loadRelaySecretKey(relay_data_path string) (string, error) {
+	if nsec := os.Getenv("NGIT_RELAY_NSEC"); nsec != "" {
+		prefix, value, err := nip19.Decode(nsec)
+		if err != nil || prefix != "nsec" {
+			return "", fmt.Errorf("invalid NGIT_RELAY_NSEC")
+		}
+		return value.(string), nil
+	}
+
+	path := filepath.Join(relay_data_path, relayKeyFileName)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		sk := strings.TrimSpace(string(data))
+		if _, err := nostr.GetPublicKey(sk); err != nil {
+			return "", fmt.Errorf("invalid relay key in %s: %w", path, err)
+		}
+		return sk, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	sk := nostr.GeneratePrivateKey()
+	if err := os.MkdirAll(relay_data_path, 0755); err != nil {
+		return "", err
+	}
+	if err := shared.WriteFileAtomic(path, []byte(sk+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return sk, nil
+}
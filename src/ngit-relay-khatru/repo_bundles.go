@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"ngit-relay/shared"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/zap"
+)
+
+const gitBundleMimeType = "application/x-git-bundle"
+
+// RepoBundles publishes the bundles repository maintenance in ngit-relay-proactive-sync
+// creates. Each is stored as a blossom blob, advertised to git clients with the bundle-uri
+// capability so clones download most history as a static file and fetch only the rest, and
+// listed in a kind 1063 event signed by the relay key tagging the repository's coordinate.
+type RepoBundles struct {
+	relay         *khatru.Relay
+	git_data_path string
+	domain        string
+	blobs         *BlobStorage
+	secretKey     string
+	pubkey        string
+	logger        *zap.Logger
+}
+
+func NewRepoBundles(relay *khatru.Relay, git_data_path string, domain string, blobs *BlobStorage, secretKey string) (*RepoBundles, error) {
+	pubkey, err := nostr.GetPublicKey(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	return &RepoBundles{
+		relay:         relay,
+		git_data_path: git_data_path,
+		domain:        domain,
+		blobs:         blobs,
+		secretKey:     secretKey,
+		pubkey:        pubkey,
+		logger:        shared.L().With(zap.String("type", "RepoBundles")),
+	}, nil
+}
+
+// Start periodically publishes pending bundles of hosted and archived repositories
+func (rb *RepoBundles) Start(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			repo_paths, err := shared.ListRepoPaths(rb.git_data_path)
+			if err != nil {
+				rb.logger.Warn("cannot list repositories", zap.Error(err))
+				continue
+			}
+			if archived, err := shared.ListRepoPaths(filepath.Join(rb.git_data_path, shared.ArchiveDirName)); err == nil {
+				repo_paths = append(repo_paths, archived...)
+			}
+			for _, repo_path := range repo_paths {
+				if _, err := os.Stat(filepath.Join(repo_path, shared.PendingBundleInfoFileName)); err != nil {
+					continue
+				}
+				bundle, err := rb.publish(context.Background(), repo_path)
+				if err != nil {
+					rb.logger.Warn("cannot publish repository bundle", zap.String("repo_path", repo_path), zap.Error(err))
+					continue
+				}
+				rb.logger.Info("published repository bundle", zap.String("repo_path", repo_path), zap.String("url", bundle.URL), zap.Int64("size", bundle.Size))
+			}
+		}
+	}()
+}
+
+// publish stores the pending bundle of a repository, advertises it in place of the previous
+// bundle and removes the previous one
+func (rb *RepoBundles) publish(ctx context.Context, repo_path string) (*shared.RepoBundle, error) {
+	bundle, err := shared.LoadPendingRepoBundle(repo_path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read pending bundle: %w", err)
+	}
+	if bundle == nil {
+		return nil, fmt.Errorf("no pending bundle")
+	}
+	defer shared.RemovePendingRepoBundle(repo_path)
+
+	file, err := os.Open(filepath.Join(repo_path, shared.PendingBundleFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := rb.blobs.StoreBlobFromReader(ctx, file, bundle.SHA256, bundle.Size, rb.pubkey, gitBundleMimeType); err != nil {
+		return nil, fmt.Errorf("cannot store bundle: %w", err)
+	}
+	bundle.URL = DomainBaseURL(rb.domain) + "/" + bundle.SHA256 + ".bundle"
+
+	if err := advertiseBundleURI(repo_path, bundle.URL); err != nil {
+		return nil, err
+	}
+
+	pubkey, _, identifier, err := shared.GetPubKeyAndIdentifierFromPath(repo_path)
+	if err != nil {
+		return nil, err
+	}
+	event := nostr.Event{
+		Kind:      nostr.KindFileMetadata,
+		CreatedAt: nostr.Now(),
+		Content:   "git bundle of " + identifier,
+		Tags: nostr.Tags{
+			{"url", bundle.URL},
+			{"m", gitBundleMimeType},
+			{"x", bundle.SHA256},
+			{"size", strconv.FormatInt(bundle.Size, 10)},
+			{"a", shared.RepoCoordinate(pubkey, identifier)},
+			{"t", "git-bundle"},
+		},
+	}
+	if err := event.Sign(rb.secretKey); err != nil {
+		return nil, err
+	}
+	if skipBroadcast, err := rb.relay.AddEvent(ctx, &event); err != nil {
+		rb.logger.Debug("bundle event rejected", zap.String("repo_path", repo_path), zap.Error(err))
+	} else {
+		bundle.EventID = event.ID
+		if !skipBroadcast {
+			rb.relay.BroadcastEvent(&event)
+		}
+	}
+
+	previous, _ := shared.LoadRepoBundle(repo_path)
+	if err := shared.SaveRepoBundle(repo_path, bundle); err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		if previous.SHA256 != bundle.SHA256 {
+			if err := rb.blobs.DeleteBlob(ctx, previous.SHA256, rb.pubkey); err != nil {
+				rb.logger.Debug("cannot delete previous bundle", zap.String("sha256", previous.SHA256), zap.Error(err))
+			}
+		}
+		if previous.EventID != "" {
+			rb.deleteEvent(ctx, previous.EventID)
+		}
+	}
+	return bundle, nil
+}
+
+func (rb *RepoBundles) deleteEvent(ctx context.Context, id string) {
+	for _, ev := range queryEventsByID(ctx, rb.relay, []string{id}) {
+		if ev.PubKey != rb.pubkey {
+			continue
+		}
+		for _, del := range rb.relay.DeleteEvent {
+			if err := del(ctx, &ev); err != nil {
+				rb.logger.Debug("cannot delete previous bundle event", zap.String("id", id), zap.Error(err))
+			}
+		}
+	}
+}
+
+// advertiseBundleURI configures git upload-pack to offer the bundle to clients that support
+// bundle-uri, eg. git clone with transfer.bundleURI enabled
+func advertiseBundleURI(repo_path string, url string) error {
+	for _, config := range [][]string{
+		{"uploadpack.advertiseBundleURIs", "true"},
+		{"bundle.version", "1"},
+		{"bundle.mode", "all"},
+		{"bundle.ngit.uri", url},
+	} {
+		if output, err := exec.Command("git", "-c", "safe.directory="+repo_path, "-C", repo_path, "config", config[0], config[1]).CombinedOutput(); err != nil {
+			return fmt.Errorf("cannot advertise bundle: %w, output: %s", err, string(output))
+		}
+	}
+	return nil
+}
+
+// WithdrawRepoBundles stops git advertising the bundles published while bundles were enabled,
+// eg. before NGIT_AUTH_TO_READ was turned on, and forgets them so they are published afresh if
+// bundles are enabled again
+func WithdrawRepoBundles(git_data_path string) {
+	logger := shared.L().With(zap.String("type", "RepoBundles"))
+	repo_paths, err := shared.ListRepoPaths(git_data_path)
+	if err != nil {
+		logger.Warn("cannot list repositories", zap.Error(err))
+		return
+	}
+	if archived, err := shared.ListRepoPaths(filepath.Join(git_data_path, shared.ArchiveDirName)); err == nil {
+		repo_paths = append(repo_paths, archived...)
+	}
+	for _, repo_path := range repo_paths {
+		if err := withdrawBundleURI(repo_path); err != nil {
+			logger.Warn("cannot withdraw repository bundle", zap.String("repo_path", repo_path), zap.Error(err))
+			continue
+		}
+		shared.RemovePendingRepoBundle(repo_path)
+		if err := os.Remove(filepath.Join(repo_path, shared.RepoBundleFileName)); err != nil && !os.IsNotExist(err) {
+			logger.Warn("cannot forget repository bundle", zap.String("repo_path", repo_path), zap.Error(err))
+		}
+	}
+}
+
+// withdrawBundleURI removes the config set by advertiseBundleURI
+func withdrawBundleURI(repo_path string) error {
+	git := func(args ...string) *exec.Cmd {
+		return exec.Command("git", append([]string{"-c", "safe.directory=" + repo_path, "-C", repo_path, "config"}, args...)...)
+	}
+	if git("--get", "bundle.ngit.uri").Run() != nil {
+		return nil
+	}
+	for _, args := range [][]string{
+		{"--unset-all", "uploadpack.advertiseBundleURIs"},
+		{"--remove-section", "bundle.ngit"},
+		{"--remove-section", "bundle"},
+	} {
+		if output, err := git(args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("git config %s: %w, output: %s", args[0], err, string(output))
+		}
+	}
+	return nil
+}
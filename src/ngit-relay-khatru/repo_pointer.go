@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// RepoPointer points to a repository, or all repositories of a pubkey when Identifier is
+// empty. Used for archive and provisioning whitelist entries.
+type RepoPointer struct {
+	PubKey     string
+	Identifier string
+	Relays     []string
+}
+
+// ParseRepoPointer parses an npub, nprofile, naddr, hex pubkey or repository coordinate
+func ParseRepoPointer(s string) (RepoPointer, error) {
+	if nostr.IsValidPublicKey(s) {
+		return RepoPointer{PubKey: s}, nil
+	}
+	if parts := strings.SplitN(s, ":", 3); len(parts) == 3 {
+		if parts[0] != fmt.Sprint(nostr.KindRepositoryAnnouncement) || !nostr.IsValidPublicKey(parts[1]) || parts[2] == "" {
+			return RepoPointer{}, fmt.Errorf("not a repository coordinate: %s", s)
+		}
+		return RepoPointer{PubKey: parts[1], Identifier: parts[2]}, nil
+	}
+
+	prefix, value, err := nip19.Decode(s)
+	if err != nil {
+		return RepoPointer{}, err
+	}
+	switch prefix {
+	case "npub":
+		return RepoPointer{PubKey: value.(string)}, nil
+	case "nprofile":
+		pointer := value.(nostr.ProfilePointer)
+		return RepoPointer{PubKey: pointer.PublicKey, Relays: pointer.Relays}, nil
+	case "naddr":
+		pointer := value.(nostr.EntityPointer)
+		if pointer.Kind != nostr.KindRepositoryAnnouncement {
+			return RepoPointer{}, fmt.Errorf("naddr is not a repository announcement: %s", s)
+		}
+		return RepoPointer{PubKey: pointer.PublicKey, Identifier: pointer.Identifier, Relays: pointer.Relays}, nil
+	}
+	return RepoPointer{}, fmt.Errorf("unsupported repository pointer: %s", s)
+}
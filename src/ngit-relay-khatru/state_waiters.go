@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// StateWaiters lets pushes waiting within the state grace window follow state events as
+// they are saved, without a websocket subscription to the relay
+type StateWaiters struct {
+	mu      sync.Mutex
+	waiters map[string][]chan nostr.Event
+}
+
+func NewStateWaiters() *StateWaiters {
+	return &StateWaiters{waiters: make(map[string][]chan nostr.Event)}
+}
+
+// OnEventSaved passes saved state events on to the pushes waiting for them
+func (s *StateWaiters) OnEventSaved(ctx context.Context, event *nostr.Event) {
+	if event.Kind != nostr.KindRepositoryState {
+		return
+	}
+	identifier := event.Tags.GetD()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ch := range s.waiters[identifier] {
+		select {
+		case ch <- *event:
+		default:
+			// the waiter is behind, a later state event will supersede this one anyway
+		}
+	}
+}
+
+// Watch returns a channel of state events for the identifier saved from now on, by any
+// author. stop must be called once the events are no longer needed.
+func (s *StateWaiters) Watch(identifier string) (events <-chan nostr.Event, stop func()) {
+	ch := make(chan nostr.Event, 16)
+
+	s.mu.Lock()
+	s.waiters[identifier] = append(s.waiters[identifier], ch)
+	s.mu.Unlock()
+
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.waiters[identifier] = slices.DeleteFunc(s.waiters[identifier], func(c chan nostr.Event) bool { return c == ch })
+		if len(s.waiters[identifier]) == 0 {
+			delete(s.waiters, identifier)
+		}
+	}
+}
+
+// fromAuthors passes on the events from one of the authors until ctx is done
+func fromAuthors(ctx context.Context, events <-chan nostr.Event, authors []string) <-chan nostr.Event {
+	filtered := make(chan nostr.Event)
+	go func() {
+		defer close(filtered)
+		for {
+			select {
+			case event := <-events:
+				if !slices.Contains(authors, event.PubKey) {
+					continue
+				}
+				select {
+				case filtered <- event:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return filtered
+}
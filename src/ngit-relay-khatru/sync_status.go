@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"ngit-relay/shared"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+// SyncStatusAPIPath serves the sync status of every hosted and archived repository
+const SyncStatusAPIPath = "/api/sync-status"
+
+// GitServerHealthAPIPath serves the health of the git servers repositories are synced from
+const GitServerHealthAPIPath = SyncStatusAPIPath + "/git-servers"
+
+// RepoSyncStatusSuffix serves the sync status of a repository at /npub123/repo.git/ngit-status
+const RepoSyncStatusSuffix = "/ngit-status"
+
+type repoSyncStatus struct {
+	Repo     string `json:"repo"` // eg. npub123/repo.git or archive/npub123/repo.git
+	Archived bool   `json:"archived"`
+	*shared.SyncStatus
+	// Maintenance is the last scheduled maintenance of the repository's object storage
+	Maintenance *shared.RepoMaintenance `json:"maintenance,omitempty"`
+	// Bundle is the published bundle clones can download most of the repository from
+	Bundle *shared.RepoBundle `json:"bundle,omitempty"`
+}
+
+func (g *GitHTTP) loadRepoSyncStatus(repo_path string) (*repoSyncStatus, error) {
+	status, err := shared.LoadSyncStatus(repo_path)
+	if err != nil {
+		return nil, err
+	}
+	repo, _ := filepath.Rel(g.git_data_path, repo_path)
+	maintenance, _ := shared.LoadRepoMaintenance(repo_path)
+	if maintenance != nil && maintenance.LastRun == nil {
+		maintenance = nil
+	}
+	bundle, _ := shared.LoadRepoBundle(repo_path)
+	return &repoSyncStatus{
+		Repo:        filepath.ToSlash(repo),
+		Archived:    shared.IsArchiveRepoPath(repo_path),
+		SyncStatus:  status,
+		Maintenance: maintenance,
+		Bundle:      bundle,
+	}, nil
+}
+
+func (g *GitHTTP) serveRepoSyncStatus(w http.ResponseWriter, repo_path string) {
+	status, err := g.loadRepoSyncStatus(repo_path)
+	if err != nil {
+		g.logger.Warn("cannot read sync status", zap.String("repo_path", repo_path), zap.Error(err))
+		http.Error(w, "cannot read sync status", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// authorizeStatusAPI applies the git read rules to the status APIs, responding with the error
+// if the request isn't authorized. One header for SyncStatusAPIPath authorizes them all.
+func (g *GitHTTP) authorizeStatusAPI(w http.ResponseWriter, r *http.Request) bool {
+	if status, err := g.readAuth.AuthorizeGitRead(r, RequestBaseURL(r)+SyncStatusAPIPath); err != nil {
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", "Nostr")
+		}
+		http.Error(w, err.Error(), status)
+		return false
+	}
+	return true
+}
+
+func (g *GitHTTP) serveSyncStatusAPI(w http.ResponseWriter, r *http.Request) {
+	if !g.authorizeStatusAPI(w, r) {
+		return
+	}
+
+	repo_paths, err := shared.ListRepoPaths(g.git_data_path)
+	if err != nil {
+		http.Error(w, "cannot list repositories", http.StatusInternalServerError)
+		return
+	}
+	if archived, err := shared.ListRepoPaths(filepath.Join(g.git_data_path, shared.ArchiveDirName)); err == nil {
+		repo_paths = append(repo_paths, archived...)
+	}
+
+	// optionally filter to one npub, eg. ?npub=npub123
+	npub := r.URL.Query().Get("npub")
+	statuses := []*repoSyncStatus{}
+	for _, repo_path := range repo_paths {
+		if npub != "" && filepath.Base(filepath.Dir(repo_path)) != npub {
+			continue
+		}
+		status, err := g.loadRepoSyncStatus(repo_path)
+		if err != nil {
+			g.logger.Warn("cannot read sync status", zap.String("repo_path", repo_path), zap.Error(err))
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+func (g *GitHTTP) serveGitServerHealthAPI(w http.ResponseWriter, r *http.Request) {
+	if !g.authorizeStatusAPI(w, r) {
+		return
+	}
+	report, err := shared.GitServerHealthReport(g.git_data_path)
+	if err != nil {
+		g.logger.Warn("cannot read git server health", zap.Error(err))
+		http.Error(w, "cannot read git server health", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
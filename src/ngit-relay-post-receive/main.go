@@ -41,6 +41,12 @@ func main() {
 		logger.Fatal("cannot GetStateFromMaintainers", zap.Error(err))
 	}
 
+	if logger.Core().Enabled(zap.DebugLevel) {
+		if plan, err := shared.PlanProactiveSyncGitFromStateAndServers(state, []string{}, repo_path); err == nil {
+			logger.Debug("aligning repository with state event", zap.Reflect("plan", plan))
+		}
+	}
+
 	err = shared.ProactiveSyncGitFromStateAndServers(state, []string{}, repo_path)
 	if err != nil {
 		logger.Debug("ProactiveSyncGitFromStateAndServers not successful", zap.Error(err))
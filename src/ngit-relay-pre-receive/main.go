@@ -3,13 +3,10 @@ package main
 import (
 	"bufio"
 	"context"
-	"fmt"
 	"io"
 	"os"
-	"strings"
 
 	"github.com/nbd-wtf/go-nostr"
-	"github.com/nbd-wtf/go-nostr/nip34"
 	"go.uber.org/zap"
 
 	"ngit-relay/shared"
@@ -31,6 +28,25 @@ func main() {
 	logger = logger.With(zap.String("identifier", identifier), zap.String("npub", npub))
 	ctx := context.Background()
 
+	repo_path, err := os.Getwd()
+	if err != nil {
+		logger.Fatal(LogStderr("cannot get current working directory", err), zap.Error(err))
+	}
+
+	// archived repositories are read-only mirrors of repositories that don't list this instance
+	if shared.IsArchiveRepoPath(repo_path) {
+		logger.Fatal(LogStderr("this is a read-only archive of a repository that doesn't list this ngit-relay instance"))
+	}
+
+	// repositories blocked by the relay owner via the NIP-86 management API
+	management, err := shared.LoadManagement(shared.GitDataPathFromRepoPath(repo_path))
+	if err != nil {
+		logger.Fatal(LogStderr("cannot load relay management state", err), zap.Error(err))
+	}
+	if blocked, reason := management.IsRepoBlocked(pubkey, identifier); blocked {
+		logger.Fatal(LogStderr(reason))
+	}
+
 	events, err := shared.FetchAnnouncementAndStateEventsFromRelay(ctx, identifier)
 	if err != nil {
 		logger.Fatal(LogStderr("cannot fetch state events from internal relay", err), zap.Error(err))
@@ -42,58 +58,72 @@ func main() {
 		logger.Warn("state event not on internal relay, will only allow refs/nostr/ refs", zap.Error(stateErr))
 	}
 
-	// Create a scanner to read from standard input
+	// Read every ref update first so they can be re-evaluated together against newer state events
 	scanner := bufio.NewScanner(os.Stdin)
-
-	// Read each line from stdin - each one represents a ref to push
+	var updates []shared.RefUpdate
 	for scanner.Scan() {
 		line := scanner.Text()
-		refLogger := logger.With(zap.String("line", line))
-		// Split the line into oldRev, newRev, and refName
-		parts := strings.Fields(line)
-		if len(parts) != 3 {
-			refLogger.Fatal(LogStderr("Invalid input format from git hook"))
+		update, err := shared.ParseRefUpdate(line)
+		if err != nil {
+			logger.With(zap.String("line", line)).Fatal(LogStderr("Invalid input format from git hook"))
 		}
+		updates = append(updates, update)
+	}
 
-		oldRev := parts[0]
-		newRev := parts[1]
-		refName := parts[2]
-
-		if strings.HasPrefix(refName, "refs/nostr/") {
-			if nostr.IsValid32ByteHex(strings.Replace(refName, "refs/nostr/", "", 1)) {
-				if state != nil {
-					refLogger.Debug("Allowing push for PR ref", zap.Any("tags", state.Tags), zap.Any("branches", state.Branches))
-				} else {
-					refLogger.Debug("Allowing push for PR ref (no state available)")
-				}
-				continue
-			}
-			logger.Fatal(LogStderr("refs/nostr/<event-id> must use a valid event id", nil))
-		}
+	// Check for any errors during scanning
+	if err := scanner.Err(); err != nil {
+		logger.Fatal(LogStderr("Error reading input from git hook stdin", err), zap.Error(err))
+	}
 
-		// If state couldn't be fetched and this isn't a refs/nostr/ ref, fatal error
-		if stateErr != nil {
-			refLogger.Fatal(LogStderr("state event not on internal relay, cannot validate non-nostr refs", stateErr), zap.Error(stateErr))
+	// the state event is often published just after the git data is pushed so wait for it
+	var states <-chan nostr.Event
+	window := shared.StateGraceWindow()
+	if maintainers := shared.GetMaintainers(events, pubkey, identifier); window > 0 && len(maintainers) > 0 && len(shared.CheckRefUpdates(updates, state)) > 0 {
+		var since nostr.Timestamp
+		if state != nil {
+			since = state.CreatedAt
 		}
-
-		// Reject branches with pr/ prefix
-		if strings.HasPrefix(refName, "refs/heads/pr/") {
-			refLogger.Debug(LogStderr("'pr/*' branches should be sent over nostr, not through the git server"))
-			os.Exit(1)
+		subCtx, cancel := context.WithTimeout(ctx, window)
+		defer cancel()
+		states, err = shared.SubscribeToStateEventsFromRelay(subCtx, identifier, maintainers, since)
+		if err != nil {
+			logger.Warn("cannot follow state events, will not wait for a matching state event", zap.Error(err))
 		}
+	}
+	state, rejected := shared.WaitForMatchingState(ctx, updates, state, states, window, func(msg string) {
+		os.Stderr.WriteString(msg + "\n")
+	})
+
+	// refs/nostr/ refs must be for a PR, PR update or patch event for this repository, or
+	// are held until the event arrives
+	nostrEvents, err := shared.FetchEventsByIDFromRelay(ctx, shared.NostrRefEventIDs(updates))
+	if err != nil {
+		logger.Fatal(LogStderr("cannot fetch PR events from internal relay", err), zap.Error(err))
+	}
+	coordinates := []string{shared.RepoCoordinate(pubkey, identifier)}
+	if maintainers := shared.GetMaintainers(events, pubkey, identifier); len(maintainers) > 0 {
+		coordinates = shared.GetRepoCoordinates(maintainers, identifier)
+	}
+	nostrRejected, pendingNostrRefs := shared.CheckNostrRefUpdates(updates, nostrEvents, coordinates)
+	for ref, err := range nostrRejected {
+		rejected[ref] = err
+	}
 
-		// Reject branches/tags that don't match state event
-		matches, err := MatchesStateEvent(refName, newRev, oldRev, state)
-		if !matches {
+	for _, update := range updates {
+		refLogger := logger.With(zap.String("ref", update.RefName), zap.String("new_rev", update.NewRev))
+		if err, ok := rejected[update.RefName]; ok {
 			refLogger.Debug(LogStderr(err.Error()), zap.Error(err))
 			os.Exit(1)
 		}
-		refLogger.Debug("Allowing push for ref as it matches nostr state event", zap.Any("tags", state.Tags), zap.Any("branches", state.Branches))
+		if state != nil {
+			refLogger.Debug("Allowing push for ref as it matches nostr state event", zap.Any("tags", state.Tags), zap.Any("branches", state.Branches))
+		} else {
+			refLogger.Debug("Allowing push for PR ref (no state available)")
+		}
 	}
 
-	// Check for any errors during scanning
-	if err := scanner.Err(); err != nil {
-		logger.Fatal(LogStderr("Error reading input from git hook stdin", err), zap.Error(err))
+	if err := shared.RecordPendingNostrRefs(repo_path, pendingNostrRefs); err != nil {
+		logger.Warn("cannot record refs/nostr/ refs pushed before their event", zap.Error(err))
 	}
 
 	logger.Debug("Pre-receive hook completed successfully, all refs accepted.")
@@ -110,26 +140,3 @@ func LogStderr(msg string, err ...error) string {
 	os.Stderr.WriteString("error: " + msg + errMsg + "\n")
 	return msg
 }
-
-func MatchesStateEvent(ref string, to string, oldRev string, state *nip34.RepositoryState) (bool, error) {
-	if strings.HasPrefix(ref, "refs/heads/") {
-		for branchName, commitId := range state.Branches {
-			if ref[11:] == branchName {
-				if to == commitId {
-					return true, nil
-				}
-				return false, fmt.Errorf("cannot push %s to %s as nostr state event is at %s", ref[11:], to[:7], commitId[:7])
-			}
-		}
-	} else if strings.HasPrefix(ref, "refs/tags/") {
-		for tagName, commitId := range state.Tags {
-			if ref[10:] == tagName {
-				if to == commitId {
-					return true, nil
-				}
-				return false, fmt.Errorf("cannot push %s to %s as nostr state event is at %s", ref[10:], to[:7], commitId[:7])
-			}
-		}
-	}
-	return false, fmt.Errorf("%s not found in our latest nostr state event", ref)
-}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
 	"time"
 
 	"ngit-relay/shared"
 
+	"github.com/nbd-wtf/go-nostr/nip34"
 	"go.uber.org/zap"
 )
 
@@ -18,27 +22,42 @@ func main() {
 
 	git_data_path := flag.String("git-data-dir", "", "Directory for repositories data")
 	sync_interval := flag.Int("sync-interval", 15, "minutes between each proactive sync")
+	sync_workers := flag.Int("sync-workers", 4, "number of repositories to sync in parallel")
+	pool_gc_interval := flag.Int("pool-gc-interval", 24, "hours between each gc of the object pools shared by copies of the same project")
+	dry_run := flag.Bool("dry-run", false, "print what a sync would change in each repository, without changing anything, and exit")
 	flag.Parse()
 	if *git_data_path == "" {
 		flag.Usage()
 		logger.Fatal("relay-data-dir, git-data-dir and blossom_data_path are required CLI arguments.")
 	}
 
+	if *dry_run {
+		PlanRepos(*git_data_path)
+		return
+	}
+
 	// Wait 20s for warmup then run SyncRepos
 	logger.Info("Waiting 20 seconds for warmup before starting sync", zap.Int("sync_interval", *sync_interval))
 	time.Sleep(20 * time.Second)
 
 	// Run SyncRepos every sync_interval minutes
 	// If SyncRepos takes longer than sync_interval, run it again when it finishes
+	var lastPoolGC time.Time
 	for {
 		startTime := time.Now()
-		if !shared.GetEnvBool("NGIT_PROACTIVE_SYNC_GIT", true) {
+		if shared.GetEnvBool("NGIT_PROACTIVE_SYNC_GIT", true) {
+			logger.Info("starting sync")
+			SyncRepos(*git_data_path, *sync_workers, logger)
+		} else {
 			logger.Debug("Skipping sync as NGIT_PROACTIVE_SYNC_GIT is false", zap.Int("sync_interval", *sync_interval))
-			time.Sleep(time.Duration(*sync_interval) * time.Minute)
-			continue
 		}
-		logger.Info("starting sync")
-		SyncRepos(*git_data_path, logger)
+		if shared.RepoMaintenanceEnabled() {
+			MaintainRepos(*git_data_path, *sync_workers, logger)
+		}
+		if shared.ObjectPoolsEnabled() && time.Since(lastPoolGC) >= time.Duration(*pool_gc_interval)*time.Hour {
+			MaintainObjectPools(*git_data_path, logger)
+			lastPoolGC = time.Now()
+		}
 
 		// Calculate time elapsed and sleep for the remainder of the interval
 		elapsed := time.Since(startTime)
@@ -59,48 +78,129 @@ func main() {
 	}
 }
 
-func SyncRepos(git_data_path string, logger *zap.Logger) {
+func SyncRepos(git_data_path string, workers int, logger *zap.Logger) {
 	// git_data_path has a structure of [git_data_path]/npub123/repo.git
-
-	// First, list all npub directories
-	npubDirs, err := os.ReadDir(git_data_path)
+	repoPaths, err := shared.ListRepoPaths(git_data_path)
 	if err != nil {
 		logger.Error("Failed to read git data directory", zap.String("path", git_data_path), zap.Error(err))
 		return
 	}
 
-	// For each npub directory
-	for _, npubDir := range npubDirs {
-		if !npubDir.IsDir() || !strings.HasPrefix(npubDir.Name(), "npub") {
-			continue // Skip if not a directory or not an npub directory
+	// sync repositories in parallel so a slow git server doesn't hold up every other repository
+	forEachRepo(repoPaths, workers, func(repoPath string) {
+		logger.Debug("Syncing repository", zap.String("repo_path", repoPath))
+		if err := SyncRepo(git_data_path, repoPath); err != nil {
+			logger.Error("Failed to sync repository",
+				zap.String("repo_path", repoPath),
+				zap.Error(err))
 		}
+	})
 
-		npubPath := filepath.Join(git_data_path, npubDir.Name())
-
-		// List all repo.git directories for this npub
-		repoDirs, err := os.ReadDir(npubPath)
-		if err != nil {
-			logger.Error("Failed to read npub directory", zap.String("path", npubPath), zap.Error(err))
+	report, err := shared.GitServerHealthReport(git_data_path)
+	if err != nil {
+		logger.Warn("cannot read git server health", zap.Error(err))
+	}
+	for _, health := range report {
+		if health.Failures == 0 {
 			continue
 		}
+		logger.Info("git server health",
+			zap.String("server", health.Server),
+			zap.Float64("success_rate", health.SuccessRate()),
+			zap.Duration("average_latency", health.AverageLatency),
+			zap.Int("consecutive_failures", health.ConsecutiveFailures),
+			zap.String("last_error", health.LastError),
+			zap.Time("backoff_until", health.BackoffUntil))
+	}
+}
 
-		// For each repo.git directory
-		for _, repoDir := range repoDirs {
-			if !repoDir.IsDir() || !strings.HasSuffix(repoDir.Name(), ".git") {
-				continue // Skip if not a directory or not a git repository
+// PlanRepos prints the plan to align each hosted and archived repository with its state
+// event
+func PlanRepos(git_data_path string) {
+	for _, data_path := range []string{git_data_path, filepath.Join(git_data_path, shared.ArchiveDirName)} {
+		repoPaths, err := shared.ListRepoPaths(data_path)
+		if os.IsNotExist(err) && data_path != git_data_path {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read git data directory %s: %v\n", data_path, err)
+			os.Exit(1)
+		}
+		for _, repoPath := range repoPaths {
+			pubkey, _, identifier, err := shared.GetPubKeyAndIdentifierFromPath(repoPath)
+			if err == nil {
+				var plan *shared.SyncPlan
+				if plan, err = shared.PlanProactiveSyncGit(pubkey, identifier, data_path); err == nil {
+					fmt.Print(plan)
+					continue
+				}
 			}
+			fmt.Printf("%s: cannot plan sync: %v\n", repoPath, err)
+		}
+	}
+}
 
-			repoPath := filepath.Join(npubPath, repoDir.Name())
-			logger.Debug("Syncing repository", zap.String("repo_path", repoPath))
+// MaintainRepos runs the maintenance tasks due for each hosted and archived repository. It
+// runs after SyncRepos, and repositories locked by a push or a sync in ngit-relay-khatru are
+// skipped until the next run.
+func MaintainRepos(git_data_path string, workers int, logger *zap.Logger) {
+	repoPaths, err := shared.ListRepoPaths(git_data_path)
+	if err != nil {
+		logger.Error("Failed to read git data directory", zap.String("path", git_data_path), zap.Error(err))
+		return
+	}
+	if archived, err := shared.ListRepoPaths(filepath.Join(git_data_path, shared.ArchiveDirName)); err == nil {
+		repoPaths = append(repoPaths, archived...)
+	}
 
-			err := SyncRepo(git_data_path, repoPath)
-			if err != nil {
-				logger.Error("Failed to sync repository",
-					zap.String("repo_path", repoPath),
-					zap.Error(err))
-			}
+	var mu sync.Mutex
+	maintained, loosePacked, failed := 0, 0, 0
+	forEachRepo(repoPaths, workers, func(repoPath string) {
+		maintenance, err := shared.MaintainRepo(repoPath)
+		if err != nil {
+			logger.Error("Failed to maintain repository", zap.String("repo_path", repoPath), zap.Error(err))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			failed++
+		}
+		if maintenance != nil && maintenance.After != nil {
+			maintained++
+			loosePacked += maintenance.Before.LooseObjects - maintenance.After.LooseObjects
+			logger.Debug("maintained repository",
+				zap.String("repo_path", repoPath),
+				zap.Strings("tasks", maintenance.Tasks),
+				zap.Duration("duration", maintenance.Duration),
+				zap.Int("packs", maintenance.After.Packs),
+				zap.Int("pack_size_kib", maintenance.After.PackSizeKiB))
 		}
+	})
+	logger.Info("repository maintenance completed",
+		zap.Int("repos", len(repoPaths)),
+		zap.Int("maintained", maintained),
+		zap.Int("failed", failed),
+		zap.Int("loose_objects_packed", loosePacked))
+}
+
+// forEachRepo runs fn for each repository, on up to workers repositories at a time
+func forEachRepo(repoPaths []string, workers int, fn func(repoPath string)) {
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < max(workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for repoPath := range queue {
+				fn(repoPath)
+			}
+		}()
 	}
+	for _, repoPath := range repoPaths {
+		queue <- repoPath
+	}
+	close(queue)
+	wg.Wait()
 }
 
 func SyncRepo(git_data_path string, repoPath string) error {
@@ -110,3 +210,54 @@ func SyncRepo(git_data_path string, repoPath string) error {
 	}
 	return shared.ProactiveSyncGit(pubkey, identifier, git_data_path)
 }
+
+// MaintainObjectPools adds repositories that aren't yet in an object pool to the pool for
+// their announced earliest unique commit, then garbage collects each pool
+func MaintainObjectPools(git_data_path string, logger *zap.Logger) {
+	ctx := context.Background()
+	for _, data_path := range []string{git_data_path, filepath.Join(git_data_path, shared.ArchiveDirName)} {
+		repoPaths, err := shared.ListRepoPaths(data_path)
+		if err != nil && !os.IsNotExist(err) {
+			logger.Error("Failed to read git data directory", zap.String("path", data_path), zap.Error(err))
+		}
+		for _, repoPath := range repoPaths {
+			if len(shared.ObjectPoolsOf(repoPath)) > 0 {
+				continue
+			}
+			pubkey, _, identifier, err := shared.GetPubKeyAndIdentifierFromPath(repoPath)
+			if err != nil {
+				continue
+			}
+			events, err := shared.FetchAnnouncementAndStateEventsFromRelay(ctx, identifier)
+			if err != nil {
+				continue
+			}
+			announcement := shared.FindAnnouncementEventByPubKeyIdentifier(events, pubkey, identifier)
+			if announcement == nil {
+				continue
+			}
+			if euc := shared.EarliestUniqueCommit(*announcement); euc != "" {
+				err := shared.JoinObjectPool(repoPath, euc, nip34.ParseRepository(*announcement).Maintainers)
+				if errors.Is(err, shared.ErrObjectPoolNotReady) {
+					logger.Debug("not joining object pool yet", zap.String("repo_path", repoPath), zap.Error(err))
+				} else if err != nil {
+					logger.Warn("cannot join object pool", zap.String("repo_path", repoPath), zap.Error(err))
+				}
+			}
+		}
+	}
+
+	pools, err := shared.ListObjectPools(git_data_path)
+	if err != nil {
+		logger.Error("Failed to list object pools", zap.Error(err))
+		return
+	}
+	for _, pool := range pools {
+		start := time.Now()
+		if err := shared.MaintainObjectPool(pool, "2.weeks.ago"); err != nil {
+			logger.Error("Failed to maintain object pool", zap.String("pool", pool), zap.Error(err))
+			continue
+		}
+		logger.Debug("maintained object pool", zap.String("pool", pool), zap.Duration("elapsed", time.Since(start)))
+	}
+}
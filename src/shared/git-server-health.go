@@ -0,0 +1,223 @@
+package shared
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// GitServerHealthFileName is the file, within git_data_path, recording the health of the git
+// servers synced from. It is shared by every process that syncs repositories, so it survives
+// restarts and ngit-relay-khatru and ngit-relay-proactive-sync back off the same servers.
+const GitServerHealthFileName = "ngit-git-server-health.json"
+
+// gitServerHealthLockFileName is held while the health file is updated
+const gitServerHealthLockFileName = "ngit-git-server-health.lock"
+
+const (
+	gitServerBaseBackoff = time.Minute
+	gitServerMaxBackoff  = 6 * time.Hour
+)
+
+// GitServerHealth is the record of fetches from a git server, across every repository that
+// lists it
+type GitServerHealth struct {
+	Server              string        `json:"server"`
+	Successes           int           `json:"successes"`
+	Failures            int           `json:"failures"`
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	AverageLatency      time.Duration `json:"average_latency"`
+	LastError           string        `json:"last_error,omitempty"`
+	LastErrorAt         time.Time     `json:"last_error_at,omitempty"`
+	LastSuccessAt       time.Time     `json:"last_success_at,omitempty"`
+	BackoffUntil        time.Time     `json:"backoff_until,omitempty"`
+}
+
+// SuccessRate is the proportion of fetches that succeeded, 1 when there haven't been any
+func (h GitServerHealth) SuccessRate() float64 {
+	if h.Successes+h.Failures == 0 {
+		return 1
+	}
+	return float64(h.Successes) / float64(h.Successes+h.Failures)
+}
+
+// InBackoff reports whether the server has failed recently enough that it shouldn't be tried
+// while other servers are available
+func (h GitServerHealth) InBackoff() bool {
+	return time.Now().Before(h.BackoffUntil)
+}
+
+// gitServerKey groups repository urls by the server hosting them
+func gitServerKey(repo_url string) string {
+	u, err := url.Parse(repo_url)
+	if err != nil || u.Host == "" {
+		return repo_url
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// loadGitServerHealth reads the health of each git server, by gitServerKey, from
+// git_data_path. A missing file returns no records.
+func loadGitServerHealth(git_data_path string) (map[string]*GitServerHealth, error) {
+	servers := make(map[string]*GitServerHealth)
+	data, err := os.ReadFile(filepath.Join(git_data_path, GitServerHealthFileName))
+	if os.IsNotExist(err) {
+		return servers, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &servers); err != nil {
+		return nil, err
+	}
+	return servers, nil
+}
+
+// updateGitServerHealth applies update to the record of the server hosting repo_url while
+// holding the lock on the health file. Health is advisory so failures are ignored.
+func updateGitServerHealth(git_data_path string, repo_url string, update func(h *GitServerHealth)) {
+	lock, err := lockFile(context.Background(), filepath.Join(git_data_path, gitServerHealthLockFileName), "git server health", RepoLockTimeout())
+	if err != nil {
+		return
+	}
+	defer lock.Unlock()
+
+	servers, err := loadGitServerHealth(git_data_path)
+	if err != nil {
+		// start afresh rather than never record health again
+		servers = make(map[string]*GitServerHealth)
+	}
+	key := gitServerKey(repo_url)
+	h, exists := servers[key]
+	if !exists {
+		h = &GitServerHealth{Server: key}
+		servers[key] = h
+	}
+	update(h)
+
+	data, err := json.MarshalIndent(servers, "", "  ")
+	if err != nil {
+		return
+	}
+	WriteFileAtomic(filepath.Join(git_data_path, GitServerHealthFileName), data, 0644)
+}
+
+// RecordGitServerSuccess records a successful fetch from the server hosting repo_url
+func RecordGitServerSuccess(git_data_path string, repo_url string, latency time.Duration) {
+	updateGitServerHealth(git_data_path, repo_url, func(h *GitServerHealth) {
+		if h.AverageLatency == 0 {
+			h.AverageLatency = latency
+		} else {
+			// exponentially weighted so recent fetches count most
+			h.AverageLatency = (h.AverageLatency*4 + latency) / 5
+		}
+		h.Successes++
+		h.ConsecutiveFailures = 0
+		h.LastSuccessAt = time.Now()
+		h.BackoffUntil = time.Time{}
+	})
+}
+
+// RecordGitServerFailure records a failed fetch from the server hosting repo_url, backing
+// it off exponentially on consecutive failures
+func RecordGitServerFailure(git_data_path string, repo_url string, err error) {
+	updateGitServerHealth(git_data_path, repo_url, func(h *GitServerHealth) {
+		h.Failures++
+		h.ConsecutiveFailures++
+		h.LastError = err.Error()
+		h.LastErrorAt = time.Now()
+		backoff := gitServerMaxBackoff
+		if h.ConsecutiveFailures <= 20 {
+			backoff = min(gitServerBaseBackoff<<(h.ConsecutiveFailures-1), gitServerMaxBackoff)
+		}
+		h.BackoffUntil = time.Now().Add(backoff)
+	})
+}
+
+// git fetch output when the repository is missing or private, rather than the server down
+var repoLevelFetchErrors = []string{
+	"not found",
+	"404",
+	"401",
+	"403",
+	"authentication failed",
+	"could not read username",
+	"does not appear to be a git repository",
+	// objects requested by id that the server won't serve
+	"not our ref",
+	"unadvertised object",
+	"couldn't find remote ref",
+}
+
+// IsGitServerFailure reports whether a failed fetch indicates a problem with the server, eg.
+// it is unreachable or timed out, rather than with the repository on it
+func IsGitServerFailure(output string) bool {
+	output = strings.ToLower(output)
+	for _, msg := range repoLevelFetchErrors {
+		if strings.Contains(output, msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// GitServerHealthReport returns the health of every git server fetched from by any process
+// syncing repositories in git_data_path
+func GitServerHealthReport(git_data_path string) ([]GitServerHealth, error) {
+	servers, err := loadGitServerHealth(git_data_path)
+	if err != nil {
+		return nil, err
+	}
+	report := make([]GitServerHealth, 0, len(servers))
+	for _, h := range servers {
+		report = append(report, *h)
+	}
+	slices.SortFunc(report, func(a, b GitServerHealth) int { return cmp.Compare(a.Server, b.Server) })
+	return report, nil
+}
+
+// OrderGitServersByHealth orders repository urls so the most reliable and fastest servers
+// are tried first. Servers in backoff are skipped, unless every server is in backoff in which
+// case they are all tried, soonest out of backoff first.
+func OrderGitServersByHealth(git_data_path string, repo_urls []string) []string {
+	// without records every server is treated as healthy
+	servers, _ := loadGitServerHealth(git_data_path)
+
+	healthy := []string{}
+	backedOff := []string{}
+	health := make(map[string]GitServerHealth)
+	for _, repo_url := range repo_urls {
+		h := GitServerHealth{Server: gitServerKey(repo_url)}
+		if record, exists := servers[gitServerKey(repo_url)]; exists {
+			h = *record
+		}
+		health[repo_url] = h
+		if h.InBackoff() {
+			backedOff = append(backedOff, repo_url)
+		} else {
+			healthy = append(healthy, repo_url)
+		}
+	}
+
+	slices.SortStableFunc(healthy, func(a, b string) int {
+		ha, hb := health[a], health[b]
+		if c := cmp.Compare(hb.SuccessRate(), ha.SuccessRate()); c != 0 {
+			return c
+		}
+		return cmp.Compare(ha.AverageLatency, hb.AverageLatency)
+	})
+	if len(healthy) > 0 {
+		return healthy
+	}
+
+	slices.SortStableFunc(backedOff, func(a, b string) int {
+		return health[a].BackoffUntil.Compare(health[b].BackoffUntil)
+	})
+	return backedOff
+}
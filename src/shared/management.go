@@ -0,0 +1,103 @@
+package shared
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// ManagementFileName is the file, within git_data_path, where moderation decisions and
+// relay settings made by the owner via the NIP-86 relay management API are persisted. It
+// lives alongside the repositories so the git hooks can enforce it too.
+const ManagementFileName = "ngit-relay-management.json"
+
+type Management struct {
+	BannedPubkeys    map[string]string `json:"banned_pubkeys"`  // pubkey -> reason
+	AllowedPubkeys   map[string]string `json:"allowed_pubkeys"` // pubkey -> reason
+	BannedEvents     map[string]string `json:"banned_events"`   // event id -> reason
+	BlockedRepos     map[string]string `json:"blocked_repos"`   // repository coordinate -> reason
+	RelayName        string            `json:"relay_name,omitempty"`
+	RelayDescription string            `json:"relay_description,omitempty"`
+}
+
+func NewManagement() *Management {
+	return &Management{
+		BannedPubkeys:  make(map[string]string),
+		AllowedPubkeys: make(map[string]string),
+		BannedEvents:   make(map[string]string),
+		BlockedRepos:   make(map[string]string),
+	}
+}
+
+// LoadManagement reads the management file from git_data_path. A missing file returns an
+// empty Management.
+func LoadManagement(git_data_path string) (*Management, error) {
+	m := NewManagement()
+	data, err := os.ReadFile(filepath.Join(git_data_path, ManagementFileName))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	// maps missing from the file are unmarshalled as nil
+	if m.BannedPubkeys == nil {
+		m.BannedPubkeys = make(map[string]string)
+	}
+	if m.AllowedPubkeys == nil {
+		m.AllowedPubkeys = make(map[string]string)
+	}
+	if m.BannedEvents == nil {
+		m.BannedEvents = make(map[string]string)
+	}
+	if m.BlockedRepos == nil {
+		m.BlockedRepos = make(map[string]string)
+	}
+	return m, nil
+}
+
+// Save atomically writes the management file to git_data_path
+func (m *Management) Save(git_data_path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filepath.Join(git_data_path, ManagementFileName), data, 0644)
+}
+
+// IsRepoBlocked reports whether the owner has blocked the repository, or banned its author
+func (m *Management) IsRepoBlocked(pubkey string, identifier string) (bool, string) {
+	if reason, blocked := m.BlockedRepos[RepoCoordinate(pubkey, identifier)]; blocked {
+		return true, "repository blocked by relay owner: " + reason
+	}
+	if reason, banned := m.BannedPubkeys[pubkey]; banned {
+		return true, "pubkey banned by relay owner: " + reason
+	}
+	return false, ""
+}
+
+// WriteFileAtomic writes data to a temporary file and renames it over path so readers in
+// other processes never see a partially written file
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,38 @@
+package shared
+
+import "testing"
+
+func TestManagementSaveLoadAndIsRepoBlocked(t *testing.T) {
+	dir := t.TempDir()
+	pubkey := "a008def15796fba9a0d6fab04e8fd57089285d9fd505da5a83fe8aad57a3564d"
+
+	// missing file returns empty state
+	m, err := LoadManagement(dir)
+	if err != nil {
+		t.Fatalf("LoadManagement() on missing file returned an error: %v", err)
+	}
+	if blocked, _ := m.IsRepoBlocked(pubkey, "repo"); blocked {
+		t.Errorf("Expected repo not to be blocked in empty state")
+	}
+
+	m.BlockedRepos[RepoCoordinate(pubkey, "repo")] = "spam"
+	if err := m.Save(dir); err != nil {
+		t.Fatalf("Save() returned an error: %v", err)
+	}
+
+	loaded, err := LoadManagement(dir)
+	if err != nil {
+		t.Fatalf("LoadManagement() returned an error: %v", err)
+	}
+	if blocked, _ := loaded.IsRepoBlocked(pubkey, "repo"); !blocked {
+		t.Errorf("Expected repo to be blocked after reload")
+	}
+	if blocked, _ := loaded.IsRepoBlocked(pubkey, "other"); blocked {
+		t.Errorf("Expected other repo by same pubkey not to be blocked")
+	}
+
+	loaded.BannedPubkeys[pubkey] = "spammer"
+	if blocked, _ := loaded.IsRepoBlocked(pubkey, "other"); !blocked {
+		t.Errorf("Expected all repos of a banned pubkey to be blocked")
+	}
+}
@@ -0,0 +1,265 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// NostrRefKinds are the event kinds a refs/nostr/<event-id> ref can be pushed for
+var NostrRefKinds = []int{nostr.KindPatch, KindPullRequest, KindPullRequestUpdate}
+
+// PendingNostrRefsFileName is the file, within a repository, recording refs/nostr/ refs
+// pushed before their event reached the relay
+const PendingNostrRefsFileName = "ngit-pending-nostr-refs.json"
+
+// NostrRefGraceWindow is how long a refs/nostr/ ref pushed before its event is held for the
+// event to arrive, as clients push the git data just before publishing the PR. Anything can
+// be pushed to such a ref and served meanwhile, so it is kept short. Set with
+// NGIT_NOSTR_REF_GRACE_SECONDS.
+func NostrRefGraceWindow() time.Duration {
+	return time.Duration(getEnvInt("NGIT_NOSTR_REF_GRACE_SECONDS", 120)) * time.Second
+}
+
+// NostrRefEventID returns the event id of a refs/nostr/<event-id> ref
+func NostrRefEventID(ref string) (string, bool) {
+	if !strings.HasPrefix(ref, "refs/nostr/") {
+		return "", false
+	}
+	id := strings.TrimPrefix(ref, "refs/nostr/")
+	return id, nostr.IsValid32ByteHex(id)
+}
+
+// CheckNostrRefUpdate returns an error if the refs/nostr/<event-id> update isn't for the
+// stored PR, PR update or patch event, which must tag one of the repository coordinates and
+// have the pushed tip as its commit. event is nil when it hasn't reached the relay yet, in
+// which case the ref is permitted but should be recorded with RecordPendingNostrRefs.
+func CheckNostrRefUpdate(update RefUpdate, event *nostr.Event, coordinates []string) error {
+	if _, valid := NostrRefEventID(update.RefName); !valid {
+		return fmt.Errorf("refs/nostr/<event-id> must use a valid event id")
+	}
+	if update.NewRev == ZeroHash {
+		return fmt.Errorf("refs/nostr/ refs cannot be deleted over git")
+	}
+	if event == nil {
+		return nil
+	}
+	if !slices.Contains(NostrRefKinds, event.Kind) {
+		return fmt.Errorf("%s is not a PR, PR update or patch event", update.RefName)
+	}
+	tagsRepo := false
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "a" && slices.Contains(coordinates, tag[1]) {
+			tagsRepo = true
+			break
+		}
+	}
+	if !tagsRepo {
+		return fmt.Errorf("event for %s doesn't tag this repository", update.RefName)
+	}
+	tip := ""
+	if tag := event.Tags.Find("c"); tag != nil {
+		tip = tag[1]
+	} else if tag := event.Tags.Find("commit"); tag != nil {
+		tip = tag[1]
+	}
+	if tip == "" {
+		return fmt.Errorf("event for %s has no commit tag", update.RefName)
+	}
+	if tip != update.NewRev {
+		return fmt.Errorf("cannot push %s to %s as the nostr event is at %s", update.RefName, shortHash(update.NewRev), shortHash(tip))
+	}
+	return nil
+}
+
+// NostrRefEventIDs returns the event ids of the refs/nostr/<event-id> refs in updates
+func NostrRefEventIDs(updates []RefUpdate) []string {
+	ids := []string{}
+	for _, update := range updates {
+		if id, valid := NostrRefEventID(update.RefName); valid {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// CheckNostrRefUpdates checks each refs/nostr/ update against its event in events, returning
+// the errors keyed by ref name and the refs whose event hasn't arrived yet
+func CheckNostrRefUpdates(updates []RefUpdate, events []nostr.Event, coordinates []string) (rejected map[string]error, pending []string) {
+	rejected = make(map[string]error)
+	for _, update := range updates {
+		if !strings.HasPrefix(update.RefName, "refs/nostr/") {
+			continue
+		}
+		id, _ := NostrRefEventID(update.RefName)
+		var event *nostr.Event
+		for i := range events {
+			if events[i].ID == id {
+				event = &events[i]
+				break
+			}
+		}
+		if err := CheckNostrRefUpdate(update, event, coordinates); err != nil {
+			rejected[update.RefName] = err
+		} else if event == nil {
+			pending = append(pending, update.RefName)
+		}
+	}
+	return rejected, pending
+}
+
+// LoadPendingNostrRefs reads the refs/nostr/ refs pushed before their event arrived, with
+// the time each was pushed
+func LoadPendingNostrRefs(repo_path string) (map[string]time.Time, error) {
+	pending := make(map[string]time.Time)
+	data, err := os.ReadFile(filepath.Join(repo_path, PendingNostrRefsFileName))
+	if os.IsNotExist(err) {
+		return pending, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+func savePendingNostrRefs(repo_path string, pending map[string]time.Time) error {
+	path := filepath.Join(repo_path, PendingNostrRefsFileName)
+	if len(pending) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(pending, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data, 0644)
+}
+
+// RecordPendingNostrRefs records refs/nostr/ refs pushed before their event arrived so
+// SweepPendingNostrRefs can remove them if the event doesn't arrive in time
+func RecordPendingNostrRefs(repo_path string, refs []string) error {
+	if len(refs) == 0 {
+		return nil
+	}
+	pending, err := LoadPendingNostrRefs(repo_path)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		pending[ref] = time.Now()
+	}
+	return savePendingNostrRefs(repo_path, pending)
+}
+
+// SweepPendingNostrRefs checks each pending refs/nostr/ ref against its event, found with
+// lookup. Refs whose event has arrived and matches are kept. Refs whose event doesn't match,
+// or hasn't arrived within grace, are deleted and the objects only they referenced are
+// pruned straight away, rather than being served as unreachable objects until the next
+// prune.
+func SweepPendingNostrRefs(repo_path string, coordinates []string, lookup func(id string) *nostr.Event, grace time.Duration) (deleted []string, err error) {
+	pending, err := LoadPendingNostrRefs(repo_path)
+	if err != nil || len(pending) == 0 {
+		return nil, err
+	}
+
+	lock, err := LockRepo(context.Background(), repo_path, "sweep refs/nostr/")
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	// pending may have changed while waiting for the lock
+	if pending, err = LoadPendingNostrRefs(repo_path); err != nil {
+		return nil, err
+	}
+
+	var gitErrors []string
+	tips := []string{}
+	for ref, pushedAt := range pending {
+		id, _ := NostrRefEventID(ref)
+		event := lookup(id)
+		if event == nil && time.Since(pushedAt) < grace {
+			continue
+		}
+		delete(pending, ref)
+
+		output, err := exec.Command("git", "-C", repo_path, "rev-parse", "--verify", "--quiet", ref).Output()
+		if err != nil {
+			continue // push failed or ref already removed
+		}
+		update := RefUpdate{OldRev: ZeroHash, NewRev: strings.TrimSpace(string(output)), RefName: ref}
+		if event != nil && CheckNostrRefUpdate(update, event, coordinates) == nil {
+			continue
+		}
+		if output, err := exec.Command("git", "-C", repo_path, "update-ref", "-d", ref).CombinedOutput(); err != nil {
+			// try again at the next sweep
+			pending[ref] = pushedAt
+			gitErrors = append(gitErrors, fmt.Sprintf("failed to delete ref %s: %v, output: %s", ref, err, string(output)))
+			continue
+		}
+		deleted = append(deleted, ref)
+		tips = append(tips, update.NewRev)
+	}
+	if err := savePendingNostrRefs(repo_path, pending); err != nil {
+		return deleted, err
+	}
+	if err := pruneObjectsOnlyReachableFrom(repo_path, tips); err != nil {
+		gitErrors = append(gitErrors, err.Error())
+	}
+	if len(gitErrors) > 0 {
+		return deleted, fmt.Errorf("%s", strings.Join(gitErrors, "; "))
+	}
+	return deleted, nil
+}
+
+// pruneObjectsOnlyReachableFrom removes the objects reachable from tips and no ref. Loose
+// objects are deleted directly; if any are packed the repository is repacked without its
+// unreachable objects, which drops other unreachable objects too. The caller holds the
+// repository lock.
+func pruneObjectsOnlyReachableFrom(repo_path string, tips []string) error {
+	if len(tips) == 0 {
+		return nil
+	}
+	args := append([]string{"-C", repo_path, "rev-list", "--objects"}, tips...)
+	output, err := exec.Command("git", append(args, "--not", "--all")...).Output()
+	if err != nil {
+		return fmt.Errorf("failed to list objects of removed refs/nostr/ refs: %w", err)
+	}
+	packed := false
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		object, _, _ := strings.Cut(line, " ")
+		if !isObjectID(object) {
+			continue
+		}
+		err := os.Remove(filepath.Join(repo_path, "objects", object[:2], object[2:]))
+		if os.IsNotExist(err) {
+			packed = true
+		} else if err != nil {
+			return fmt.Errorf("failed to remove object %s: %w", object, err)
+		}
+	}
+	if !packed {
+		return nil
+	}
+	for _, args := range [][]string{
+		{"repack", "-a", "-d", "-l", "-q"},
+		{"prune", "--expire=now"},
+	} {
+		if output, err := exec.Command("git", append([]string{"-C", repo_path}, args...)...).CombinedOutput(); err != nil {
+			return fmt.Errorf("git %s: %w, output: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,392 @@
+package shared
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ObjectPoolsDirName is the directory within git_data_path holding the object pools shared
+// by repositories for the same project: [git_data_path]/pools/<earliest-unique-commit>.git
+//
+// Each member repository borrows the pool's objects via objects/info/alternates. The pool
+// fetches every member's refs into refs/members/<member>/ so everything a member references
+// stays reachable in the pool, and members then drop their copies of the pooled objects.
+const ObjectPoolsDirName = "pools"
+
+// objectPoolMembersFileName is the file, within a pool, listing its member repositories
+const objectPoolMembersFileName = "ngit-pool-members.json"
+
+// objectPoolMaintainersFileName is the file, within a pool, recording the maintainers each
+// member's announcement listed when it joined (member -> pubkeys)
+const objectPoolMaintainersFileName = "ngit-pool-maintainers.json"
+
+// ErrObjectPoolNotReady is returned by JoinObjectPool until the repository has its announced
+// earliest unique commit, eg. before its first push
+var ErrObjectPoolNotReady = errors.New("repository doesn't have its earliest unique commit yet")
+
+// ObjectPoolsEnabled reports whether repositories join object pools. Set with
+// NGIT_OBJECT_POOLS. Every member can serve the pool's objects by id, so pools aren't used
+// when NGIT_AUTH_TO_READ is enabled.
+func ObjectPoolsEnabled() bool {
+	return GetEnvBool("NGIT_OBJECT_POOLS", true) && !GetEnvBool("NGIT_AUTH_TO_READ", false)
+}
+
+// EarliestUniqueCommit returns the commit announced in the ["r", <commit>, "euc"] tag, which
+// forks and co-maintainers' copies of a project share
+func EarliestUniqueCommit(announcement nostr.Event) string {
+	for _, tag := range announcement.Tags {
+		if len(tag) >= 3 && tag[0] == "r" && tag[2] == "euc" && isObjectID(tag[1]) {
+			return strings.ToLower(tag[1])
+		}
+	}
+	return ""
+}
+
+func isObjectID(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// ObjectPoolPath returns the path of the pool for repositories with the earliest unique commit
+func ObjectPoolPath(git_data_path string, euc string) string {
+	return filepath.Join(git_data_path, ObjectPoolsDirName, euc+".git")
+}
+
+// ListObjectPools returns the path of every object pool in git_data_path
+func ListObjectPools(git_data_path string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(git_data_path, ObjectPoolsDirName))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pools := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasSuffix(entry.Name(), ".git") {
+			pools = append(pools, filepath.Join(git_data_path, ObjectPoolsDirName, entry.Name()))
+		}
+	}
+	return pools, nil
+}
+
+// ObjectPoolsOf returns the object pools a repository borrows objects from
+func ObjectPoolsOf(repo_path string) []string {
+	data, err := os.ReadFile(filepath.Join(repo_path, "objects", "info", "alternates"))
+	if err != nil {
+		return []string{}
+	}
+	pools := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			pools = append(pools, filepath.Dir(filepath.Clean(line)))
+		}
+	}
+	return pools
+}
+
+// JoinObjectPool makes a repository borrow objects from the pool for its earliest unique
+// commit, creating the pool if needed. A repository whose announced commit changes stays in
+// its previous pools too, so nothing it borrows is lost.
+//
+// Anyone can announce any earliest unique commit, and every member can serve the objects of
+// the others by id, so a repository only joins once it has the commit itself, and only a pool
+// whose members share maintainers with it: maintainers are the pubkeys the repository's
+// announcement lists, and the repository's owner must be listed by a member which it lists in
+// turn.
+func JoinObjectPool(repo_path string, euc string, maintainers []string) error {
+	if !isObjectID(euc) {
+		return fmt.Errorf("invalid earliest unique commit: %s", euc)
+	}
+	repo_path, err := filepath.Abs(repo_path)
+	if err != nil {
+		return err
+	}
+	pool_path := ObjectPoolPath(GitDataPathFromRepoPath(repo_path), euc)
+	if slices.Contains(ObjectPoolsOf(repo_path), pool_path) {
+		return nil
+	}
+	if err := exec.Command("git", "-c", "safe.directory="+repo_path, "-C", repo_path, "cat-file", "-e", euc+"^{commit}").Run(); err != nil {
+		return ErrObjectPoolNotReady
+	}
+	owner, _, _, err := GetPubKeyAndIdentifierFromPath(repo_path)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(maintainers, owner) {
+		maintainers = append(slices.Clone(maintainers), owner)
+	}
+
+	if _, err := os.Stat(pool_path); os.IsNotExist(err) {
+		if err := createObjectPool(pool_path); err != nil {
+			os.RemoveAll(pool_path)
+			return err
+		}
+	}
+
+	// pool before member, the same order as MaintainObjectPool
+	pool_lock, err := LockRepo(context.Background(), pool_path, "join")
+	if err != nil {
+		return err
+	}
+	defer pool_lock.Unlock()
+	repo_lock, err := LockRepo(context.Background(), repo_path, "join object pool")
+	if err != nil {
+		return err
+	}
+	defer repo_lock.Unlock()
+
+	// the pool records the member before it borrows anything, so the pool's gc always
+	// accounts for it
+	members, err := loadObjectPoolMembers(pool_path)
+	if err != nil {
+		return err
+	}
+	memberMaintainers, err := loadObjectPoolMaintainers(pool_path)
+	if err != nil {
+		return err
+	}
+	if !sharesMaintainers(members, memberMaintainers, owner, maintainers) {
+		return fmt.Errorf("not joining object pool %s as its members don't share maintainers with %s", pool_path, repo_path)
+	}
+	memberMaintainers[repo_path] = maintainers
+	if err := saveObjectPoolMaintainers(pool_path, memberMaintainers); err != nil {
+		return err
+	}
+	if !slices.Contains(members, repo_path) {
+		if err := saveObjectPoolMembers(pool_path, append(members, repo_path)); err != nil {
+			return err
+		}
+	}
+
+	alternates := filepath.Join(repo_path, "objects", "info", "alternates")
+	existing, err := os.ReadFile(alternates)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(existing) > 0 && !strings.HasSuffix(string(existing), "\n") {
+		existing = append(existing, '\n')
+	}
+	if err := os.MkdirAll(filepath.Dir(alternates), 0755); err != nil {
+		return err
+	}
+	return WriteFileAtomic(alternates, append(existing, []byte(filepath.Join(pool_path, "objects")+"\n")...), 0644)
+}
+
+// sharesMaintainers reports whether a repository owned by owner, whose announcement lists
+// maintainers, can join a pool. It can join an empty pool, or one with a member that it lists
+// and that lists it.
+func sharesMaintainers(members []string, memberMaintainers map[string][]string, owner string, maintainers []string) bool {
+	if len(members) == 0 {
+		return true
+	}
+	for _, member := range members {
+		memberOwner, _, _, err := GetPubKeyAndIdentifierFromPath(member)
+		if err != nil {
+			continue
+		}
+		if memberOwner == owner || (slices.Contains(maintainers, memberOwner) && slices.Contains(memberMaintainers[member], owner)) {
+			return true
+		}
+	}
+	return false
+}
+
+func createObjectPool(pool_path string) error {
+	if output, err := exec.Command("git", "init", "--bare", "--quiet", pool_path).CombinedOutput(); err != nil {
+		return fmt.Errorf("error initializing object pool: %w, output: %s", err, string(output))
+	}
+	for _, config := range [][]string{
+		// only MaintainObjectPool may gc a pool, once it has fetched every member's refs
+		{"gc.auto", "0"},
+		{"core.logAllRefUpdates", "false"},
+	} {
+		if output, err := exec.Command("git", "-C", pool_path, "config", config[0], config[1]).CombinedOutput(); err != nil {
+			return fmt.Errorf("error configuring object pool: %w, output: %s", err, string(output))
+		}
+	}
+	return ensureSafeDirectory(pool_path)
+}
+
+func loadObjectPoolMembers(pool_path string) ([]string, error) {
+	members := []string{}
+	data, err := os.ReadFile(filepath.Join(pool_path, objectPoolMembersFileName))
+	if os.IsNotExist(err) {
+		return members, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func saveObjectPoolMembers(pool_path string, members []string) error {
+	slices.Sort(members)
+	data, err := json.MarshalIndent(members, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filepath.Join(pool_path, objectPoolMembersFileName), data, 0644)
+}
+
+func loadObjectPoolMaintainers(pool_path string) (map[string][]string, error) {
+	maintainers := make(map[string][]string)
+	data, err := os.ReadFile(filepath.Join(pool_path, objectPoolMaintainersFileName))
+	if os.IsNotExist(err) {
+		return maintainers, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &maintainers); err != nil {
+		return nil, err
+	}
+	return maintainers, nil
+}
+
+func saveObjectPoolMaintainers(pool_path string, maintainers map[string][]string) error {
+	data, err := json.MarshalIndent(maintainers, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filepath.Join(pool_path, objectPoolMaintainersFileName), data, 0644)
+}
+
+// memberRefPrefix is where the pool keeps a copy of a member's refs
+func memberRefPrefix(pool_path string, repo_path string) string {
+	name, err := filepath.Rel(GitDataPathFromRepoPath(pool_path), repo_path)
+	if err != nil || exec.Command("git", "check-ref-format", "refs/members/"+name+"/HEAD").Run() != nil {
+		sum := sha256.Sum256([]byte(repo_path))
+		name = hex.EncodeToString(sum[:8])
+	}
+	return "refs/members/" + name + "/"
+}
+
+// MaintainObjectPool fetches every member's refs into the pool, garbage collects the pool,
+// pruning unreachable objects older than expire (eg. "2.weeks.ago"), and then removes the
+// objects members have copies of in the pool from the members.
+//
+// Each member is only locked while its refs are fetched into the pool and while it is
+// repacked, so pushes to members aren't held up by the pool's gc. An object a member starts
+// referencing after its refs were fetched is kept by the expire grace period until the next
+// run fetches it. Members that no longer exist, or no longer borrow from the pool, are
+// removed from it.
+func MaintainObjectPool(pool_path string, expire string) error {
+	if err := ensureSafeDirectory(pool_path); err != nil {
+		return err
+	}
+	pool_lock, err := LockRepo(context.Background(), pool_path, "gc")
+	if err != nil {
+		return err
+	}
+	defer pool_lock.Unlock()
+
+	members, err := loadObjectPoolMembers(pool_path)
+	if err != nil {
+		return err
+	}
+
+	current := []string{}
+	for _, repo_path := range members {
+		if _, err := os.Stat(repo_path); err == nil && slices.Contains(ObjectPoolsOf(repo_path), pool_path) {
+			current = append(current, repo_path)
+			continue
+		}
+		// the member's refs no longer need to keep objects in the pool
+		prefix := memberRefPrefix(pool_path, repo_path)
+		output, _ := exec.Command("git", "-C", pool_path, "for-each-ref", "--format=delete %(refname)", prefix).Output()
+		if len(output) > 0 {
+			if err := updateRefs(pool_path, strings.Split(strings.TrimSpace(string(output)), "\n")); err != nil {
+				return fmt.Errorf("failed to remove refs of former member %s: %w", repo_path, err)
+			}
+		}
+	}
+
+	for _, repo_path := range current {
+		if err := withRepoLock(repo_path, "object pool fetch", func() error {
+			return fetchIntoObjectPool(pool_path, repo_path)
+		}); err != nil {
+			return err
+		}
+	}
+	if err := saveObjectPoolMembers(pool_path, current); err != nil {
+		return err
+	}
+	if memberMaintainers, err := loadObjectPoolMaintainers(pool_path); err == nil {
+		for member := range memberMaintainers {
+			if !slices.Contains(current, member) {
+				delete(memberMaintainers, member)
+			}
+		}
+		if err := saveObjectPoolMaintainers(pool_path, memberMaintainers); err != nil {
+			return err
+		}
+	}
+
+	if output, err := exec.Command("git", "-C", pool_path, "gc", "--quiet", "--prune="+expire).CombinedOutput(); err != nil {
+		return fmt.Errorf("object pool gc failed: %w, output: %s", err, string(output))
+	}
+
+	var repackErrors []string
+	for _, repo_path := range current {
+		// -l leaves out objects in the pool. unreachable objects are left to the member's gc.
+		if err := withRepoLock(repo_path, "object pool repack", func() error {
+			cmd := exec.Command("git", "-C", repo_path, "repack", "-a", "-d", "-l", "--keep-unreachable", "-q")
+			if output, err := cmd.CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to repack %s: %v, output: %s", repo_path, err, string(output))
+			}
+			return nil
+		}); err != nil {
+			repackErrors = append(repackErrors, err.Error())
+		}
+	}
+	if len(repackErrors) > 0 {
+		return fmt.Errorf("%s", strings.Join(repackErrors, "; "))
+	}
+	return nil
+}
+
+// withRepoLock runs fn while holding the repository lock
+func withRepoLock(repo_path string, purpose string, fn func() error) error {
+	lock, err := LockRepo(context.Background(), repo_path, purpose)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return fn()
+}
+
+// fetchIntoObjectPool copies a member's refs, including hidden ones, into the pool along with
+// the objects they reference that the pool doesn't have
+func fetchIntoObjectPool(pool_path string, repo_path string) error {
+	if err := ensureSafeDirectory(repo_path); err != nil {
+		return err
+	}
+	prefix := memberRefPrefix(pool_path, repo_path)
+	upload_pack := "git -c transfer.hideRefs=!" + strings.TrimSuffix(RemovedRefsPrefix, "/") + " upload-pack"
+	cmd := exec.Command("git", "-C", pool_path,
+		"fetch", "--quiet", "--prune", "--no-tags", "--no-write-fetch-head", "--no-auto-gc",
+		"--upload-pack="+upload_pack, repo_path, "+refs/*:"+prefix+"*",
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to fetch %s into object pool: %w, output: %s", repo_path, err, string(output))
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package shared
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// testGit runs git in repo_path and returns its trimmed output
+func testGit(t *testing.T, repo_path string, stdin string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-C", repo_path}, args...)...)
+	cmd.Env = append(cmd.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	cmd.Stdin = strings.NewReader(stdin)
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %s: %v", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// testCommit commits a file with content onto parent (if any) and points ref at it
+func testCommit(t *testing.T, repo_path string, ref string, parent string, content string) string {
+	t.Helper()
+	blob := testGit(t, repo_path, content, "hash-object", "-w", "--stdin")
+	tree := testGit(t, repo_path, "100644 blob "+blob+"\tfile\n", "mktree")
+	args := []string{"commit-tree", tree, "-m", content}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	commit := testGit(t, repo_path, "", args...)
+	testGit(t, repo_path, "", "update-ref", ref, commit)
+	return commit
+}
+
+// testOwnerRepo creates an empty repository for a new owner in git_data_path
+func testOwnerRepo(t *testing.T, git_data_path string, identifier string) (string, string) {
+	t.Helper()
+	pubkey, err := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	npub, err := nip19.EncodePublicKey(pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo_path := filepath.Join(git_data_path, npub, identifier+".git")
+	if output, err := exec.Command("git", "init", "--bare", "--quiet", repo_path).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v, %s", err, output)
+	}
+	return repo_path, pubkey
+}
+
+func TestJoinObjectPool(t *testing.T) {
+	git_data_path := t.TempDir()
+	alice_repo, alice := testOwnerRepo(t, git_data_path, "project")
+	bob_repo, bob := testOwnerRepo(t, git_data_path, "project")
+	mallory_repo, _ := testOwnerRepo(t, git_data_path, "project")
+
+	euc := testCommit(t, alice_repo, "refs/heads/main", "", "first")
+	if err := JoinObjectPool(bob_repo, euc, []string{alice}); !errors.Is(err, ErrObjectPoolNotReady) {
+		t.Fatalf("JoinObjectPool() without the earliest unique commit error = %v, want ErrObjectPoolNotReady", err)
+	}
+	for _, repo_path := range []string{bob_repo, mallory_repo} {
+		testGit(t, repo_path, "", "fetch", "--quiet", alice_repo, "refs/heads/*:refs/heads/*")
+	}
+
+	pool_path := ObjectPoolPath(git_data_path, euc)
+	tests := []struct {
+		name        string
+		repo_path   string
+		maintainers []string
+		wantJoined  bool
+	}{
+		{"the first member creates the pool", alice_repo, []string{bob}, true},
+		{"a maintainer listed by a member, listing it in turn, joins", bob_repo, []string{alice}, true},
+		{"a repository listing a member that doesn't list it is refused", mallory_repo, []string{alice, bob}, false},
+	}
+	for _, test := range tests {
+		err := JoinObjectPool(test.repo_path, euc, test.maintainers)
+		if test.wantJoined && err != nil {
+			t.Errorf("%s: JoinObjectPool() error = %v", test.name, err)
+		}
+		if !test.wantJoined && err == nil {
+			t.Errorf("%s: JoinObjectPool() error = nil, want refused", test.name)
+		}
+		joined := len(ObjectPoolsOf(test.repo_path)) == 1 && ObjectPoolsOf(test.repo_path)[0] == pool_path
+		if joined != test.wantJoined {
+			t.Errorf("%s: joined = %v, want %v", test.name, joined, test.wantJoined)
+		}
+	}
+}
+
+func TestMaintainObjectPoolKeepsMemberObjects(t *testing.T) {
+	git_data_path := t.TempDir()
+	alice_repo, alice := testOwnerRepo(t, git_data_path, "project")
+	bob_repo, bob := testOwnerRepo(t, git_data_path, "project")
+
+	euc := testCommit(t, alice_repo, "refs/heads/main", "", "first")
+	testCommit(t, alice_repo, "refs/heads/main", euc, "second")
+	testGit(t, bob_repo, "", "fetch", "--quiet", alice_repo, "refs/heads/*:refs/heads/*")
+	// objects only bob references, including from a ref hidden from clients
+	testCommit(t, bob_repo, "refs/heads/feature", euc, "bob's feature")
+	testCommit(t, bob_repo, RemovedRefsPrefix+"refs/heads/old", euc, "bob's removed branch")
+
+	if err := JoinObjectPool(alice_repo, euc, []string{bob}); err != nil {
+		t.Fatalf("JoinObjectPool(alice) error = %v", err)
+	}
+	if err := JoinObjectPool(bob_repo, euc, []string{alice}); err != nil {
+		t.Fatalf("JoinObjectPool(bob) error = %v", err)
+	}
+	referenced := map[string]string{}
+	for _, repo_path := range []string{alice_repo, bob_repo} {
+		referenced[repo_path] = testGit(t, repo_path, "", "rev-list", "--objects", "--all")
+	}
+
+	pool_path := ObjectPoolPath(git_data_path, euc)
+	if err := MaintainObjectPool(pool_path, "now"); err != nil {
+		t.Fatalf("MaintainObjectPool() error = %v", err)
+	}
+	// alice moves main on after the pool fetched her refs
+	testCommit(t, alice_repo, "refs/heads/main", testGit(t, alice_repo, "", "rev-parse", "refs/heads/main"), "third")
+	referenced[alice_repo] = testGit(t, alice_repo, "", "rev-list", "--objects", "--all")
+	if err := MaintainObjectPool(pool_path, "now"); err != nil {
+		t.Fatalf("MaintainObjectPool() second run error = %v", err)
+	}
+
+	for _, repo_path := range []string{alice_repo, bob_repo} {
+		testGit(t, repo_path, "", "fsck", "--connectivity-only", "--no-dangling")
+		for _, line := range strings.Split(referenced[repo_path], "\n") {
+			object, _, _ := strings.Cut(line, " ")
+			testGit(t, repo_path, "", "cat-file", "-e", object)
+		}
+		// the shared history is only kept in the pool
+		indexes, _ := filepath.Glob(filepath.Join(repo_path, "objects", "pack", "*.idx"))
+		for _, index := range indexes {
+			data, err := os.ReadFile(index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(testGit(t, repo_path, string(data), "show-index"), euc) {
+				t.Errorf("%s kept its copy of the earliest unique commit", repo_path)
+			}
+		}
+	}
+	if output, err := exec.Command("git", "-C", pool_path, "cat-file", "-e", euc).CombinedOutput(); err != nil {
+		t.Errorf("pool lost the earliest unique commit: %v, %s", err, output)
+	}
+}
@@ -1,11 +1,15 @@
 package shared
 
 import (
+	"cmp"
 	"context"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nbd-wtf/go-nostr"
@@ -15,31 +19,48 @@ import (
 
 // align state with nostr state using other git servers listed in announcement event
 func ProactiveSyncGit(pubkey string, identifier string, git_data_path string) error {
+	state, gitServers, repo_path, err := getStateAndGitServers(pubkey, identifier, git_data_path)
+	if err != nil {
+		if repo_path != "" {
+			recordSyncStatus(repo_path, nil, nil, nil, err)
+		}
+		return err
+	}
+	// if len(gitServers) == 0 its still work proceeding to clean up state (delete branches)
+
+	return ProactiveSyncGitFromStateAndServers(state, gitServers, repo_path)
+
+}
+
+// getStateAndGitServers finds the maintainers' state and the git servers, other than this
+// instance, listed in their announcements
+func getStateAndGitServers(pubkey string, identifier string, git_data_path string) (state *nip34.RepositoryState, gitServers []string, repo_path string, err error) {
 	ctx := context.Background()
 
+	npub, err := nip19.EncodePublicKey(pubkey)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	repo_path = git_data_path + "/" + npub + "/" + identifier + ".git"
+
 	events, err := FetchAnnouncementAndStateEventsFromRelay(ctx, identifier)
 	if err != nil {
-		return err
+		return nil, nil, repo_path, err
 	}
 
 	maintainers := GetMaintainers(events, pubkey, identifier)
 	if len(maintainers) == 0 {
-		return fmt.Errorf("repo announcement event from pubkey not on internal relay")
+		return nil, nil, repo_path, fmt.Errorf("repo announcement event from pubkey not on internal relay")
 	}
 
-	state, err := GetStateFromMaintainers(events, maintainers)
+	state, err = GetStateFromMaintainers(events, maintainers)
 	if err != nil {
-		return err
+		return nil, nil, repo_path, err
 	}
 
-	npub, err := nip19.EncodePublicKey(pubkey)
-	if err != nil {
-		return err
-	}
-
-	gitServers := GetGitServersFromMaintainers(events, maintainers)
+	gitServers = GetGitServersFromMaintainers(events, maintainers)
 	if len(gitServers) == 0 {
-		return fmt.Errorf("repo announcement event(s) doesnt list any git servers")
+		return nil, nil, repo_path, fmt.Errorf("repo announcement event(s) doesnt list any git servers")
 	}
 	domain := getEnv("NGIT_DOMAIN", "")
 	if domain != "" {
@@ -59,12 +80,7 @@ func ProactiveSyncGit(pubkey string, identifier string, git_data_path string) er
 		// Update gitServers to the filtered list
 		gitServers = filteredGitServers
 	}
-	// if len(gitServers) == 0 its still work proceeding to clean up state (delete branches)
-
-	repo_path := git_data_path + "/" + npub + "/" + identifier + ".git"
-
-	return ProactiveSyncGitFromStateAndServers(state, gitServers, repo_path)
-
+	return state, gitServers, repo_path, nil
 }
 
 func GetGitServersFromMaintainers(events []nostr.Event, maintainers []string) []string {
@@ -97,171 +113,193 @@ func GetGitServersFromMaintainers(events []nostr.Event, maintainers []string) []
 	return gitServers
 }
 
-func ProactiveSyncGitFromStateAndServers(state *nip34.RepositoryState, gitServers []string, repo_path string) error {
+var safeDirectories = struct {
+	mu    sync.Mutex
+	added map[string]bool
+}{added: make(map[string]bool)}
+
+// ensureSafeDirectory adds repo_path to the global safe.directory list once per process.
+// Repositories are synced in parallel, and by several processes, and concurrent writes to the
+// global git config fail.
+func ensureSafeDirectory(repo_path string) error {
+	safeDirectories.mu.Lock()
+	defer safeDirectories.mu.Unlock()
+	if safeDirectories.added[repo_path] {
+		return nil
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		lock, err := lockFile(context.Background(), filepath.Join(home, ".gitconfig.ngit-relay.lock"), "safe.directory", RepoLockTimeout())
+		if err == nil {
+			defer lock.Unlock()
+		}
+	}
+	output, _ := exec.Command("git", "config", "--global", "--get-all", "safe.directory").Output()
+	if !slices.Contains(strings.Split(string(output), "\n"), repo_path) {
+		if err := exec.Command("git", "config", "--global", "--add", "safe.directory", repo_path).Run(); err != nil {
+			return err
+		}
+	}
+	safeDirectories.added[repo_path] = true
+	return nil
+}
+
+// ProactiveSyncGitFromStateAndServers aligns the repository with state, fetching missing
+// objects from gitServers. PlanProactiveSyncGitFromStateAndServers reports what it would do.
+func ProactiveSyncGitFromStateAndServers(state *nip34.RepositoryState, gitServers []string, repo_path string) (err error) {
 	// Use cmd and the installed git client
 	var gitErrors []string
 	missingRefs := make(map[string]bool)
+	serverErrors := make(map[string]string)
+	defer func() {
+		recordSyncStatus(repo_path, state, sortedKeys(missingRefs), serverErrors, err)
+	}()
 
 	// check we can open the directory
 	if _, err := os.Stat(repo_path); err != nil {
 		return fmt.Errorf("cannot open repo directory: %w", err)
 	}
+	lock, err := LockRepo(context.Background(), repo_path, "sync")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if lock != nil {
+			lock.Unlock()
+		}
+	}()
 
 	// Configure Git to accept the repository directory as safe
-	configCmd := exec.Command("git", "config", "--global", "--add", "safe.directory", repo_path)
-	if err := configCmd.Run(); err != nil {
+	if err := ensureSafeDirectory(repo_path); err != nil {
 		return fmt.Errorf("failed to set safe.directory: %w", err)
 	}
-
-	// Check repo_path is a git repository
-	cmd := exec.Command("git", "-C", repo_path, "rev-parse", "--git-dir")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("not a git repository at %s: %w\nOutput: %s", repo_path, err, string(output))
+	plan, err := planSync(state, gitServers, repo_path, false)
+	if err != nil {
+		return err
 	}
-
-	// Get local refs
-	cmd = exec.Command("git", "-C", repo_path, "show-ref", "--heads", "--tags")
-	output, err := cmd.Output()
-	localRefs := make(map[string]string)
-	// It's okay if this fails with exit status 1 (no refs found)
-	if err == nil || err.(*exec.ExitError).ExitCode() == 1 {
-		if output != nil {
-			lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-			for _, line := range lines {
-				if line == "" {
-					continue
-				}
-				parts := strings.SplitN(line, " ", 2)
-				if len(parts) == 2 {
-					hash := parts[0]
-					ref := parts[1]
-					localRefs[ref] = hash
-				}
-			}
+	stateRefs := StateRefs(state)
+
+	// Remove any refs that exist locally but aren't in state, keeping them under
+	// RemovedRefsPrefix in case the state event is wrong
+	if len(plan.Remove) > 0 {
+		removedRefs := make(map[string]string)
+		for _, change := range plan.Remove {
+			removedRefs[change.Ref] = change.From
 		}
-	} else {
-		return fmt.Errorf("error getting local refs: %w", err)
-	}
-
-	// Build the state refs map (excluding HEAD)
-	stateRefs := make(map[string]string)
-
-	// Add branches to stateRefs
-	for branch, hash := range state.Branches {
-		ref := "refs/heads/" + branch
-		stateRefs[ref] = hash
-	}
-
-	// Add tags to stateRefs
-	for tag, hash := range state.Tags {
-		// tag^{} is just a dereferenced version of the tag. we should ignore these
-		if !strings.HasSuffix(tag, "^{}") {
-			ref := "refs/tags/" + tag
-			stateRefs[ref] = hash
+		if err := removeRefs(repo_path, state.Event.ID, removedRefs); err != nil {
+			gitErrors = append(gitErrors, err.Error())
 		}
 	}
-
-	// Delete any refs that exist locally but aren't in state
-	for ref := range localRefs {
-		if _, exists := stateRefs[ref]; !exists {
-			cmd = exec.Command("git", "-C", repo_path, "update-ref", "-d", ref)
-			if output, err := cmd.CombinedOutput(); err != nil {
-				gitErrors = append(gitErrors, fmt.Sprintf("failed to delete ref %s: %v, output: %s", ref, err, string(output)))
-			}
-		}
+	if err := pruneRemovedRefs(repo_path, RemovedRefRetention()); err != nil {
+		gitErrors = append(gitErrors, err.Error())
+	}
+	if err := forgetRestoredRefs(repo_path, state); err != nil {
+		gitErrors = append(gitErrors, err.Error())
 	}
 
 	// Identify refs in nip34state that don't have local refs that match
-	for ref, hash := range stateRefs {
-		if localHash, exists := localRefs[ref]; !exists || localHash != hash {
-			missingRefs[ref] = true
-		}
+	for _, change := range append(append([]PlannedRefChange{}, plan.Update...), plan.Fetch...) {
+		missingRefs[change.Ref] = true
 	}
 
-	// Try each git server
-	for _, server := range gitServers {
-		if len(missingRefs) == 0 {
-			continue // no need to fetch any refs
-		}
-		if server == "" {
-			continue // Skip empty server URLs
-		}
-
-		remoteName := fmt.Sprintf("origin_%d", time.Now().UnixNano())
-
-		// Add remote
-		cmd = exec.Command("git", "-C", repo_path, "remote", "add", remoteName, server)
-		if output, err := cmd.CombinedOutput(); err != nil {
-			gitErrors = append(gitErrors, fmt.Sprintf("failed to add remote %s: %v, output: %s", server, err, string(output)))
-			continue
-		}
-
-		// Fetch refs with timeout
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		// Fetch all refs including orphaned tag commits
-		fetchCmd := exec.CommandContext(ctx, "git", "-C", repo_path, "fetch", remoteName, "--tags", "--force")
-		output, err := fetchCmd.CombinedOutput()
-		cancel() // Always cancel the context
-
+	// Point each missing ref whose object we have at its state hash. Local values are read
+	// afresh each time, with the lock held, as refs may be pushed while it is released for
+	// fetching.
+	updateMissingRefs := func() {
+		localRefs, err := localSyncedRefs(repo_path)
 		if err != nil {
-			gitErrors = append(gitErrors, fmt.Sprintf("failed to fetch from %s: %v, output: %s", server, err, string(output)))
-			// Clean up remote
-			exec.Command("git", "-C", repo_path, "remote", "remove", remoteName).Run()
-			continue
+			gitErrors = append(gitErrors, err.Error())
+			return
 		}
-
-		// Try to update each missing ref
 		for ref := range missingRefs {
 			hash := stateRefs[ref]
-
-			// Check if the hash exists in the remote
-			cmd = exec.Command("git", "-C", repo_path, "cat-file", "-e", hash)
-			if err := cmd.Run(); err != nil {
-				continue // Hash doesn't exist in this remote
+			if localRefs[ref] == hash {
+				// eg. pushed while the lock was released
+				delete(missingRefs, ref)
+				continue
 			}
-
-			// Update the ref
-			cmd = exec.Command("git", "-C", repo_path, "update-ref", ref, hash)
+			if !hasObject(repo_path, hash) {
+				continue
+			}
+			cmd := exec.Command("git", "-C", repo_path, "update-ref", ref, hash, cmp.Or(localRefs[ref], ZeroHash))
 			if output, err := cmd.CombinedOutput(); err != nil {
 				gitErrors = append(gitErrors, fmt.Sprintf("failed to update ref %s to %s: %v, output: %s", ref, hash, err, string(output)))
 				continue
 			}
-
 			// Ref is now synced, remove from missing
 			delete(missingRefs, ref)
 		}
+	}
+	// eg. refs deleted locally but still in state, or pushed by a client but not yet updated
+	updateMissingRefs()
 
-		// Clean up remote
-		exec.Command("git", "-C", repo_path, "remote", "remove", remoteName).Run()
-
-		// If all refs are synced, we're done
+	// Try each git server, most reliable first
+	for _, server := range plan.Servers {
 		if len(missingRefs) == 0 {
-			break
+			break // no need to fetch any refs
 		}
-	}
 
-	// Handle HEAD after all other refs are synced
-	if state.HEAD != "" {
-		targetRef := "refs/heads/" + state.HEAD
-		if strings.HasPrefix(state.HEAD, "refs/") {
-			targetRef = state.HEAD
+		wants := []string{}
+		refs := []string{}
+		for ref := range missingRefs {
+			wants = append(wants, stateRefs[ref])
+			refs = append(refs, ref)
 		}
-
-		// Check if target ref exists and update HEAD
-		if _, exists := stateRefs[targetRef]; exists {
-			cmd = exec.Command("git", "-C", repo_path, "symbolic-ref", "HEAD", targetRef)
-			if output, err := cmd.CombinedOutput(); err != nil {
-				gitErrors = append(gitErrors, fmt.Sprintf("failed to update HEAD to %s: %v, output: %s", targetRef, err, string(output)))
+		slices.Sort(refs)
+
+		// fetching only adds objects, so pushes needn't wait for it
+		lock.Unlock()
+		lock = nil
+
+		fetchStart := time.Now()
+		output, fetchErr := fetchObjects(repo_path, server, wants)
+		serverFailed := fetchErr != nil && IsGitServerFailure(string(output))
+		refErrors := []string{}
+		if fetchErr != nil && !serverFailed {
+			// the server refused to serve some objects by id, or doesn't have them, so fall
+			// back to fetching each ref individually
+			for _, ref := range refs {
+				refOutput, refErr := fetchObjects(repo_path, server, []string{ref})
+				if refErr == nil {
+					continue
+				}
+				if IsGitServerFailure(string(refOutput)) {
+					serverFailed, fetchErr, output = true, refErr, refOutput
+					break
+				}
+				refErrors = append(refErrors, fmt.Sprintf("%s: %v, output: %s", ref, refErr, strings.TrimSpace(string(refOutput))))
 			}
 		}
+		if lock, err = LockRepo(context.Background(), repo_path, "sync"); err != nil {
+			return err
+		}
+		// whatever was fetched before any failure can still be used
+		updateMissingRefs()
+
+		if serverFailed {
+			RecordGitServerFailure(GitDataPathFromRepoPath(repo_path), server, fetchErr)
+			gitErrors = append(gitErrors, fmt.Sprintf("failed to fetch from %s: %v, output: %s", server, fetchErr, string(output)))
+			serverErrors[server] = fmt.Sprintf("%v: %s", fetchErr, strings.TrimSpace(string(output)))
+			continue
+		}
+		// the server responded, even if it didn't have every ref
+		RecordGitServerSuccess(GitDataPathFromRepoPath(repo_path), server, time.Since(fetchStart))
+		if len(refErrors) > 0 {
+			gitErrors = append(gitErrors, fmt.Sprintf("failed to fetch refs from %s: %s", server, strings.Join(refErrors, "; ")))
+			serverErrors[server] = strings.Join(refErrors, "; ")
+		}
+	}
+
+	// Handle HEAD after all other refs are synced
+	if plan.HEAD != nil {
+		cmd := exec.Command("git", "-C", repo_path, "symbolic-ref", "HEAD", plan.HEAD.To)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			gitErrors = append(gitErrors, fmt.Sprintf("failed to update HEAD to %s: %v, output: %s", plan.HEAD.To, err, string(output)))
+		}
 	}
 
 	// Return error if there are still missing refs
 	if len(missingRefs) > 0 {
-		missingRefsList := make([]string, 0, len(missingRefs))
-		for ref := range missingRefs {
-			missingRefsList = append(missingRefsList, ref)
-		}
+		missingRefsList := sortedKeys(missingRefs)
 
 		return fmt.Errorf("failed to sync repository: git errors: %v, missing refs: %v",
 			strings.Join(gitErrors, "; "),
@@ -276,6 +314,31 @@ func ProactiveSyncGitFromStateAndServers(state *nip34.RepositoryState, gitServer
 	return nil
 }
 
+// fetchObjects fetches the objects for wants, which are object ids or ref names, directly from
+// the repository url without adding a remote or updating any refs
+func fetchObjects(repo_path string, repo_url string, wants []string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	args := append([]string{
+		"-C", repo_path, "-c", "protocol.version=2",
+		"fetch", "--no-tags", "--no-write-fetch-head", "--no-auto-gc", "--quiet", repo_url,
+	}, wants...)
+	return exec.CommandContext(ctx, "git", args...).CombinedOutput()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func hasObject(repo_path string, hash string) bool {
+	return repoGit(repo_path, "cat-file", "-e", hash).Run() == nil
+}
+
 // updateState updates the git repository state based on the latest nostr state events.
 // It fetches relevant events, identifies maintainers, determines the current state,
 // and then calls ProactiveSyncGitFromStateAndServers to synchronize the local git repository.
@@ -0,0 +1,88 @@
+package shared
+
+import (
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip34"
+)
+
+// NIP-34 kinds not yet defined in go-nostr
+const (
+	KindPullRequest       int = 1618
+	KindPullRequestUpdate int = 1619
+)
+
+// RepoDiscussionKinds are the NIP-34 event kinds that tag a repository `a` coordinate
+// and make up the conversation around a repository.
+var RepoDiscussionKinds = []int{
+	nostr.KindPatch,
+	KindPullRequest,
+	KindPullRequestUpdate,
+	nostr.KindIssue,
+	nostr.KindReply,
+	nostr.KindComment,
+	nostr.KindStatusOpen,
+	nostr.KindStatusApplied,
+	nostr.KindStatusClosed,
+	nostr.KindStatusDraft,
+}
+
+// RepoReplyKinds are the event kinds used to reply to, or set the status of, patches,
+// PRs and issues. They reference the root event by id and may not tag the repository.
+var RepoReplyKinds = []int{
+	nostr.KindTextNote,
+	nostr.KindReply,
+	nostr.KindComment,
+	nostr.KindStatusOpen,
+	nostr.KindStatusApplied,
+	nostr.KindStatusClosed,
+	nostr.KindStatusDraft,
+}
+
+// GetRelaysFromMaintainers returns the unique relays listed in the announcement events of
+// the maintainers
+func GetRelaysFromMaintainers(events []nostr.Event, maintainers []string) []string {
+	relays := []string{}
+
+	for _, maintainer := range maintainers {
+		for _, event := range events {
+			if event.Kind != nostr.KindRepositoryAnnouncement || event.PubKey != maintainer {
+				continue
+			}
+			for _, relay := range nip34.ParseRepository(event).Relays {
+				relay = nostr.NormalizeURL(relay)
+				if relay == "" || contains(relays, relay) {
+					continue
+				}
+				relays = append(relays, relay)
+			}
+		}
+	}
+
+	return relays
+}
+
+// GetRepoCoordinates returns the `a` tag coordinate of each maintainer's announcement
+// for the repository identifier
+func GetRepoCoordinates(maintainers []string, identifier string) []string {
+	coordinates := make([]string, 0, len(maintainers))
+	for _, maintainer := range maintainers {
+		coordinates = append(coordinates, RepoCoordinate(maintainer, identifier))
+	}
+	return coordinates
+}
+
+// RepoCoordinate returns the `a` tag coordinate of a repository announcement
+func RepoCoordinate(pubkey string, identifier string) string {
+	return fmt.Sprintf("%d:%s:%s", nostr.KindRepositoryAnnouncement, pubkey, identifier)
+}
+
+func contains(slice []string, item string) bool {
+	for _, s := range slice {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
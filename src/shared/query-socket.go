@@ -0,0 +1,79 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DefaultQuerySocketPath is where ngit-relay-khatru listens for local queries from the git
+// hooks and proactive sync, unless NGIT_QUERY_SOCKET is set. An empty NGIT_QUERY_SOCKET
+// disables the socket.
+const DefaultQuerySocketPath = "/tmp/ngit-relay-query.sock"
+
+// QuerySocketEventsPath returns the announcement and state events for the `identifier`
+// query parameter, or the identifier within the `coordinate` query parameter, or the events
+// with the ids in the repeatable `id` query parameter
+const QuerySocketEventsPath = "/events"
+
+// DefaultInternalRelayURL is used to query ngit-relay-khatru when the query socket is not
+// available, unless NGIT_INTERNAL_RELAY_URL is set
+const DefaultInternalRelayURL = "ws://localhost:3334"
+
+func QuerySocketPath() string {
+	return getEnv("NGIT_QUERY_SOCKET", DefaultQuerySocketPath)
+}
+
+func InternalRelayURL() string {
+	if relayURL := getEnv("NGIT_INTERNAL_RELAY_URL", ""); relayURL != "" {
+		return relayURL
+	}
+	return DefaultInternalRelayURL
+}
+
+// FetchAnnouncementAndStateEventsFromSocket queries ngit-relay-khatru over its unix-domain
+// query socket, avoiding a websocket handshake
+func FetchAnnouncementAndStateEventsFromSocket(ctx context.Context, socket_path string, identifier string) ([]nostr.Event, error) {
+	return fetchEventsFromSocket(ctx, socket_path, url.Values{"identifier": []string{identifier}})
+}
+
+// FetchEventsByIDFromSocket queries ngit-relay-khatru over its unix-domain query socket for
+// the events with ids
+func FetchEventsByIDFromSocket(ctx context.Context, socket_path string, ids []string) ([]nostr.Event, error) {
+	return fetchEventsFromSocket(ctx, socket_path, url.Values{"id": ids})
+}
+
+func fetchEventsFromSocket(ctx context.Context, socket_path string, query url.Values) ([]nostr.Event, error) {
+	client := http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket_path)
+			},
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://unix"+QuerySocketEventsPath+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not query internal relay socket: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("internal relay socket returned %s", resp.Status)
+	}
+	var events []nostr.Event
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+		return nil, fmt.Errorf("invalid response from internal relay socket: %w", err)
+	}
+	return events, nil
+}
@@ -0,0 +1,180 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip34"
+)
+
+// RefUpdate is a ref update requested by a git push
+type RefUpdate struct {
+	OldRev  string
+	NewRev  string
+	RefName string
+}
+
+// ParseRefUpdate parses a "<old-rev> <new-rev> <ref-name>" line, as received by the
+// pre-receive hook and in the commands of a receive-pack request
+func ParseRefUpdate(line string) (RefUpdate, error) {
+	parts := strings.Fields(line)
+	if len(parts) != 3 {
+		return RefUpdate{}, fmt.Errorf("invalid ref update: %s", line)
+	}
+	return RefUpdate{OldRev: parts[0], NewRev: parts[1], RefName: parts[2]}, nil
+}
+
+// CheckRefUpdate returns an error if the ref update is not permitted by the latest state
+// event. state is nil when no state event is available, in which case only refs/nostr/
+// refs are permitted. refs/nostr/ refs must also be checked against their event with
+// CheckNostrRefUpdates.
+func CheckRefUpdate(update RefUpdate, state *nip34.RepositoryState) error {
+	if strings.HasPrefix(update.RefName, "refs/nostr/") {
+		if nostr.IsValid32ByteHex(strings.TrimPrefix(update.RefName, "refs/nostr/")) {
+			return nil
+		}
+		return fmt.Errorf("refs/nostr/<event-id> must use a valid event id")
+	}
+
+	if state == nil {
+		return fmt.Errorf("state event not on internal relay, cannot validate non-nostr refs")
+	}
+
+	if strings.HasPrefix(update.RefName, "refs/heads/pr/") {
+		return fmt.Errorf("'pr/*' branches should be sent over nostr, not through the git server")
+	}
+
+	if _, err := MatchesStateEvent(update.RefName, update.NewRev, update.OldRev, state); err != nil {
+		return err
+	}
+	return nil
+}
+
+// CheckRefUpdates returns the error for each update not permitted by state, keyed by ref name
+func CheckRefUpdates(updates []RefUpdate, state *nip34.RepositoryState) map[string]error {
+	rejected := make(map[string]error)
+	for _, update := range updates {
+		if err := CheckRefUpdate(update, state); err != nil {
+			rejected[update.RefName] = err
+		}
+	}
+	return rejected
+}
+
+// StateGraceWindow is how long a push that doesn't match the latest state event waits for a
+// newer one, as clients often push git data just before the relay receives the state event.
+// Set with NGIT_STATE_GRACE_SECONDS, 0 disables waiting.
+func StateGraceWindow() time.Duration {
+	return time.Duration(getEnvInt("NGIT_STATE_GRACE_SECONDS", 30)) * time.Second
+}
+
+// WaitForMatchingState re-evaluates rejected updates each time a newer state event arrives
+// on states, until every update is permitted, the window expires or states is closed.
+// states should only carry state events from the repository maintainers, a nil states skips
+// waiting. progress is called with messages to show the pusher while waiting.
+func WaitForMatchingState(ctx context.Context, updates []RefUpdate, state *nip34.RepositoryState, states <-chan nostr.Event, window time.Duration, progress func(msg string)) (*nip34.RepositoryState, map[string]error) {
+	rejected := CheckRefUpdates(updates, state)
+	if len(rejected) == 0 || states == nil || window <= 0 || !stateCouldPermit(rejected) {
+		return state, rejected
+	}
+
+	progress(fmt.Sprintf("waiting up to %s for a nostr state event matching %d ref(s)", window, len(rejected)))
+	deadline := time.NewTimer(window)
+	defer deadline.Stop()
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	started := time.Now()
+
+	for {
+		select {
+		case event, ok := <-states:
+			if !ok {
+				return state, rejected
+			}
+			if state != nil && event.CreatedAt <= state.CreatedAt {
+				continue
+			}
+			newState := nip34.ParseRepositoryState(event)
+			state = &newState
+			rejected = CheckRefUpdates(updates, state)
+			if len(rejected) == 0 {
+				progress("received matching nostr state event")
+				return state, rejected
+			}
+			progress(fmt.Sprintf("received nostr state event but %d ref(s) still don't match", len(rejected)))
+		case <-ticker.C:
+			progress(fmt.Sprintf("still waiting for nostr state event (%ds left)", int((window - time.Since(started)).Seconds())))
+		case <-deadline.C:
+			progress("no matching nostr state event received")
+			return state, rejected
+		case <-ctx.Done():
+			return state, rejected
+		}
+	}
+}
+
+// stateCouldPermit reports whether a newer state event could permit any of the rejected refs
+func stateCouldPermit(rejected map[string]error) bool {
+	for ref := range rejected {
+		if !strings.HasPrefix(ref, "refs/nostr/") && !strings.HasPrefix(ref, "refs/heads/pr/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ZeroHash is the old-rev of a ref being created, and the new-rev of a ref being deleted
+const ZeroHash = "0000000000000000000000000000000000000000"
+
+// StateRefs returns every ref in the state event by full ref name, including namespaces
+// other than refs/heads/ and refs/tags/ such as refs/notes/. Peeled tags (tag^{}) are left
+// out as they are just the dereferenced version of the tag.
+func StateRefs(state *nip34.RepositoryState) map[string]string {
+	refs := make(map[string]string)
+	for _, tag := range state.Event.Tags {
+		if len(tag) < 2 || !strings.HasPrefix(tag[0], "refs/") || strings.HasSuffix(tag[0], "^{}") {
+			continue
+		}
+		refs[tag[0]] = tag[1]
+	}
+	// state events parsed without the underlying event
+	for branch, commitId := range state.Branches {
+		refs["refs/heads/"+branch] = commitId
+	}
+	for tag, commitId := range state.Tags {
+		if !strings.HasSuffix(tag, "^{}") {
+			refs["refs/tags/"+tag] = commitId
+		}
+	}
+	return refs
+}
+
+// MatchesStateEvent checks a ref update against the refs in the state event. Deleting a ref
+// is permitted once it has been removed from the state event.
+func MatchesStateEvent(ref string, to string, oldRev string, state *nip34.RepositoryState) (bool, error) {
+	name := strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/tags/")
+	commitId, exists := StateRefs(state)[ref]
+	if to == ZeroHash {
+		if exists {
+			return false, fmt.Errorf("cannot delete %s as it is in our latest nostr state event at %s", name, shortHash(commitId))
+		}
+		return true, nil
+	}
+	if !exists {
+		return false, fmt.Errorf("%s not found in our latest nostr state event", ref)
+	}
+	if to != commitId {
+		return false, fmt.Errorf("cannot push %s to %s as nostr state event is at %s", name, shortHash(to), shortHash(commitId))
+	}
+	return true, nil
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 7 {
+		return hash[:7]
+	}
+	return hash
+}
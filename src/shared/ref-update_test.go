@@ -0,0 +1,119 @@
+package shared
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip34"
+)
+
+func TestCheckRefUpdate(t *testing.T) {
+	main := strings.Repeat("a", 40)
+	notes := strings.Repeat("b", 40)
+	other := strings.Repeat("c", 40)
+	state := nip34.ParseRepositoryState(nostr.Event{
+		Kind: nostr.KindRepositoryState,
+		Tags: nostr.Tags{
+			{"d", "repo"},
+			{"HEAD", "ref: refs/heads/main"},
+			{"refs/heads/main", main},
+			{"refs/tags/v1", main},
+			{"refs/notes/commits", notes},
+		},
+	})
+
+	tests := []struct {
+		name    string
+		update  RefUpdate
+		state   *nip34.RepositoryState
+		allowed bool
+	}{
+		{"branch matches", RefUpdate{ZeroHash, main, "refs/heads/main"}, &state, true},
+		{"branch mismatch", RefUpdate{ZeroHash, other, "refs/heads/main"}, &state, false},
+		{"tag matches", RefUpdate{ZeroHash, main, "refs/tags/v1"}, &state, true},
+		{"other namespace matches", RefUpdate{ZeroHash, notes, "refs/notes/commits"}, &state, true},
+		{"other namespace mismatch", RefUpdate{ZeroHash, other, "refs/notes/commits"}, &state, false},
+		{"ref not in state", RefUpdate{ZeroHash, other, "refs/heads/feature"}, &state, false},
+		{"delete ref not in state", RefUpdate{other, ZeroHash, "refs/heads/feature"}, &state, true},
+		{"delete ref in state", RefUpdate{main, ZeroHash, "refs/heads/main"}, &state, false},
+		{"pr branch", RefUpdate{ZeroHash, other, "refs/heads/pr/feature"}, &state, false},
+		{"nostr ref without state", RefUpdate{ZeroHash, other, "refs/nostr/" + strings.Repeat("d", 64)}, nil, true},
+		{"invalid nostr ref", RefUpdate{ZeroHash, other, "refs/nostr/feature"}, &state, false},
+		{"branch without state", RefUpdate{ZeroHash, main, "refs/heads/main"}, nil, false},
+	}
+
+	for _, test := range tests {
+		err := CheckRefUpdate(test.update, test.state)
+		if (err == nil) != test.allowed {
+			t.Errorf("%s: CheckRefUpdate() error = %v, want allowed %v", test.name, err, test.allowed)
+		}
+	}
+}
+
+func TestCheckNostrRefUpdate(t *testing.T) {
+	tip := strings.Repeat("a", 40)
+	other := strings.Repeat("b", 40)
+	coordinate := RepoCoordinate(strings.Repeat("1", 64), "repo")
+	pr := nostr.Event{ID: strings.Repeat("d", 64), Kind: KindPullRequest, Tags: nostr.Tags{{"a", coordinate}, {"c", tip}}}
+	patch := nostr.Event{ID: strings.Repeat("e", 64), Kind: nostr.KindPatch, Tags: nostr.Tags{{"a", coordinate}, {"commit", tip}}}
+	otherRepo := nostr.Event{ID: strings.Repeat("f", 64), Kind: KindPullRequest, Tags: nostr.Tags{{"a", RepoCoordinate(strings.Repeat("2", 64), "repo")}, {"c", tip}}}
+	issue := nostr.Event{ID: strings.Repeat("9", 64), Kind: nostr.KindIssue, Tags: nostr.Tags{{"a", coordinate}}}
+
+	tests := []struct {
+		name    string
+		update  RefUpdate
+		event   *nostr.Event
+		allowed bool
+	}{
+		{"pr matches", RefUpdate{ZeroHash, tip, "refs/nostr/" + pr.ID}, &pr, true},
+		{"pr tip mismatch", RefUpdate{ZeroHash, other, "refs/nostr/" + pr.ID}, &pr, false},
+		{"patch matches", RefUpdate{ZeroHash, tip, "refs/nostr/" + patch.ID}, &patch, true},
+		{"pr for another repo", RefUpdate{ZeroHash, tip, "refs/nostr/" + otherRepo.ID}, &otherRepo, false},
+		{"not a pr", RefUpdate{ZeroHash, tip, "refs/nostr/" + issue.ID}, &issue, false},
+		{"event not arrived", RefUpdate{ZeroHash, tip, "refs/nostr/" + strings.Repeat("8", 64)}, nil, true},
+		{"delete", RefUpdate{tip, ZeroHash, "refs/nostr/" + pr.ID}, &pr, false},
+	}
+
+	for _, test := range tests {
+		err := CheckNostrRefUpdate(test.update, test.event, []string{coordinate})
+		if (err == nil) != test.allowed {
+			t.Errorf("%s: CheckNostrRefUpdate() error = %v, want allowed %v", test.name, err, test.allowed)
+		}
+	}
+}
+
+func TestSweepPendingNostrRefsPrunesObjects(t *testing.T) {
+	repo_path := filepath.Join(t.TempDir(), "repo.git")
+	if output, err := exec.Command("git", "init", "--bare", "--quiet", repo_path).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v, %s", err, output)
+	}
+	main := testCommit(t, repo_path, "refs/heads/main", "", "main")
+	// one pushed as a pack, one as loose objects, before events which never arrive
+	packed_ref := "refs/nostr/" + strings.Repeat("7", 64)
+	packed := testCommit(t, repo_path, packed_ref, main, "packed")
+	testGit(t, repo_path, "", "repack", "-a", "-d", "-q")
+	loose_ref := "refs/nostr/" + strings.Repeat("8", 64)
+	loose := testCommit(t, repo_path, loose_ref, main, "loose")
+
+	if err := RecordPendingNostrRefs(repo_path, []string{packed_ref, loose_ref}); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := SweepPendingNostrRefs(repo_path, nil, func(id string) *nostr.Event { return nil }, 0)
+	if err != nil {
+		t.Fatalf("SweepPendingNostrRefs() error = %v", err)
+	}
+	if len(deleted) != 2 {
+		t.Fatalf("SweepPendingNostrRefs() deleted %v, want both refs", deleted)
+	}
+	for _, object := range []string{loose, packed} {
+		if exec.Command("git", "-C", repo_path, "cat-file", "-e", object).Run() == nil {
+			t.Errorf("object %s of a swept ref is still served", object)
+		}
+	}
+	if exec.Command("git", "-C", repo_path, "cat-file", "-e", main).Run() != nil {
+		t.Errorf("object %s still referenced by main was pruned", main)
+	}
+}
@@ -0,0 +1,375 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr/nip34"
+)
+
+// RemovedRefsPrefix is the hidden namespace refs removed by a sync are moved to, as
+// refs/ngit-removed/<unix-timestamp>.<nanoseconds>/heads/main, so a bad state event can be
+// undone
+const RemovedRefsPrefix = "refs/ngit-removed/"
+
+// PendingRefDeletionFileName is the file, within a repository, recording a removal of more
+// refs than RefDeletionThreshold that is waiting for the owner to confirm it
+const PendingRefDeletionFileName = "ngit-pending-ref-deletion.json"
+
+// RemovedRefRetention is how long removed refs are kept before being deleted, 0 to keep
+// them forever. Set with NGIT_REMOVED_REF_RETENTION_DAYS.
+func RemovedRefRetention() time.Duration {
+	return time.Duration(getEnvInt("NGIT_REMOVED_REF_RETENTION_DAYS", 30)) * 24 * time.Hour
+}
+
+// RefDeletionThreshold is the most refs a single sync removes without the owner confirming,
+// 0 for no limit. Set with NGIT_REF_DELETION_THRESHOLD.
+func RefDeletionThreshold() int {
+	return getEnvInt("NGIT_REF_DELETION_THRESHOLD", 0)
+}
+
+// RestoredRefsFileName is the file, within a repository, recording when the owner restored
+// removed refs, so syncs don't remove them again until there's a newer state event
+const RestoredRefsFileName = "ngit-restored-refs.json"
+
+type RemovedRef struct {
+	Ref       string    `json:"ref"`
+	Hash      string    `json:"hash"`
+	RemovedAt time.Time `json:"removed_at"`
+	// QuarantineRef is where the ref is kept, under RemovedRefsPrefix
+	QuarantineRef string `json:"quarantine_ref"`
+}
+
+type PendingRefDeletion struct {
+	StateEventID string            `json:"state_event_id"`
+	Refs         map[string]string `json:"refs"` // ref -> hash
+	DetectedAt   time.Time         `json:"detected_at"`
+	Confirmed    bool              `json:"confirmed"`
+}
+
+// quarantineRef returns the ref under RemovedRefsPrefix that ref is moved to. The removal time
+// includes nanoseconds so removing a ref again within the same second doesn't clash.
+func quarantineRef(ref string, removedAt time.Time) string {
+	return RemovedRefsPrefix + fmt.Sprintf("%d.%09d", removedAt.Unix(), removedAt.Nanosecond()) + "/" + strings.TrimPrefix(ref, "refs/")
+}
+
+// parseQuarantineStamp parses the removal time of a quarantine ref, with or without the
+// nanoseconds added later
+func parseQuarantineStamp(stamp string) (time.Time, error) {
+	seconds, nanoseconds, _ := strings.Cut(stamp, ".")
+	s, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var ns int64
+	if nanoseconds != "" {
+		if ns, err = strconv.ParseInt(nanoseconds, 10, 64); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(s, ns).UTC(), nil
+}
+
+// ensureRemovedRefsHidden stops removed refs being advertised to fetches and pushes. The
+// objects remain fetchable by id with uploadpack.allowUnreachable.
+func ensureRemovedRefsHidden(repo_path string) error {
+	output, _ := exec.Command("git", "-C", repo_path, "config", "--get-all", "transfer.hideRefs").Output()
+	if slices.Contains(strings.Split(string(output), "\n"), strings.TrimSuffix(RemovedRefsPrefix, "/")) {
+		return nil
+	}
+	if output, err := exec.Command("git", "-C", repo_path, "config", "--add", "transfer.hideRefs", strings.TrimSuffix(RemovedRefsPrefix, "/")).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to hide %s: %w, output: %s", RemovedRefsPrefix, err, string(output))
+	}
+	return nil
+}
+
+// updateRefs applies git update-ref --stdin instructions as a single transaction
+func updateRefs(repo_path string, instructions []string) error {
+	cmd := exec.Command("git", "-C", repo_path, "update-ref", "--stdin")
+	cmd.Stdin = strings.NewReader(strings.Join(instructions, "\n") + "\n")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// quarantineRefs moves refs (ref -> hash) under RemovedRefsPrefix in a single transaction,
+// so either every ref is moved or none are
+func quarantineRefs(repo_path string, refs map[string]string) error {
+	if err := ensureRemovedRefsHidden(repo_path); err != nil {
+		return err
+	}
+	now := time.Now()
+	instructions := []string{}
+	for _, ref := range sortedKeys(refs) {
+		instructions = append(instructions,
+			"create "+quarantineRef(ref, now)+" "+refs[ref],
+			"delete "+ref+" "+refs[ref],
+		)
+	}
+	if err := updateRefs(repo_path, instructions); err != nil {
+		return fmt.Errorf("failed to remove refs %s: %w", strings.Join(sortedKeys(refs), ", "), err)
+	}
+	return nil
+}
+
+// removeRefs removes refs (ref -> hash) that are missing from state by quarantining them. The
+// repository must be locked.
+// More than RefDeletionThreshold refs are only removed once the owner has confirmed the
+// removal with ConfirmPendingRefDeletion.
+func removeRefs(repo_path string, stateEventID string, refs map[string]string) error {
+	if removalNeedsConfirmation(repo_path, stateEventID, len(refs)) {
+		pending := &PendingRefDeletion{StateEventID: stateEventID, Refs: refs, DetectedAt: time.Now()}
+		if err := savePendingRefDeletion(repo_path, pending); err != nil {
+			return err
+		}
+		return fmt.Errorf("not removing %d refs missing from state event %s as it is more than %d, waiting for the owner to confirm", len(refs), stateEventID, RefDeletionThreshold())
+	}
+	if err := quarantineRefs(repo_path, refs); err != nil {
+		return err
+	}
+	return savePendingRefDeletion(repo_path, nil)
+}
+
+// removalNeedsConfirmation reports whether removing count refs missing from the state event
+// is over RefDeletionThreshold and hasn't been confirmed by the owner
+func removalNeedsConfirmation(repo_path string, stateEventID string, count int) bool {
+	if threshold := RefDeletionThreshold(); threshold <= 0 || count <= threshold {
+		return false
+	}
+	pending, err := LoadPendingRefDeletion(repo_path)
+	return err != nil || pending == nil || !pending.Confirmed || pending.StateEventID != stateEventID
+}
+
+// LoadPendingRefDeletion reads the removal waiting for the owner to confirm, nil if there
+// isn't one
+func LoadPendingRefDeletion(repo_path string) (*PendingRefDeletion, error) {
+	data, err := os.ReadFile(filepath.Join(repo_path, PendingRefDeletionFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pending := &PendingRefDeletion{}
+	if err := json.Unmarshal(data, pending); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+func savePendingRefDeletion(repo_path string, pending *PendingRefDeletion) error {
+	path := filepath.Join(repo_path, PendingRefDeletionFileName)
+	if pending == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(pending, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data, 0644)
+}
+
+// ConfirmPendingRefDeletion confirms the removal waiting for the owner so the next sync
+// against the same state event applies it
+func ConfirmPendingRefDeletion(repo_path string) (*PendingRefDeletion, error) {
+	pending, err := LoadPendingRefDeletion(repo_path)
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil {
+		return nil, fmt.Errorf("no ref removal is waiting for confirmation")
+	}
+	pending.Confirmed = true
+	return pending, savePendingRefDeletion(repo_path, pending)
+}
+
+// ListRemovedRefs returns the refs removed by syncs that are still kept, most recently
+// removed first
+func ListRemovedRefs(repo_path string) ([]RemovedRef, error) {
+	output, err := exec.Command("git", "-C", repo_path, "for-each-ref", "--format=%(objectname) %(refname)", RemovedRefsPrefix).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list removed refs: %w", err)
+	}
+	removed := []RemovedRef{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		hash, name, found := strings.Cut(line, " ")
+		if !found {
+			continue
+		}
+		stamp, ref, found := strings.Cut(strings.TrimPrefix(name, RemovedRefsPrefix), "/")
+		removedAt, err := parseQuarantineStamp(stamp)
+		if !found || err != nil {
+			continue
+		}
+		removed = append(removed, RemovedRef{
+			Ref:           "refs/" + ref,
+			Hash:          hash,
+			RemovedAt:     removedAt,
+			QuarantineRef: name,
+		})
+	}
+	slices.SortStableFunc(removed, func(a, b RemovedRef) int { return b.RemovedAt.Compare(a.RemovedAt) })
+	return removed, nil
+}
+
+// RestoreRemovedRefs moves removed refs back to their original names. selector is the unix
+// timestamp of a removal to restore every ref removed then, a ref name to restore its most
+// recent removal, or empty to restore the most recent removal. Syncs keep the restored refs
+// until a state event newer than the restore leaves them out.
+func RestoreRemovedRefs(repo_path string, selector string) ([]RemovedRef, error) {
+	lock, err := LockRepo(context.Background(), repo_path, "restore removed refs")
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	removed, err := ListRemovedRefs(repo_path)
+	if err != nil {
+		return nil, err
+	}
+	if len(removed) == 0 {
+		return nil, fmt.Errorf("there are no removed refs to restore")
+	}
+
+	restore := []RemovedRef{}
+	restoring := make(map[string]bool)
+	for _, r := range removed {
+		var selected bool
+		switch {
+		case selector == "":
+			selected = r.RemovedAt.Equal(removed[0].RemovedAt)
+		case selector == r.Ref || selector == r.QuarantineRef:
+			selected = true
+		default:
+			selected = selector == strconv.FormatInt(r.RemovedAt.Unix(), 10)
+		}
+		// only the most recent removal of each ref
+		if selected && !restoring[r.Ref] {
+			restore = append(restore, r)
+			restoring[r.Ref] = true
+		}
+	}
+	if len(restore) == 0 {
+		return nil, fmt.Errorf("no removed refs match %s", selector)
+	}
+
+	instructions := []string{}
+	for _, r := range restore {
+		instructions = append(instructions,
+			"create "+r.Ref+" "+r.Hash,
+			"delete "+r.QuarantineRef+" "+r.Hash,
+		)
+	}
+	if err := updateRefs(repo_path, instructions); err != nil {
+		return nil, fmt.Errorf("failed to restore refs, they may have been recreated since: %w", err)
+	}
+
+	restored, err := loadRestoredRefs(repo_path)
+	if err != nil {
+		restored = make(map[string]time.Time)
+	}
+	now := time.Now().UTC()
+	for _, r := range restore {
+		restored[r.Ref] = now
+	}
+	if err := saveRestoredRefs(repo_path, restored); err != nil {
+		return restore, fmt.Errorf("restored refs but the next sync may remove them again: %w", err)
+	}
+	return restore, nil
+}
+
+// loadRestoredRefs reads when each restored ref was restored (ref -> time)
+func loadRestoredRefs(repo_path string) (map[string]time.Time, error) {
+	restored := make(map[string]time.Time)
+	data, err := os.ReadFile(filepath.Join(repo_path, RestoredRefsFileName))
+	if os.IsNotExist(err) {
+		return restored, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &restored); err != nil {
+		return nil, err
+	}
+	return restored, nil
+}
+
+func saveRestoredRefs(repo_path string, restored map[string]time.Time) error {
+	path := filepath.Join(repo_path, RestoredRefsFileName)
+	if len(restored) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(restored, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data, 0644)
+}
+
+// keptRestoredRefs returns the refs restored since the state event was created, which a sync
+// to it mustn't remove
+func keptRestoredRefs(repo_path string, state *nip34.RepositoryState) map[string]bool {
+	kept := make(map[string]bool)
+	restored, _ := loadRestoredRefs(repo_path)
+	for ref, restoredAt := range restored {
+		if restoredAt.After(state.Event.CreatedAt.Time()) {
+			kept[ref] = true
+		}
+	}
+	return kept
+}
+
+// forgetRestoredRefs drops the records of refs restored before the state event was created,
+// as it supersedes the restore. The repository must be locked.
+func forgetRestoredRefs(repo_path string, state *nip34.RepositoryState) error {
+	restored, err := loadRestoredRefs(repo_path)
+	if err != nil || len(restored) == 0 {
+		return err
+	}
+	for ref, restoredAt := range restored {
+		if !restoredAt.After(state.Event.CreatedAt.Time()) {
+			delete(restored, ref)
+		}
+	}
+	return saveRestoredRefs(repo_path, restored)
+}
+
+// pruneRemovedRefs deletes removed refs kept for longer than retention, letting git gc
+// clean up their objects. The repository must be locked.
+func pruneRemovedRefs(repo_path string, retention time.Duration) error {
+	if retention <= 0 {
+		return nil
+	}
+	removed, err := ListRemovedRefs(repo_path)
+	if err != nil {
+		return err
+	}
+	instructions := []string{}
+	for _, r := range removed {
+		if time.Since(r.RemovedAt) > retention {
+			instructions = append(instructions, "delete "+r.QuarantineRef+" "+r.Hash)
+		}
+	}
+	if len(instructions) == 0 {
+		return nil
+	}
+	if err := updateRefs(repo_path, instructions); err != nil {
+		return fmt.Errorf("failed to prune removed refs: %w", err)
+	}
+	return nil
+}
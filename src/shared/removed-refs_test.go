@@ -0,0 +1,43 @@
+package shared
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestQuarantineRefsTwiceInOneSecond(t *testing.T) {
+	repo_path := filepath.Join(t.TempDir(), "repo.git")
+	if output, err := exec.Command("git", "init", "--bare", "--quiet", repo_path).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v, %s", err, output)
+	}
+
+	// the branch is removed, pushed again and removed again straight away
+	first := testCommit(t, repo_path, "refs/heads/feature", "", "first")
+	if err := quarantineRefs(repo_path, map[string]string{"refs/heads/feature": first}); err != nil {
+		t.Fatalf("quarantineRefs() error = %v", err)
+	}
+	second := testCommit(t, repo_path, "refs/heads/feature", "", "second")
+	if err := quarantineRefs(repo_path, map[string]string{"refs/heads/feature": second}); err != nil {
+		t.Fatalf("quarantineRefs() again error = %v", err)
+	}
+
+	removed, err := ListRemovedRefs(repo_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 || removed[0].Hash != second || removed[1].Hash != first {
+		t.Fatalf("ListRemovedRefs() = %+v, want both removals, most recent first", removed)
+	}
+
+	restored, err := RestoreRemovedRefs(repo_path, "")
+	if err != nil {
+		t.Fatalf("RestoreRemovedRefs() error = %v", err)
+	}
+	if len(restored) != 1 || restored[0].Hash != second {
+		t.Errorf("RestoreRemovedRefs() = %+v, want the most recent removal", restored)
+	}
+	if got := testGit(t, repo_path, "", "rev-parse", "refs/heads/feature"); got != second {
+		t.Errorf("refs/heads/feature restored to %s, want %s", got, second)
+	}
+}
@@ -0,0 +1,156 @@
+package shared
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A repository's bundle is created by ngit-relay-proactive-sync as a maintenance task and
+// published by ngit-relay-khatru, which stores it as a blossom blob, advertises it to git
+// clients with the bundle-uri capability and lists it in a kind 1063 event. They are separate
+// processes so the bundle is handed over as a pending bundle within the repository.
+const (
+	// PendingBundleFileName is a bundle waiting to be published
+	PendingBundleFileName = "ngit-bundle.pending"
+	// PendingBundleInfoFileName describes the pending bundle, written once it is complete
+	PendingBundleInfoFileName = "ngit-bundle-pending.json"
+	// RepoBundleFileName records the published bundle
+	RepoBundleFileName = "ngit-bundle.json"
+)
+
+// RepoBundlesEnabled reports whether bundles are created for clones to download from blossom.
+// Set with NGIT_GIT_BUNDLES. Bundles are public blobs so they aren't created when
+// NGIT_AUTH_TO_READ is enabled.
+func RepoBundlesEnabled() bool {
+	return GetEnvBool("NGIT_GIT_BUNDLES", true) && !GetEnvBool("NGIT_AUTH_TO_READ", false)
+}
+
+// repositories with less packed data than this are cheap enough to clone without a bundle
+func bundleMinSizeKiB() int { return getEnvInt("NGIT_BUNDLE_MIN_SIZE_MB", 10) * 1024 }
+
+// bundleInterval is the least time between bundles of a repository whose refs keep changing
+func bundleInterval() time.Duration {
+	return time.Duration(getEnvInt("NGIT_BUNDLE_INTERVAL_HOURS", 24)) * time.Hour
+}
+
+type RepoBundle struct {
+	SHA256    string            `json:"sha256"`
+	Size      int64             `json:"size"`
+	Refs      map[string]string `json:"refs"` // ref -> hash
+	CreatedAt time.Time         `json:"created_at"`
+	// set once published
+	URL     string `json:"url,omitempty"`
+	EventID string `json:"event_id,omitempty"`
+}
+
+// LoadRepoBundle reads the bundle published for a repository, nil if there isn't one
+func LoadRepoBundle(repo_path string) (*RepoBundle, error) {
+	return loadRepoBundleFile(filepath.Join(repo_path, RepoBundleFileName))
+}
+
+// LoadPendingRepoBundle reads the bundle waiting to be published, nil if there isn't one
+func LoadPendingRepoBundle(repo_path string) (*RepoBundle, error) {
+	return loadRepoBundleFile(filepath.Join(repo_path, PendingBundleInfoFileName))
+}
+
+func loadRepoBundleFile(path string) (*RepoBundle, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	bundle := &RepoBundle{}
+	if err := json.Unmarshal(data, bundle); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// SaveRepoBundle records the published bundle of a repository
+func SaveRepoBundle(repo_path string, bundle *RepoBundle) error {
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filepath.Join(repo_path, RepoBundleFileName), data, 0644)
+}
+
+// RemovePendingRepoBundle removes the pending bundle once published, or abandoned
+func RemovePendingRepoBundle(repo_path string) {
+	os.Remove(filepath.Join(repo_path, PendingBundleInfoFileName))
+	os.Remove(filepath.Join(repo_path, PendingBundleFileName))
+}
+
+// bundleDue reports whether a repository with stats needs a new bundle: it is big enough, its
+// refs have changed since the last bundle, which is at least bundleInterval old, and there
+// isn't a bundle waiting to be published
+func bundleDue(repo_path string, stats *RepoObjectStats) bool {
+	if !RepoBundlesEnabled() || stats.PackSizeKiB+stats.LooseSizeKiB < bundleMinSizeKiB() {
+		return false
+	}
+	if pending, _ := LoadPendingRepoBundle(repo_path); pending != nil {
+		return false
+	}
+	last, err := LoadRepoBundle(repo_path)
+	if err != nil || last == nil {
+		return true
+	}
+	if time.Since(last.CreatedAt) < bundleInterval() {
+		return false
+	}
+	refs, err := localSyncedRefs(repo_path)
+	return err == nil && len(refs) > 0 && !maps.Equal(refs, last.Refs)
+}
+
+// createRepoBundle writes a bundle of the refs in state, ie. excluding refs/nostr/ and
+// removed refs, as the pending bundle for ngit-relay-khatru to publish
+func createRepoBundle(repo_path string) error {
+	refs, err := localSyncedRefs(repo_path)
+	if err != nil {
+		return err
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+	RemovePendingRepoBundle(repo_path)
+
+	path := filepath.Join(repo_path, PendingBundleFileName)
+	cmd := exec.Command("git", "-C", repo_path, "bundle", "create", "--quiet", path, "--stdin")
+	cmd.Stdin = strings.NewReader(strings.Join(sortedKeys(refs), "\n") + "\n")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("%w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(RepoBundle{
+		SHA256:    hex.EncodeToString(hash.Sum(nil)),
+		Size:      size,
+		Refs:      refs,
+		CreatedAt: time.Now(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filepath.Join(repo_path, PendingBundleInfoFileName), data, 0644)
+}
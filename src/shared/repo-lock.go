@@ -0,0 +1,146 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// RepoLockFileName is the lock file, within a repository, held while refs are changed. The
+// git hooks, ngit-relay-khatru and ngit-relay-proactive-sync are separate processes, so the
+// lock is an flock on this file rather than a mutex.
+const RepoLockFileName = "ngit-relay.lock"
+
+// RepoLockTimeout is how long to wait for another process to release a repository lock. Set
+// with NGIT_REPO_LOCK_TIMEOUT_SECONDS.
+func RepoLockTimeout() time.Duration {
+	return time.Duration(getEnvInt("NGIT_REPO_LOCK_TIMEOUT_SECONDS", 120)) * time.Second
+}
+
+// LockHolder describes the process holding a lock, for diagnosing locks that are held too long
+type LockHolder struct {
+	PID        int       `json:"pid"`
+	Process    string    `json:"process"`
+	Purpose    string    `json:"purpose"`
+	AcquiredAt time.Time `json:"acquired_at"`
+}
+
+func (h LockHolder) String() string {
+	return fmt.Sprintf("%s (pid %d) for %s since %s", h.Process, h.PID, h.Purpose, h.AcquiredAt.Format(time.RFC3339))
+}
+
+type RepoLock struct {
+	file *os.File
+}
+
+// LockRepo waits up to RepoLockTimeout for the exclusive lock on a repository. Anything that
+// changes refs or HEAD must hold it so syncs can't interleave with pushes. purpose is
+// recorded for diagnostics, eg. "push" or "sync". The lock is released if the process exits.
+func LockRepo(ctx context.Context, repo_path string, purpose string) (*RepoLock, error) {
+	lock, err := lockFile(ctx, filepath.Join(repo_path, RepoLockFileName), purpose, RepoLockTimeout())
+	if err != nil {
+		return nil, fmt.Errorf("cannot lock repository %s: %w", repo_path, err)
+	}
+	return lock, nil
+}
+
+// ErrRepoBusy is returned by TryLockRepo when another process holds the lock
+var ErrRepoBusy = errors.New("repository is busy")
+
+// TryLockRepo takes the lock on a repository only if it is free, returning ErrRepoBusy
+// otherwise. For work that can wait until next time rather than hold up a push or sync.
+func TryLockRepo(repo_path string, purpose string) (*RepoLock, error) {
+	lock, err := lockFile(context.Background(), filepath.Join(repo_path, RepoLockFileName), purpose, 0)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, ErrRepoBusy
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot lock repository %s: %w", repo_path, err)
+	}
+	return lock, nil
+}
+
+// Unlock releases the lock
+func (l *RepoLock) Unlock() {
+	l.file.Truncate(0)
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+}
+
+// RepoLockHolder returns the process holding the lock on a repository, nil if it isn't locked
+func RepoLockHolder(repo_path string) *LockHolder {
+	path := filepath.Join(repo_path, RepoLockFileName)
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == nil {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		return nil
+	}
+	return readLockHolder(path)
+}
+
+func readLockHolder(path string) *LockHolder {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	holder := &LockHolder{}
+	if err := json.Unmarshal(data, holder); err != nil {
+		return nil
+	}
+	return holder
+}
+
+// lockFile takes an exclusive flock on path, creating it if needed, polling until timeout.
+// The holder is written to the file once locked.
+func lockFile(ctx context.Context, path string, purpose string, timeout time.Duration) (*RepoLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	// processes run as different users, eg. git-http-backend hooks run as nginx
+	os.Chmod(path, 0666)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			file.Close()
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			file.Close()
+			if holder := readLockHolder(path); holder != nil {
+				return nil, fmt.Errorf("gave up waiting for lock held by %s: %w", holder, ctx.Err())
+			}
+			return nil, fmt.Errorf("gave up waiting for lock: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+
+	process, _ := os.Executable()
+	data, _ := json.Marshal(LockHolder{
+		PID:        os.Getpid(),
+		Process:    filepath.Base(process),
+		Purpose:    purpose,
+		AcquiredAt: time.Now(),
+	})
+	file.Truncate(0)
+	file.WriteAt(data, 0)
+	return &RepoLock{file: file}, nil
+}
@@ -0,0 +1,29 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestTryLockRepo(t *testing.T) {
+	repo_path := t.TempDir()
+
+	lock, err := LockRepo(context.Background(), repo_path, "push")
+	if err != nil {
+		t.Fatalf("LockRepo() error = %v", err)
+	}
+	if _, err := TryLockRepo(repo_path, "maintenance"); !errors.Is(err, ErrRepoBusy) {
+		t.Fatalf("TryLockRepo() on a locked repository error = %v, want ErrRepoBusy", err)
+	}
+	lock.Unlock()
+
+	lock, err = TryLockRepo(repo_path, "maintenance")
+	if err != nil {
+		t.Fatalf("TryLockRepo() on a free repository error = %v", err)
+	}
+	if holder := RepoLockHolder(repo_path); holder == nil || holder.Purpose != "maintenance" {
+		t.Errorf("RepoLockHolder() = %v, want maintenance", holder)
+	}
+	lock.Unlock()
+}
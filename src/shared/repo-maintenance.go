@@ -0,0 +1,239 @@
+package shared
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RepoMaintenanceFileName is the file, within a repository, recording its last maintenance
+const RepoMaintenanceFileName = "ngit-maintenance.json"
+
+// maintenance tasks, run in this order
+const (
+	MaintenanceLooseObjects      = "loose-objects"
+	MaintenanceIncrementalRepack = "incremental-repack"
+	MaintenancePrune             = "prune"
+	MaintenanceCommitGraph       = "commit-graph"
+	MaintenanceMultiPackIndex    = "multi-pack-index"
+	MaintenanceBundle            = "bundle" // see RepoBundle
+)
+
+// RepoMaintenanceEnabled reports whether repositories get scheduled maintenance. Set with
+// NGIT_REPO_MAINTENANCE.
+func RepoMaintenanceEnabled() bool {
+	return GetEnvBool("NGIT_REPO_MAINTENANCE", true)
+}
+
+// maintenance thresholds, matching the defaults of git maintenance's auto conditions
+func maintenanceLooseObjects() int { return getEnvInt("NGIT_MAINTENANCE_LOOSE_OBJECTS", 100) }
+func maintenancePacks() int        { return getEnvInt("NGIT_MAINTENANCE_PACKS", 10) }
+func maintenancePruneInterval() time.Duration {
+	return time.Duration(getEnvInt("NGIT_MAINTENANCE_PRUNE_DAYS", 7)) * 24 * time.Hour
+}
+
+// maintenancePruneExpire is how old unreachable objects must be before they are pruned. With
+// uploadpack.allowUnreachable clients can fetch unreachable objects by id, and syncs fetch
+// objects before pointing refs at them, so recent unreachable objects are always kept.
+func maintenancePruneExpire() string {
+	return getEnv("NGIT_MAINTENANCE_PRUNE_EXPIRE", "2.weeks.ago")
+}
+
+type RepoObjectStats struct {
+	LooseObjects      int  `json:"loose_objects"`
+	LooseSizeKiB      int  `json:"loose_size_kib"`
+	Packs             int  `json:"packs"`
+	PackSizeKiB       int  `json:"pack_size_kib"`
+	Garbage           int  `json:"garbage"`
+	HasCommitGraph    bool `json:"has_commit_graph"`
+	HasMultiPackIndex bool `json:"has_multi_pack_index"`
+	HasBitmap         bool `json:"has_bitmap"`
+}
+
+type RepoMaintenance struct {
+	LastRun   *time.Time       `json:"last_run,omitempty"`
+	LastPrune *time.Time       `json:"last_prune,omitempty"`
+	Tasks     []string         `json:"tasks"` // run at LastRun
+	Duration  time.Duration    `json:"duration"`
+	Before    *RepoObjectStats `json:"before,omitempty"`
+	After     *RepoObjectStats `json:"after,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// GetRepoObjectStats reports the object storage of a repository, used to decide which
+// maintenance tasks are due
+func GetRepoObjectStats(repo_path string) (*RepoObjectStats, error) {
+	output, err := exec.Command("git", "-C", repo_path, "count-objects", "-v").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to count objects: %w", err)
+	}
+	values := make(map[string]int)
+	for _, line := range strings.Split(string(output), "\n") {
+		if key, value, found := strings.Cut(line, ": "); found {
+			values[key], _ = strconv.Atoi(value)
+		}
+	}
+	stats := &RepoObjectStats{
+		LooseObjects: values["count"],
+		LooseSizeKiB: values["size"],
+		Packs:        values["packs"],
+		PackSizeKiB:  values["size-pack"],
+		Garbage:      values["garbage"],
+	}
+	objects := filepath.Join(repo_path, "objects")
+	if _, err := os.Stat(filepath.Join(objects, "info", "commit-graph")); err == nil {
+		stats.HasCommitGraph = true
+	} else if _, err := os.Stat(filepath.Join(objects, "info", "commit-graphs")); err == nil {
+		stats.HasCommitGraph = true
+	}
+	if _, err := os.Stat(filepath.Join(objects, "pack", "multi-pack-index")); err == nil {
+		stats.HasMultiPackIndex = true
+	}
+	if bitmaps, _ := filepath.Glob(filepath.Join(objects, "pack", "*.bitmap")); len(bitmaps) > 0 {
+		stats.HasBitmap = true
+	}
+	return stats, nil
+}
+
+// LoadRepoMaintenance reads the record of a repository's last maintenance
+func LoadRepoMaintenance(repo_path string) (*RepoMaintenance, error) {
+	maintenance := &RepoMaintenance{Tasks: []string{}}
+	data, err := os.ReadFile(filepath.Join(repo_path, RepoMaintenanceFileName))
+	if os.IsNotExist(err) {
+		return maintenance, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, maintenance); err != nil {
+		return nil, err
+	}
+	return maintenance, nil
+}
+
+// MaintenanceTasksDue returns the tasks due for a repository with stats, given its last
+// maintenance
+func MaintenanceTasksDue(stats *RepoObjectStats, last *RepoMaintenance) []string {
+	tasks := []string{}
+	if stats.LooseObjects >= maintenanceLooseObjects() {
+		tasks = append(tasks, MaintenanceLooseObjects)
+	}
+	if stats.Packs >= maintenancePacks() {
+		tasks = append(tasks, MaintenanceIncrementalRepack)
+	}
+	if interval := maintenancePruneInterval(); interval > 0 && stats.LooseObjects+stats.Packs > 0 &&
+		(last.LastPrune == nil || time.Since(*last.LastPrune) >= interval) {
+		tasks = append(tasks, MaintenancePrune)
+	}
+	// the indexes are rewritten whenever packs change
+	if len(tasks) > 0 || (stats.Packs > 0 && !stats.HasCommitGraph) {
+		tasks = append(tasks, MaintenanceCommitGraph)
+	}
+	if len(tasks) > 0 || (stats.Packs > 0 && !stats.HasMultiPackIndex) {
+		tasks = append(tasks, MaintenanceMultiPackIndex)
+	}
+	return tasks
+}
+
+// MaintainRepo runs the maintenance tasks due for a repository and records the outcome. It
+// returns nil if no tasks are due. Maintenance holds the repository's lock throughout, so
+// pushes and syncs wait for it rather than run alongside it; if a push, sync or other
+// maintenance already holds the lock it returns nil without doing anything and the
+// repository is tried again next time.
+//
+// Object pools are maintained by MaintainObjectPool instead.
+func MaintainRepo(repo_path string) (*RepoMaintenance, error) {
+	lock, err := TryLockRepo(repo_path, "maintenance")
+	if errors.Is(err, ErrRepoBusy) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	if err := ensureSafeDirectory(repo_path); err != nil {
+		return nil, err
+	}
+	last, err := LoadRepoMaintenance(repo_path)
+	if err != nil {
+		last = &RepoMaintenance{}
+	}
+	before, err := GetRepoObjectStats(repo_path)
+	if err != nil {
+		return nil, err
+	}
+	tasks := MaintenanceTasksDue(before, last)
+	// after repacking, so the bundle is created from fewer packs
+	if bundleDue(repo_path, before) {
+		tasks = append(tasks, MaintenanceBundle)
+	}
+	if len(tasks) == 0 {
+		return nil, nil
+	}
+
+	start := time.Now()
+	maintenance := &RepoMaintenance{LastRun: &start, LastPrune: last.LastPrune, Tasks: tasks, Before: before}
+	for _, task := range tasks {
+		if err := runMaintenanceTask(repo_path, task); err != nil {
+			maintenance.Error = fmt.Sprintf("%s: %v", task, err)
+			break
+		}
+		if task == MaintenancePrune {
+			maintenance.LastPrune = &start
+		}
+	}
+	maintenance.Duration = time.Since(start)
+	maintenance.After, _ = GetRepoObjectStats(repo_path)
+
+	data, err := json.MarshalIndent(maintenance, "", "  ")
+	if err == nil {
+		err = WriteFileAtomic(filepath.Join(repo_path, RepoMaintenanceFileName), data, 0644)
+	}
+	if maintenance.Error != "" {
+		return maintenance, fmt.Errorf("maintenance task %s", maintenance.Error)
+	}
+	return maintenance, err
+}
+
+func runMaintenanceTask(repo_path string, task string) error {
+	// objects borrowed from an object pool can't be included in bitmaps
+	borrows := len(ObjectPoolsOf(repo_path)) > 0
+
+	var commands [][]string
+	switch task {
+	case MaintenanceLooseObjects, MaintenanceIncrementalRepack, MaintenanceCommitGraph:
+		commands = [][]string{{"maintenance", "run", "--task=" + task, "--quiet"}}
+	case MaintenancePrune:
+		// unreachable objects are kept in a cruft pack until they expire, rather than being
+		// deleted, and objects in an object pool are left to the pool
+		commands = [][]string{
+			{"repack", "-d", "-l", "--cruft", "--cruft-expiration=" + maintenancePruneExpire(), "-q"},
+			{"prune", "--expire=" + maintenancePruneExpire()},
+		}
+	case MaintenanceBundle:
+		return createRepoBundle(repo_path)
+	case MaintenanceMultiPackIndex:
+		write := []string{"multi-pack-index", "write", "--no-progress"}
+		if !borrows {
+			write = append(write, "--bitmap")
+		}
+		commands = [][]string{write}
+	default:
+		return fmt.Errorf("unknown maintenance task")
+	}
+
+	for _, args := range commands {
+		cmd := exec.Command("git", append([]string{"-C", repo_path}, args...)...)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git %s: %w, output: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package shared
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaintainRepoSkipsLockedRepository(t *testing.T) {
+	t.Setenv("NGIT_MAINTENANCE_LOOSE_OBJECTS", "1")
+	repo_path := filepath.Join(t.TempDir(), "repo.git")
+	if output, err := exec.Command("git", "init", "--bare", "--quiet", repo_path).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v, %s", err, output)
+	}
+	// a loose object makes the loose-objects task due
+	cmd := exec.Command("git", "-C", repo_path, "hash-object", "-w", "--stdin")
+	cmd.Stdin = strings.NewReader("an object waiting to be packed")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git hash-object: %v, %s", err, output)
+	}
+
+	lock, err := LockRepo(context.Background(), repo_path, "push")
+	if err != nil {
+		t.Fatalf("LockRepo() error = %v", err)
+	}
+	// maintenance is skipped rather than run alongside the push
+	if maintenance, err := MaintainRepo(repo_path); maintenance != nil || err != nil {
+		t.Fatalf("MaintainRepo() on a locked repository = %v, %v, want nil, nil", maintenance, err)
+	}
+	if _, err := os.Stat(filepath.Join(repo_path, RepoMaintenanceFileName)); !os.IsNotExist(err) {
+		t.Errorf("skipped maintenance was recorded, stat error = %v", err)
+	}
+	lock.Unlock()
+
+	maintenance, err := MaintainRepo(repo_path)
+	if err != nil {
+		t.Fatalf("MaintainRepo() on a free repository error = %v", err)
+	}
+	if maintenance == nil || len(maintenance.Tasks) == 0 || maintenance.Tasks[0] != MaintenanceLooseObjects {
+		t.Fatalf("MaintainRepo() on a free repository = %+v, want the loose-objects task run", maintenance)
+	}
+	if holder := RepoLockHolder(repo_path); holder != nil {
+		t.Errorf("lock still held by %s after maintenance", holder)
+	}
+}
@@ -0,0 +1,245 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr/nip34"
+)
+
+// SyncPlan is what ProactiveSyncGitFromStateAndServers would do to align a repository with
+// its state event
+type SyncPlan struct {
+	RepoPath     string `json:"repo_path"`
+	StateEventID string `json:"state_event_id"`
+	// Remove are refs missing from state that would be moved under RemovedRefsPrefix
+	Remove []PlannedRefChange `json:"remove"`
+	// RemoveNeedsConfirmation is set when Remove is over RefDeletionThreshold and would wait
+	// for the owner to confirm
+	RemoveNeedsConfirmation bool `json:"remove_needs_confirmation,omitempty"`
+	// Update are refs whose state objects are already in the repository
+	Update []PlannedRefChange `json:"update"`
+	// Fetch are refs whose state objects would be fetched from Servers
+	Fetch []PlannedRefChange `json:"fetch"`
+	// Servers are the git servers that would be tried for Fetch, in order
+	Servers []string     `json:"servers"`
+	HEAD    *PlannedHEAD `json:"head,omitempty"`
+}
+
+type PlannedRefChange struct {
+	Ref  string `json:"ref"`
+	From string `json:"from,omitempty"` // empty if the ref doesn't exist locally
+	To   string `json:"to,omitempty"`   // empty if the ref would be removed
+	// Server is the first git server found advertising To at Ref, for refs to fetch. It is
+	// empty if none do, in which case the objects would still be requested by id.
+	Server string `json:"server,omitempty"`
+}
+
+type PlannedHEAD struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// IsEmpty reports whether the repository already matches the state event
+func (p *SyncPlan) IsEmpty() bool {
+	return len(p.Remove) == 0 && len(p.Update) == 0 && len(p.Fetch) == 0 && p.HEAD == nil
+}
+
+func (p *SyncPlan) String() string {
+	if p.IsEmpty() {
+		return fmt.Sprintf("%s: in sync with state event %s\n", p.RepoPath, p.StateEventID)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: to align with state event %s\n", p.RepoPath, p.StateEventID)
+	for _, change := range p.Remove {
+		held := ""
+		if p.RemoveNeedsConfirmation {
+			held = " (waits for owner confirmation)"
+		}
+		fmt.Fprintf(&b, "  remove %s at %s%s\n", change.Ref, shortHash(change.From), held)
+	}
+	for _, change := range p.Update {
+		fmt.Fprintf(&b, "  update %s %s -> %s\n", change.Ref, orNone(shortHash(change.From)), shortHash(change.To))
+	}
+	for _, change := range p.Fetch {
+		server := change.Server
+		if server == "" {
+			server = "any of " + orNone(strings.Join(p.Servers, ", "))
+		}
+		fmt.Fprintf(&b, "  fetch  %s %s -> %s from %s\n", change.Ref, orNone(shortHash(change.From)), shortHash(change.To), server)
+	}
+	if p.HEAD != nil {
+		fmt.Fprintf(&b, "  HEAD   %s -> %s\n", orNone(p.HEAD.From), p.HEAD.To)
+	}
+	return b.String()
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
+
+// PlanProactiveSyncGit returns what ProactiveSyncGit would do without changing the
+// repository. Git servers are queried to find which would serve each missing ref.
+func PlanProactiveSyncGit(pubkey string, identifier string, git_data_path string) (*SyncPlan, error) {
+	state, gitServers, repo_path, err := getStateAndGitServers(pubkey, identifier, git_data_path)
+	if err != nil {
+		return nil, err
+	}
+	return planSync(state, gitServers, repo_path, true)
+}
+
+// PlanProactiveSyncGitFromStateAndServers returns what ProactiveSyncGitFromStateAndServers
+// would do without changing the repository. Git servers are queried to find which would
+// serve each missing ref.
+func PlanProactiveSyncGitFromStateAndServers(state *nip34.RepositoryState, gitServers []string, repo_path string) (*SyncPlan, error) {
+	return planSync(state, gitServers, repo_path, true)
+}
+
+// planSync compares the repository with state. When probe is set each git server is listed,
+// in the order they would be tried, to find which advertises each ref to fetch. It only
+// reads, so a dry run leaves the repository and git's global config untouched.
+func planSync(state *nip34.RepositoryState, gitServers []string, repo_path string, probe bool) (*SyncPlan, error) {
+	// check we can open the directory
+	if _, err := os.Stat(repo_path); err != nil {
+		return nil, fmt.Errorf("cannot open repo directory: %w", err)
+	}
+
+	// Check repo_path is a git repository
+	cmd := repoGit(repo_path, "rev-parse", "--git-dir")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("not a git repository at %s: %w\nOutput: %s", repo_path, err, string(output))
+	}
+
+	localRefs, err := localSyncedRefs(repo_path)
+	if err != nil {
+		return nil, err
+	}
+	stateRefs := StateRefs(state)
+
+	plan := &SyncPlan{
+		RepoPath:     repo_path,
+		StateEventID: state.Event.ID,
+		Remove:       []PlannedRefChange{},
+		Update:       []PlannedRefChange{},
+		Fetch:        []PlannedRefChange{},
+		Servers:      []string{},
+	}
+	for _, server := range OrderGitServersByHealth(GitDataPathFromRepoPath(repo_path), gitServers) {
+		if server != "" {
+			plan.Servers = append(plan.Servers, server)
+		}
+	}
+
+	// refs the owner restored are kept until a newer state event
+	kept := keptRestoredRefs(repo_path, state)
+	for _, ref := range sortedKeys(localRefs) {
+		if _, exists := stateRefs[ref]; !exists && !kept[ref] {
+			plan.Remove = append(plan.Remove, PlannedRefChange{Ref: ref, From: localRefs[ref]})
+		}
+	}
+	plan.RemoveNeedsConfirmation = len(plan.Remove) > 0 && removalNeedsConfirmation(repo_path, state.Event.ID, len(plan.Remove))
+
+	for _, ref := range sortedKeys(stateRefs) {
+		hash := stateRefs[ref]
+		if localRefs[ref] == hash {
+			continue
+		}
+		change := PlannedRefChange{Ref: ref, From: localRefs[ref], To: hash}
+		if hasObject(repo_path, hash) {
+			plan.Update = append(plan.Update, change)
+		} else {
+			plan.Fetch = append(plan.Fetch, change)
+		}
+	}
+
+	if probe && len(plan.Fetch) > 0 {
+		for _, server := range plan.Servers {
+			advertised, err := listRemoteRefs(server)
+			if err != nil {
+				continue
+			}
+			found := true
+			for i, change := range plan.Fetch {
+				if change.Server == "" && advertised[change.Ref] == change.To {
+					plan.Fetch[i].Server = server
+				}
+				found = found && plan.Fetch[i].Server != ""
+			}
+			if found {
+				break
+			}
+		}
+	}
+
+	if targetRef := stateHEADRef(state); targetRef != "" {
+		if _, exists := stateRefs[targetRef]; exists {
+			output, _ := repoGit(repo_path, "symbolic-ref", "-q", "HEAD").Output()
+			if current := strings.TrimSpace(string(output)); current != targetRef {
+				plan.HEAD = &PlannedHEAD{From: current, To: targetRef}
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+// repoGit returns a git command for repo_path which trusts the repository for that command
+// only, rather than adding it to the global safe.directory list like ensureSafeDirectory
+func repoGit(repo_path string, args ...string) *exec.Cmd {
+	return exec.Command("git", append([]string{"-c", "safe.directory=" + repo_path, "-C", repo_path}, args...)...)
+}
+
+// localSyncedRefs returns the refs a sync aligns with state, excluding refs/nostr/ which are
+// not in the state event and refs already removed
+func localSyncedRefs(repo_path string) (map[string]string, error) {
+	output, err := repoGit(repo_path, "show-ref").Output()
+	localRefs := make(map[string]string)
+	// It's okay if this fails with exit status 1 (no refs found)
+	if exitErr, ok := err.(*exec.ExitError); err != nil && (!ok || exitErr.ExitCode() != 1) {
+		return nil, fmt.Errorf("error getting local refs: %w", err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		hash, ref, found := strings.Cut(line, " ")
+		if found && !strings.HasPrefix(ref, "refs/nostr/") && !strings.HasPrefix(ref, RemovedRefsPrefix) {
+			localRefs[ref] = hash
+		}
+	}
+	return localRefs, nil
+}
+
+// stateHEADRef returns the ref the state event's HEAD points at, if it has one
+func stateHEADRef(state *nip34.RepositoryState) string {
+	if state.HEAD == "" {
+		return ""
+	}
+	if strings.HasPrefix(state.HEAD, "refs/") {
+		return state.HEAD
+	}
+	return "refs/heads/" + state.HEAD
+}
+
+// listRemoteRefs returns the refs advertised by the repository at repo_url
+func listRemoteRefs(repo_url string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", repo_url)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if hash, ref, found := strings.Cut(line, "\t"); found {
+			refs[ref] = hash
+		}
+	}
+	return refs, nil
+}
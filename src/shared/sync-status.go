@@ -0,0 +1,77 @@
+package shared
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr/nip34"
+)
+
+// SyncStatusFileName is the file, within a repository, recording the outcome of the last
+// attempt to align it with its state event. It is written by whichever process ran the sync:
+// ngit-relay-khatru, the git hooks or ngit-relay-proactive-sync.
+const SyncStatusFileName = "ngit-sync-status.json"
+
+type SyncStatus struct {
+	LastAttempt  *time.Time        `json:"last_attempt,omitempty"`
+	LastSuccess  *time.Time        `json:"last_success,omitempty"`
+	StateEventID string            `json:"state_event_id,omitempty"` // state event last aligned to
+	InSync       bool              `json:"in_sync"`
+	MissingRefs  []string          `json:"missing_refs"`
+	ServerErrors map[string]string `json:"server_errors,omitempty"` // git server url -> error
+	Error        string            `json:"error,omitempty"`
+}
+
+// LoadSyncStatus reads the sync status of a repository. A repository that has never been
+// synced returns an empty SyncStatus.
+func LoadSyncStatus(repo_path string) (*SyncStatus, error) {
+	status := &SyncStatus{MissingRefs: []string{}}
+	data, err := os.ReadFile(filepath.Join(repo_path, SyncStatusFileName))
+	if os.IsNotExist(err) {
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, status); err != nil {
+		return nil, err
+	}
+	if status.MissingRefs == nil {
+		status.MissingRefs = []string{}
+	}
+	return status, nil
+}
+
+// recordSyncStatus records the outcome of a sync attempt. state is nil if the sync failed
+// before the state event was found.
+func recordSyncStatus(repo_path string, state *nip34.RepositoryState, missingRefs []string, serverErrors map[string]string, syncErr error) {
+	status, err := LoadSyncStatus(repo_path)
+	if err != nil {
+		status = &SyncStatus{}
+	}
+	now := time.Now()
+	status.LastAttempt = &now
+	status.MissingRefs = missingRefs
+	if status.MissingRefs == nil {
+		status.MissingRefs = []string{}
+	}
+	status.ServerErrors = serverErrors
+	status.Error = ""
+	if syncErr != nil {
+		status.Error = syncErr.Error()
+	}
+	status.InSync = state != nil && len(missingRefs) == 0
+	if status.InSync {
+		status.LastSuccess = &now
+		status.StateEventID = state.Event.ID
+	}
+
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return
+	}
+	// the repository may not exist yet, in which case there is nothing to record
+	WriteFileAtomic(filepath.Join(repo_path, SyncStatusFileName), data, 0644)
+}
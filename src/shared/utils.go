@@ -13,7 +13,17 @@ import (
 	"github.com/nbd-wtf/go-nostr/nip34"
 )
 
+// FetchAnnouncementAndStateEventsFromRelay gets the announcement and state events for the
+// identifier from ngit-relay-khatru, via the query socket when available
 func FetchAnnouncementAndStateEventsFromRelay(ctx context.Context, identifier string) ([]nostr.Event, error) {
+	if socket_path := QuerySocketPath(); socket_path != "" {
+		if _, err := os.Stat(socket_path); err == nil {
+			if events, err := FetchAnnouncementAndStateEventsFromSocket(ctx, socket_path, identifier); err == nil {
+				return events, nil
+			}
+		}
+	}
+
 	// Create the filter for repository announcements and states
 	identifierAnnFilter := nostr.Filter{
 		Kinds: []int{nostr.KindRepositoryAnnouncement, nostr.KindRepositoryState},
@@ -22,10 +32,11 @@ func FetchAnnouncementAndStateEventsFromRelay(ctx context.Context, identifier st
 		},
 	}
 
-	relay, err := nostr.RelayConnect(ctx, "ws://localhost:3334")
+	relay, err := nostr.RelayConnect(ctx, InternalRelayURL())
 	if err != nil {
 		return nil, fmt.Errorf("could not connect to internal relay to find state event")
 	}
+	defer relay.Close()
 
 	var events []nostr.Event
 
@@ -51,6 +62,69 @@ func FetchAnnouncementAndStateEventsFromRelay(ctx context.Context, identifier st
 	return events, nil
 }
 
+// FetchEventsByIDFromRelay gets the events with ids from ngit-relay-khatru, via the query
+// socket when available
+func FetchEventsByIDFromRelay(ctx context.Context, ids []string) ([]nostr.Event, error) {
+	if len(ids) == 0 {
+		return []nostr.Event{}, nil
+	}
+	if socket_path := QuerySocketPath(); socket_path != "" {
+		if _, err := os.Stat(socket_path); err == nil {
+			if events, err := FetchEventsByIDFromSocket(ctx, socket_path, ids); err == nil {
+				return events, nil
+			}
+		}
+	}
+
+	relay, err := nostr.RelayConnect(ctx, InternalRelayURL())
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to internal relay to find events")
+	}
+	defer relay.Close()
+	events, err := relay.QuerySync(ctx, nostr.Filter{IDs: ids})
+	if err != nil {
+		return nil, fmt.Errorf("could not query internal relay to find events")
+	}
+	result := make([]nostr.Event, 0, len(events))
+	for _, ev := range events {
+		result = append(result, *ev)
+	}
+	return result, nil
+}
+
+// SubscribeToStateEventsFromRelay follows state events for the identifier published by the
+// maintainers after since, until ctx is done
+func SubscribeToStateEventsFromRelay(ctx context.Context, identifier string, maintainers []string, since nostr.Timestamp) (<-chan nostr.Event, error) {
+	relay, err := nostr.RelayConnect(ctx, InternalRelayURL())
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to internal relay to follow state events")
+	}
+	sub, err := relay.Subscribe(ctx, []nostr.Filter{{
+		Kinds:   []int{nostr.KindRepositoryState},
+		Authors: maintainers,
+		Tags:    nostr.TagMap{"d": []string{identifier}},
+		Since:   &since,
+	}})
+	if err != nil {
+		relay.Close()
+		return nil, fmt.Errorf("could not subscribe to internal relay to follow state events")
+	}
+
+	states := make(chan nostr.Event)
+	go func() {
+		defer close(states)
+		defer relay.Close()
+		for ev := range sub.Events {
+			select {
+			case states <- *ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return states, nil
+}
+
 func GetState(events []nostr.Event, pubkey string, identifier string) (*nip34.RepositoryState, error) {
 	maintainers := GetMaintainers(events, pubkey, identifier)
 	if len(maintainers) == 0 {
@@ -241,3 +315,64 @@ func GetEnvBool(key string, defaultValue bool) bool {
 	}
 	return boolValue
 }
+
+// ListRepoPaths returns the path of every repository hosted in git_data_path, which has a
+// structure of [git_data_path]/npub123/repo.git
+func ListRepoPaths(git_data_path string) ([]string, error) {
+	npubDirs, err := os.ReadDir(git_data_path)
+	if err != nil {
+		return nil, err
+	}
+
+	repoPaths := []string{}
+	for _, npubDir := range npubDirs {
+		if !npubDir.IsDir() || !strings.HasPrefix(npubDir.Name(), "npub") {
+			continue // Skip if not a directory or not an npub directory
+		}
+
+		npubPath := filepath.Join(git_data_path, npubDir.Name())
+		repoDirs, err := os.ReadDir(npubPath)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, repoDir := range repoDirs {
+			if !repoDir.IsDir() || !strings.HasSuffix(repoDir.Name(), ".git") {
+				continue // Skip if not a directory or not a git repository
+			}
+			repoPaths = append(repoPaths, filepath.Join(npubPath, repoDir.Name()))
+		}
+	}
+	return repoPaths, nil
+}
+
+// ArchiveDirName is the directory within git_data_path holding read-only archived
+// repositories that don't list this instance: [git_data_path]/archive/npub123/repo.git
+const ArchiveDirName = "archive"
+
+// IsValidIdentifier reports whether a repository identifier can be used as a directory name
+// within git_data_path, ie. it has no path separators and isn't "." or ".." so it can't
+// escape git_data_path or nest repositories
+func IsValidIdentifier(identifier string) bool {
+	return identifier != "" && identifier != "." && identifier != ".." && !strings.ContainsAny(identifier, "/\\\x00")
+}
+
+// RepoPath returns the path of a repository within git_data_path
+func RepoPath(git_data_path string, npub string, identifier string) string {
+	return git_data_path + "/" + npub + "/" + identifier + ".git"
+}
+
+// IsArchiveRepoPath reports whether repo_path is within the archive namespace
+func IsArchiveRepoPath(repo_path string) bool {
+	return filepath.Base(filepath.Dir(filepath.Dir(filepath.Clean(repo_path)))) == ArchiveDirName
+}
+
+// GitDataPathFromRepoPath returns the git_data_path containing repo_path, including for
+// repositories in the archive namespace
+func GitDataPathFromRepoPath(repo_path string) string {
+	git_data_path := filepath.Dir(filepath.Dir(filepath.Clean(repo_path)))
+	if filepath.Base(git_data_path) == ArchiveDirName {
+		return filepath.Dir(git_data_path)
+	}
+	return git_data_path
+}
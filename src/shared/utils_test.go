@@ -53,3 +53,27 @@ func TestGetPubKeyAndIdentifierFromPath(t *testing.T) {
 		t.Errorf("Expected identifier: %s, got: %s", expectedIdentifier, identifier)
 	}
 }
+
+func TestIsValidIdentifier(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"repo", true},
+		{"my-repo.v2", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../other", false},
+		{"v1..v2", true},
+		{"..hidden", true},
+		{"nested/repo", false},
+		{"back\\slash", false},
+	}
+
+	for _, test := range tests {
+		if result := IsValidIdentifier(test.input); result != test.expected {
+			t.Errorf("IsValidIdentifier(%q) = %v, want %v", test.input, result, test.expected)
+		}
+	}
+}